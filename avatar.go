@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/wharfapi"
+	"github.com/iver-wharf/wharf-core/pkg/ginutil"
+	"github.com/iver-wharf/wharf-core/pkg/problem"
+	"github.com/xanzy/go-gitlab"
+)
+
+// cachedAvatar is an avatar downloaded from GitLab, when it was downloaded,
+// and the Wharf project it was served for.
+type cachedAvatar struct {
+	avatar
+	FetchedAt      time.Time `json:"fetchedAt"`
+	WharfProjectID uint      `json:"wharfProjectId"`
+}
+
+type avatarCache struct {
+	files   jsonFileStore
+	ttl     time.Duration
+	maxSize int64
+}
+
+// newAvatarCache returns nil if the avatar cache is disabled, in which case
+// avatars are downloaded on every request.
+func newAvatarCache(config AvatarProxyConfig) *avatarCache {
+	if config.CacheDir == "" {
+		return nil
+	}
+	return &avatarCache{jsonFileStore{config.CacheDir}, config.CacheTTL, config.CacheMaxSize}
+}
+
+// load returns the cached avatar, or false if it is not cached or was
+// downloaded longer ago than the TTL. A nil cache never has any.
+func (c *avatarCache) load(key string, now time.Time) (cachedAvatar, bool, error) {
+	if c == nil {
+		return cachedAvatar{}, false, nil
+	}
+	var cached cachedAvatar
+	ok, err := c.files.load(key, &cached)
+	if err != nil || !ok || now.Sub(cached.FetchedAt) > c.ttl {
+		return cachedAvatar{}, false, err
+	}
+	return cached, true, nil
+}
+
+// save caches the avatar, and then removes the avatars that were downloaded
+// the longest time ago until the cache is within its size limit.
+func (c *avatarCache) save(key string, a cachedAvatar) error {
+	if c == nil {
+		return nil
+	}
+	if err := c.files.save(key, a); err != nil {
+		return err
+	}
+	return c.files.evictOldest(c.maxSize)
+}
+
+func (c *avatarCache) remove(key string) error {
+	if c == nil {
+		return nil
+	}
+	return c.files.remove(key)
+}
+
+// avatarKey returns the file-safe name of the cached avatar of a GitLab
+// project from a given provider.
+func avatarKey(providerID uint, gitLabProjectID int) string {
+	return fmt.Sprintf("provider-%d-project-%d", providerID, gitLabProjectID)
+}
+
+// errProjectNotImported is returned when an avatar is requested for a GitLab
+// project that is not imported into Wharf using the provider.
+var errProjectNotImported = errors.New("project is not imported into Wharf using this provider")
+
+// getCachedProjectAvatar returns the avatar of the GitLab project from the
+// cache if it was downloaded recently, or downloads it using the importer
+// from newImporter, or returns false if the project has no avatar.
+//
+// A cached avatar is only served while the Wharf project it was downloaded
+// for is still imported from the GitLab project using the provider, which is
+// checked with a single call to the Wharf API. The importer is only created
+// on a cache miss, as that costs further calls to the Wharf and GitLab APIs.
+// Failures to use the cache are only logged.
+func getCachedProjectAvatar(ctx context.Context, cache *avatarCache, wharfClient wharfClientAPIFetcher, providerID uint, gitLabProjectID int, maxSize int64, now time.Time, newImporter func(ctx context.Context) (*gitLabImporter, error)) (avatar, bool, error) {
+	key := avatarKey(providerID, gitLabProjectID)
+	cached, ok, err := cache.load(key, now)
+	if err != nil {
+		log.Warn().WithError(err).WithString("avatar", key).Message("Failed to load cached avatar, downloading it instead.")
+	}
+	if ok {
+		imported, err := isWharfProjectImportedFrom(ctx, wharfClient, cached.WharfProjectID, providerID, gitLabProjectID)
+		if err != nil {
+			return avatar{}, false, err
+		}
+		if !imported {
+			if err := cache.remove(key); err != nil {
+				log.Warn().WithError(err).WithString("avatar", key).Message("Failed to remove cached avatar.")
+			}
+			return avatar{}, false, errProjectNotImported
+		}
+		return cached.avatar, true, nil
+	}
+
+	importer, err := newImporter(ctx)
+	if err != nil {
+		return avatar{}, false, err
+	}
+	downloaded, ok, err := importer.getProjectAvatar(ctx, gitLabProjectID, maxSize)
+	if err != nil || !ok {
+		return avatar{}, ok, err
+	}
+	downloaded.FetchedAt = now
+	if err := cache.save(key, downloaded); err != nil {
+		log.Warn().WithError(err).WithString("avatar", key).Message("Failed to cache avatar.")
+	}
+	return downloaded.avatar, true, nil
+}
+
+// isWharfProjectImportedFrom returns true if the Wharf project still exists
+// and is imported from the GitLab project using the provider.
+func isWharfProjectImportedFrom(ctx context.Context, wharfClient wharfClientAPIFetcher, wharfProjectID, providerID uint, gitLabProjectID int) (bool, error) {
+	proj, err := wharfClient.GetProject(ctx, wharfProjectID)
+	var prob problem.Response
+	if errors.As(err, &prob) && prob.Status == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return proj.ProviderID == providerID && isRemoteProjectID(proj.RemoteProjectID, gitLabProjectID), nil
+}
+
+// getProjectAvatar downloads the avatar of the GitLab project, or returns
+// false if the project has no avatar. As the avatar is downloaded using the
+// provider's token, only projects that are imported into Wharf using the
+// provider are served, and errProjectNotImported is returned for others.
+func (importer gitLabImporter) getProjectAvatar(ctx context.Context, gitLabProjectID int, maxSize int64) (cachedAvatar, bool, error) {
+	gitLabProject, err := importer.gitLabClient.getProjectByID(ctx, gitLabProjectID)
+	if err != nil {
+		return cachedAvatar{}, false, err
+	}
+	wharfProjectID, imported, err := importer.findImportedProject(ctx, gitLabProject)
+	if err != nil {
+		return cachedAvatar{}, false, err
+	}
+	if !imported {
+		return cachedAvatar{}, false, errProjectNotImported
+	}
+	if gitLabProject.AvatarURL == "" {
+		return cachedAvatar{}, false, nil
+	}
+	a, err := importer.gitLabClient.getAvatar(ctx, gitLabProject.AvatarURL, maxSize)
+	if err != nil {
+		return cachedAvatar{}, false, err
+	}
+	return cachedAvatar{avatar: a, WharfProjectID: wharfProjectID}, true, nil
+}
+
+// findImportedProject returns the ID of the Wharf project that is imported
+// from the GitLab project using the importer's provider, or false if there is
+// none. The Wharf projects are looked up by the names the provider gives the
+// GitLab project, and those with a different remote project ID are skipped.
+func (importer gitLabImporter) findImportedProject(ctx context.Context, gitLabProject *gitlab.Project) (uint, bool, error) {
+	groupName, projectName := importer.mapper.names.mapNames(*gitLabProject)
+	providerID := importer.mapper.providerID
+	projects, err := importer.wharfClient.GetProjectList(ctx, wharfapi.ProjectSearch{
+		GroupName:  &groupName,
+		Name:       &projectName,
+		ProviderID: &providerID,
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	for _, proj := range projects.List {
+		if isRemoteProjectID(proj.RemoteProjectID, gitLabProject.ID) {
+			return proj.ProjectID, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// isRemoteProjectID returns true if the remote project ID stored in Wharf is
+// that of the GitLab project. Projects imported before the remote project ID
+// was stored have none, and are assumed to match.
+func isRemoteProjectID(remoteProjectID string, gitLabProjectID int) bool {
+	return remoteProjectID == "" || remoteProjectID == strconv.Itoa(gitLabProjectID)
+}
+
+// getAvatarHandler godoc
+// @Summary Get the avatar of a GitLab project
+// @Description Downloads the avatar of a GitLab project using the token of
+// @Description the provider, and caches it on disk. This lets the Wharf web UI
+// @Description show avatars that require signing in to GitLab, such as those
+// @Description of private projects. The avatar URLs of imported projects point
+// @Description here when the import.avatarProxy.url config is set.
+// @Description
+// @Description The caller is not authenticated, so only avatars of projects
+// @Description that are imported into Wharf using the provider are served.
+// @Description Anyone who can reach this endpoint can read those avatars.
+// @Description Cached avatars are only served while the project is still
+// @Description imported. Only raster images, such as PNG and JPEG, are served.
+// @Tags import
+// @Produce image/png
+// @Param projectId path int true "GitLab project ID" minimum(0)
+// @Param providerId query uint true "Wharf provider ID" minimum(0)
+// @Success 200 {file} byte "Avatar image"
+// @Failure 400 {object} problem.Response "Bad request"
+// @Failure 404 {object} problem.Response "Project has no avatar, or is not imported using the provider"
+// @Failure 502 {object} problem.Response "Failed to download avatar"
+// @Router /gitlab/avatars/{projectId} [get]
+func (m importModule) getAvatarHandler(c *gin.Context) {
+	gitLabProjectID, ok := ginutil.ParseParamInt(c, "projectId")
+	if !ok {
+		return
+	}
+	providerID, ok := ginutil.ParseQueryUint(c, "providerId")
+	if !ok {
+		return
+	}
+
+	config := m.config.Import.AvatarProxy
+	wharfClient := newWharfAPIClient(m.config.API.AuthHeader, m.config.API.URL)
+	newImporter := func(ctx context.Context) (*gitLabImporter, error) {
+		return newGitLabImporterForProvider(ctx, wharfClient, providerID, m.config.Import)
+	}
+	a, ok, err := getCachedProjectAvatar(c.Request.Context(), newAvatarCache(config), wharfClient,
+		providerID, gitLabProjectID, config.MaxSize, time.Now(), newImporter)
+	if errors.Is(err, errAvatarTooLarge) {
+		ginutil.WriteProblemError(c, err, problem.Response{
+			Type:   "/prob/provider/gitlab/avatar-too-large",
+			Title:  "Avatar is too large.",
+			Status: http.StatusBadGateway,
+			Detail: fmt.Sprintf("The avatar of GitLab project with ID %d is larger than %d bytes, as set by the import.avatarProxy.maxSize config.",
+				gitLabProjectID, config.MaxSize),
+		})
+		return
+	}
+	if errors.Is(err, errProjectNotImported) {
+		ginutil.WriteProblemError(c, err, problem.Response{
+			Type:   "/prob/provider/gitlab/project-not-imported",
+			Title:  "Project not imported.",
+			Status: http.StatusNotFound,
+			Detail: fmt.Sprintf("GitLab project with ID %d is not imported into Wharf using provider with ID %d.",
+				gitLabProjectID, providerID),
+		})
+		return
+	}
+	if err != nil {
+		writeImportErrorProblem(c, err, fmt.Sprintf("Unable to get the avatar of GitLab project with ID %d", gitLabProjectID))
+		return
+	}
+	if !ok {
+		ginutil.WriteProblem(c, problem.Response{
+			Type:   "/prob/provider/gitlab/avatar-not-found",
+			Title:  "Avatar not found.",
+			Status: http.StatusNotFound,
+			Detail: fmt.Sprintf("GitLab project with ID %d has no avatar.", gitLabProjectID),
+		})
+		return
+	}
+	writeAvatar(c, a, config.CacheTTL)
+}
+
+// writeAvatar responds with the avatar. The avatar comes from a repository
+// that the caller may not control, so browsers are told not to guess its
+// type or run anything in it.
+func writeAvatar(c *gin.Context, a avatar, maxAge time.Duration) {
+	c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", int(maxAge.Seconds())))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "default-src 'none'")
+	c.Data(http.StatusOK, a.ContentType, a.Content)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/response"
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/wharfapi"
+	"github.com/iver-wharf/wharf-core/pkg/problem"
+	"github.com/iver-wharf/wharf-provider-gitlab/testdoubles"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestGetCachedProjectAvatar(t *testing.T) {
+	now := time.Date(2022, 5, 11, 2, 30, 0, 0, time.UTC)
+	gitLabProject := &gitlab.Project{
+		ID:                84,
+		Name:              "web",
+		PathWithNamespace: "default/web",
+		Namespace:         &gitlab.ProjectNamespace{FullPath: "default"},
+		AvatarURL:         "https://gitlab.local/uploads/-/system/project/avatar/84/logo.png",
+	}
+	gitLabMock := &gitLabClientMock{}
+	gitLabMock.On("getProjectByID", 84).Return(gitLabProject, nil).Once()
+	gitLabMock.On("getAvatar", gitLabProject.AvatarURL, int64(1024)).
+		Return(avatar{ContentType: "image/png", Content: []byte("png")}, nil).Once()
+	wharfMock := new(testdoubles.WharfClientAPIFetcherMock)
+	wharfMock.On("GetProjectList", mock.MatchedBy(func(search wharfapi.ProjectSearch) bool {
+		return *search.ProviderID == 1 && *search.GroupName == "default" && *search.Name == "web"
+	})).Return(response.PaginatedProjects{List: []response.Project{{ProjectID: 1, RemoteProjectID: "84"}}}, nil).Once()
+	wharfMock.On("GetProject", uint(1)).Return(response.Project{ProjectID: 1, ProviderID: 1, RemoteProjectID: "84"}, nil).Once()
+
+	var importers int
+	newImporter := func(context.Context) (*gitLabImporter, error) {
+		importers++
+		return &gitLabImporter{
+			gitLabClient: gitLabMock,
+			wharfClient:  wharfMock,
+			mapper:       mapper{tokenID: 2, providerID: 1},
+		}, nil
+	}
+	cache := newAvatarCache(AvatarProxyConfig{CacheDir: t.TempDir(), CacheTTL: time.Hour})
+
+	for i := 0; i < 2; i++ {
+		a, ok, err := getCachedProjectAvatar(context.Background(), cache, wharfMock, 1, 84, 1024, now, newImporter)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "image/png", a.ContentType)
+		assert.Equal(t, []byte("png"), a.Content)
+	}
+	assert.Equal(t, 1, importers, "resolved the provider on a cache hit")
+	gitLabMock.AssertExpectations(t)
+	wharfMock.AssertExpectations(t)
+
+	_, ok, err := cache.load(avatarKey(1, 84), now.Add(2*time.Hour))
+	require.NoError(t, err)
+	assert.False(t, ok, "expired avatar should not be loaded")
+}
+
+func TestGetCachedProjectAvatarRemovedFromWharf(t *testing.T) {
+	now := time.Date(2022, 5, 11, 2, 30, 0, 0, time.UTC)
+	cache := newAvatarCache(AvatarProxyConfig{CacheDir: t.TempDir(), CacheTTL: time.Hour})
+	key := avatarKey(1, 84)
+	require.NoError(t, cache.save(key, cachedAvatar{
+		avatar:         avatar{ContentType: "image/png", Content: []byte("png")},
+		FetchedAt:      now,
+		WharfProjectID: 1,
+	}))
+	wharfMock := new(testdoubles.WharfClientAPIFetcherMock)
+	wharfMock.On("GetProject", uint(1)).Return(response.Project{}, problem.Response{Status: http.StatusNotFound})
+	newImporter := func(context.Context) (*gitLabImporter, error) {
+		t.Error("resolved the provider for a cached avatar")
+		return nil, errors.New("unexpected")
+	}
+
+	_, _, err := getCachedProjectAvatar(context.Background(), cache, wharfMock, 1, 84, 1024, now, newImporter)
+	assert.ErrorIs(t, err, errProjectNotImported)
+	_, ok, err := cache.load(key, now)
+	require.NoError(t, err)
+	assert.False(t, ok, "avatar of removed project should be removed from the cache")
+}
+
+func TestWriteAvatar(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	writeAvatar(c, avatar{ContentType: "image/png", Content: []byte("png")}, time.Hour)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "default-src 'none'", w.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "private, max-age=3600", w.Header().Get("Cache-Control"))
+}
+
+func TestGetProjectAvatarRequiresImportedProject(t *testing.T) {
+	gitLabMock := &gitLabClientMock{}
+	gitLabMock.On("getProjectByID", 84).Return(&gitlab.Project{
+		ID:                84,
+		Name:              "secret",
+		PathWithNamespace: "private/secret",
+		AvatarURL:         "https://gitlab.local/uploads/logo.png",
+	}, nil)
+	wharfMock := new(testdoubles.WharfClientAPIFetcherMock)
+	wharfMock.On("GetProjectList", mock.Anything).Return(response.PaginatedProjects{List: []response.Project{
+		// Same name, but imported from another GitLab project.
+		{ProjectID: 1, RemoteProjectID: "12"},
+	}}, nil)
+
+	importer := gitLabImporter{
+		gitLabClient: gitLabMock,
+		wharfClient:  wharfMock,
+		mapper:       mapper{tokenID: 2, providerID: 1},
+	}
+	_, _, err := importer.getProjectAvatar(context.Background(), 84, 1024)
+	assert.ErrorIs(t, err, errProjectNotImported)
+	gitLabMock.AssertNotCalled(t, "getAvatar", mock.Anything, mock.Anything)
+}
+
+func TestAvatarCacheEvictsOldestAvatars(t *testing.T) {
+	dir := t.TempDir()
+	cache := newAvatarCache(AvatarProxyConfig{CacheDir: dir, CacheTTL: time.Hour})
+	now := time.Date(2022, 5, 11, 2, 30, 0, 0, time.UTC)
+	content := avatar{ContentType: "image/png", Content: make([]byte, 100)}
+
+	require.NoError(t, cache.save("old", cachedAvatar{avatar: content, FetchedAt: now}))
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "old.json"), now, now.Add(-time.Minute)))
+	info, err := os.Stat(filepath.Join(dir, "old.json"))
+	require.NoError(t, err)
+	cache.maxSize = info.Size() + info.Size()/2
+
+	require.NoError(t, cache.save("new", cachedAvatar{avatar: content, FetchedAt: now}))
+
+	_, ok, err := cache.load("old", now)
+	require.NoError(t, err)
+	assert.False(t, ok, "oldest avatar should be evicted")
+	_, ok, err = cache.load("new", now)
+	require.NoError(t, err)
+	assert.True(t, ok, "newest avatar should be kept")
+}
+
+func TestMapAvatarURL(t *testing.T) {
+	proj := gitlab.Project{ID: 84, AvatarURL: "https://gitlab.local/uploads/logo.png"}
+
+	m := mapper{providerID: 1}
+	assert.Equal(t, proj.AvatarURL, m.mapAvatarURL(proj))
+
+	m.avatarProxyURL = "https://wharf.local/"
+	assert.Equal(t, "https://wharf.local/import/gitlab/avatars/84?providerId=1", m.mapAvatarURL(proj))
+	assert.Empty(t, m.mapAvatarURL(gitlab.Project{ID: 84}))
+}
+
+func TestGetAvatarOnlySendsTokenToGitLab(t *testing.T) {
+	otherHost := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("PRIVATE-TOKEN"))
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("gravatar"))
+	}))
+	defer otherHost.Close()
+	gitLab := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/":
+			// The client checks the rate limits on its first request.
+		case "/uploads/logo.png":
+			assert.Equal(t, "token", r.Header.Get("PRIVATE-TOKEN"))
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("0123456789"))
+		case "/uploads/logo.svg":
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Write([]byte("<svg/>"))
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer gitLab.Close()
+
+	client, err := newGitLabClient("token", gitLab.URL)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	a, err := client.getAvatar(ctx, gitLab.URL+"/uploads/logo.png", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("0123456789"), a.Content)
+
+	a, err = client.getAvatar(ctx, otherHost.URL+"/avatar/abc", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("gravatar"), a.Content)
+
+	_, err = client.getAvatar(ctx, gitLab.URL+"/uploads/logo.png", 9)
+	assert.ErrorIs(t, err, errAvatarTooLarge)
+
+	_, err = client.getAvatar(ctx, gitLab.URL+"/uploads/logo.svg", 10)
+	assert.Error(t, err, "vector images should not be served")
+}
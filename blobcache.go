@@ -0,0 +1,50 @@
+package main
+
+import "regexp"
+
+// blobIDPattern matches the SHA-1 and SHA-256 blob SHAs that GitLab returns,
+// which are safe to use as file names.
+var blobIDPattern = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+
+// blobCache stores the content of files fetched from GitLab by their blob
+// SHA. As a blob SHA is the hash of the content, cached entries never go
+// stale, and a file whose blob SHA is cached does not need to be downloaded
+// again.
+type blobCache struct {
+	files   jsonFileStore
+	maxSize int64
+}
+
+type cachedBlob struct {
+	Content string `json:"content"`
+}
+
+// newBlobCache returns nil if the cache is disabled, in which case files are
+// always downloaded.
+func newBlobCache(config ImportConfig) *blobCache {
+	if config.BlobCacheDir == "" {
+		return nil
+	}
+	return &blobCache{jsonFileStore{config.BlobCacheDir}, config.BlobCacheMaxSize}
+}
+
+// load returns the cached content of a blob, or false if it is not cached. A
+// nil cache never has any.
+func (c *blobCache) load(blobID string) (string, bool, error) {
+	if c == nil || !blobIDPattern.MatchString(blobID) {
+		return "", false, nil
+	}
+	var blob cachedBlob
+	ok, err := c.files.load(blobID, &blob)
+	return blob.Content, ok, err
+}
+
+func (c *blobCache) save(blobID, content string) error {
+	if c == nil || !blobIDPattern.MatchString(blobID) {
+		return nil
+	}
+	if err := c.files.save(blobID, cachedBlob{content}); err != nil {
+		return err
+	}
+	return c.files.evictOldest(c.maxSize)
+}
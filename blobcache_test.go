@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetRawFileIfExistsUsesBlobCache(t *testing.T) {
+	const blobID = "79f7bbd25901e8334750839545a9bd021f0e4c83"
+	var downloads int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/v4/":
+			// The client checks the rate limits on its first request.
+		case r.Method == http.MethodHead && strings.HasSuffix(r.URL.Path, "/repository/files/.wharf-ci.yml"):
+			assert.Equal(t, "main", r.URL.Query().Get("ref"))
+			w.Header().Set("X-Gitlab-Blob-Id", blobID)
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusNotFound)
+		case strings.HasSuffix(r.URL.Path, "/repository/blobs/"+blobID+"/raw"):
+			downloads++
+			w.Write([]byte(validBuildDefinition))
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := newGitLabClient("token", server.URL)
+	require.NoError(t, err)
+	client.blobCache = newBlobCache(ImportConfig{BlobCacheDir: t.TempDir()})
+
+	for i := 0; i < 2; i++ {
+		content, ok, err := client.getRawFileIfExists(context.Background(), 84, "main", BuildDefinitionFileName)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, validBuildDefinition, content)
+	}
+	assert.Equal(t, 1, downloads)
+
+	_, ok, err := client.getRawFileIfExists(context.Background(), 84, "main", "missing.yml")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestBlobCacheIgnoresInvalidBlobIDs(t *testing.T) {
+	cache := newBlobCache(ImportConfig{BlobCacheDir: t.TempDir()})
+	require.NoError(t, cache.save("../escape", "content"))
+	_, ok, err := cache.load("../escape")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestBlobCacheEvictsOldestBlobs(t *testing.T) {
+	const oldBlobID = "79f7bbd25901e8334750839545a9bd021f0e4c83"
+	const newBlobID = "3b18e512dba79e4c8300dd08aeb37f8e728b8dad"
+	dir := t.TempDir()
+	cache := newBlobCache(ImportConfig{BlobCacheDir: dir})
+	require.NoError(t, cache.save(oldBlobID, validBuildDefinition))
+	oldPath := filepath.Join(dir, oldBlobID+".json")
+	info, err := os.Stat(oldPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Chtimes(oldPath, info.ModTime(), info.ModTime().Add(-time.Minute)))
+
+	cache.maxSize = info.Size() + info.Size()/2
+	require.NoError(t, cache.save(newBlobID, validBuildDefinition))
+
+	_, ok, err := cache.load(oldBlobID)
+	require.NoError(t, err)
+	assert.False(t, ok, "oldest blob should be evicted")
+	_, ok, err = cache.load(newBlobID)
+	require.NoError(t, err)
+	assert.True(t, ok, "newest blob should be kept")
+}
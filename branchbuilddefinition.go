@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// BranchBuildDefinition is the build definition of a single branch, for
+// branches other than the default branch whose build definition is stored on
+// the project in Wharf.
+type BranchBuildDefinition struct {
+	Branch string `json:"branch" example:"feature/new-pipeline"`
+	// Path is the path of the build definition file in the repository.
+	Path string `json:"path" example:".wharf-ci.yml"`
+	// Content is the build definition. If it was rejected, then this is the
+	// build definition that was stored before, if any.
+	Content     string                      `json:"content"`
+	Diagnostics []BuildDefinitionDiagnostic `json:"diagnostics"`
+	// Rejected is true if the build definition was invalid and was not
+	// stored, as set by the import.rejectInvalidBuildDefinitions config.
+	Rejected bool `json:"rejected" example:"false"`
+}
+
+// branchBuildDefinitions are the build definitions of the branches of a
+// project, by branch name.
+type branchBuildDefinitions map[string]BranchBuildDefinition
+
+// newBranchBuildDefinitionStore returns nil if per-branch build definitions
+// are disabled, in which case they are neither fetched nor stored.
+func newBranchBuildDefinitionStore(config ImportConfig) *jsonStore[branchBuildDefinitions] {
+	if !config.BranchBuildDefinitions {
+		return nil
+	}
+	return newJSONStore[branchBuildDefinitions](config.BranchBuildDefinitionDir)
+}
+
+// branchBuildDefinitionsKey returns the file-safe name of the branch build
+// definitions of a Wharf project. The Wharf project ID is used, as that is
+// what builds in Wharf refer to.
+func branchBuildDefinitionsKey(wharfProjectID uint) string {
+	return fmt.Sprintf("wharf-project-%d", wharfProjectID)
+}
+
+// branchBuildDefinitionFetcher fetches the build definitions of the branches
+// of a project while its branches are imported, and saves them all at once
+// when done. A nil fetcher does nothing, as when per-branch build definitions
+// are disabled.
+type branchBuildDefinitionFetcher struct {
+	importer       gitLabImporter
+	wharfProjectID uint
+	gitLabProject  *gitlab.Project
+	paths          []string
+	previous       branchBuildDefinitions
+	defs           branchBuildDefinitions
+}
+
+func (importer gitLabImporter) newBranchBuildDefinitionFetcher(wharfProjectID uint, gitLabProject *gitlab.Project) *branchBuildDefinitionFetcher {
+	if importer.branchBuildDefinitions == nil {
+		return nil
+	}
+	key := projectStateKey(importer.mapper.providerID, gitLabProject.ID)
+	state, _, err := importer.projectStates.load(key)
+	if err != nil {
+		log.Warn().
+			WithError(err).
+			WithString("projectState", key).
+			Message("Failed to load project state, looking for branch build definitions in configured paths.")
+	}
+	previous, _, err := importer.branchBuildDefinitions.load(branchBuildDefinitionsKey(wharfProjectID))
+	if err != nil {
+		log.Warn().
+			WithError(err).
+			WithUint("projectId", wharfProjectID).
+			Message("Failed to load branch build definitions, replacing them.")
+	}
+	return &branchBuildDefinitionFetcher{
+		importer:       importer,
+		wharfProjectID: wharfProjectID,
+		gitLabProject:  gitLabProject,
+		paths:          importer.buildDefinitionPathsFor(state.BuildDefinitionPath),
+		previous:       previous,
+		defs:           make(branchBuildDefinitions),
+	}
+}
+
+// fetch fetches and validates the build definition of the branch, unless it
+// is the default branch or does not match the configured patterns. If it
+// cannot be fetched, then the one fetched before is kept.
+func (f *branchBuildDefinitionFetcher) fetch(ctx context.Context, branch *gitlab.Branch) {
+	if f == nil || branch.Default || !matchesBranchPatterns(f.importer.branchBuildDefinitionPatterns, branch.Name) {
+		return
+	}
+	previous, hasPrevious := f.previous[branch.Name]
+	buildDef, err := f.importer.gitLabClient.getBuildDefinitionIfExists(ctx, f.gitLabProject.ID, branch.Name, f.paths)
+	if err != nil {
+		log.Warn().
+			WithError(err).
+			WithInt("gitLabProjectId", f.gitLabProject.ID).
+			WithString("branch", branch.Name).
+			Message("Failed to get build definition of branch, keeping the previous one.")
+		if hasPrevious {
+			f.defs[branch.Name] = previous
+		}
+		return
+	}
+	if buildDef.Path == "" {
+		return
+	}
+	f.importer.expandBuildDefinition(ctx, f.gitLabProject, branch.Name, &buildDef)
+	f.importer.validateBuildDefinition(f.gitLabProject, branch.Name, &buildDef)
+	def := BranchBuildDefinition{
+		Branch:      branch.Name,
+		Path:        buildDef.Path,
+		Content:     buildDef.Content,
+		Diagnostics: buildDef.Diagnostics,
+		Rejected:    buildDef.Rejected,
+	}
+	if buildDef.Rejected {
+		// Keep the build definition that is already stored.
+		def.Content = previous.Content
+	}
+	f.defs[branch.Name] = def
+}
+
+func (f *branchBuildDefinitionFetcher) save() {
+	if f == nil {
+		return
+	}
+	// Replace the saved build definitions, so that branches that were deleted
+	// or no longer have a build definition are removed.
+	key := branchBuildDefinitionsKey(f.wharfProjectID)
+	var err error
+	if len(f.defs) == 0 {
+		err = f.importer.branchBuildDefinitions.remove(key)
+	} else {
+		err = f.importer.branchBuildDefinitions.save(key, f.defs)
+	}
+	if err != nil {
+		log.Warn().
+			WithError(err).
+			WithUint("projectId", f.wharfProjectID).
+			Message("Failed to save branch build definitions.")
+		return
+	}
+	log.Debug().
+		WithUint("projectId", f.wharfProjectID).
+		WithInt("branches", len(f.defs)).
+		Message("Saved branch build definitions.")
+}
+
+// matchesBranchPatterns returns true if the branch name matches any of the
+// patterns, or if there are no patterns. The patterns are matched as by
+// path.Match, so "*" does not match "/".
+func matchesBranchPatterns(patterns []string, branchName string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, branchName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validateBranchPatterns returns an error for the first malformed pattern, so
+// that it is caught when loading the config instead of never matching.
+func validateBranchPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
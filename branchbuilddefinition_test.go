@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/response"
+	"github.com/iver-wharf/wharf-provider-gitlab/testdoubles"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestMatchesBranchPatterns(t *testing.T) {
+	type testCase struct {
+		name     string
+		patterns []string
+		branch   string
+		want     bool
+	}
+	testCases := []testCase{
+		{"no patterns", nil, "feature/login", true},
+		{"exact", []string{"develop"}, "develop", true},
+		{"wildcard", []string{"feature/*"}, "feature/login", true},
+		{"wildcard does not match slash", []string{"feature/*"}, "feature/login/v2", false},
+		{"any pattern", []string{"release-*", "feature/*"}, "release-1.0", true},
+		{"no match", []string{"feature/*"}, "fix/login", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, matchesBranchPatterns(tc.patterns, tc.branch))
+		})
+	}
+}
+
+func TestImportConfigValidateBranchPatterns(t *testing.T) {
+	assert.NoError(t, ImportConfig{BranchBuildDefinitionPatterns: []string{"feature/*"}}.validate())
+	assert.Error(t, ImportConfig{BranchBuildDefinitionPatterns: []string{"feature/["}}.validate())
+}
+
+func TestRefreshBranchesStoresBranchBuildDefinitions(t *testing.T) {
+	project := &gitlab.Project{ID: 84, DefaultBranch: "main"}
+	branches := []*gitlab.Branch{
+		{Name: "main", Default: true},
+		{Name: "feature/login"},
+		{Name: "feature/logout"},
+		{Name: "fix/typo"},
+	}
+	config := ImportConfig{
+		BranchBuildDefinitions:        true,
+		BranchBuildDefinitionPatterns: []string{"feature/*"},
+		BranchBuildDefinitionDir:      t.TempDir(),
+	}
+
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getBranches", 84, gitLabPageCursor{}).Return(branches, gitLabPaging{}, nil)
+	gitLabMock.On("getBuildDefinitionIfExists", 84, "feature/login", []string{BuildDefinitionFileName}).
+		Return(buildDefinitionFile{Path: BuildDefinitionFileName, Content: validBuildDefinition}, nil).Once()
+	gitLabMock.On("getBuildDefinitionIfExists", 84, "feature/logout", []string{BuildDefinitionFileName}).
+		Return(buildDefinitionFile{}, nil).Once()
+	wharfMock := new(testdoubles.WharfClientAPIFetcherMock)
+	wharfMock.On("UpdateProjectBranchList", uint(1), mock.Anything).Return([]response.Branch{}, nil)
+
+	importer := gitLabImporter{
+		gitLabClient:                  gitLabMock,
+		wharfClient:                   wharfMock,
+		mapper:                        mapper{tokenID: 2, providerID: 1},
+		branchBuildDefinitions:        newBranchBuildDefinitionStore(config),
+		branchBuildDefinitionPatterns: config.BranchBuildDefinitionPatterns,
+	}
+
+	require.NoError(t, importer.refreshBranches(context.Background(), 1, project))
+	gitLabMock.AssertExpectations(t)
+	defs, _, err := importer.branchBuildDefinitions.load(branchBuildDefinitionsKey(1))
+	require.NoError(t, err)
+	require.Len(t, defs, 1)
+	assert.Equal(t, validBuildDefinition, defs["feature/login"].Content)
+	assert.Equal(t, BuildDefinitionFileName, defs["feature/login"].Path)
+
+	// A failed fetch keeps the build definition from before.
+	gitLabMock.On("getBuildDefinitionIfExists", 84, "feature/login", []string{BuildDefinitionFileName}).
+		Return(buildDefinitionFile{}, errors.New("502 Bad Gateway")).Once()
+	gitLabMock.On("getBuildDefinitionIfExists", 84, "feature/logout", []string{BuildDefinitionFileName}).
+		Return(buildDefinitionFile{}, nil).Once()
+	require.NoError(t, importer.refreshBranches(context.Background(), 1, project))
+	defs, _, err = importer.branchBuildDefinitions.load(branchBuildDefinitionsKey(1))
+	require.NoError(t, err)
+	assert.Equal(t, validBuildDefinition, defs["feature/login"].Content)
+
+	gin.SetMode(gin.TestMode)
+	m := importModule{config: &Config{Import: config}, jobs: newImportJobRegistry()}
+	r := gin.New()
+	m.register(r)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/import/gitlab/projects/1/build-definition?branch=feature/login", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"branch":"feature/login"`)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/import/gitlab/projects/1/build-definition?branch=main", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
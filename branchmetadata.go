@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// BranchMetadata holds details about a branch in GitLab that Wharf has no
+// fields for, such as for only building protected branches, or skipping
+// branches without recent commits.
+type BranchMetadata struct {
+	Branch    string `json:"branch" example:"main"`
+	Default   bool   `json:"default" example:"true"`
+	Protected bool   `json:"protected" example:"true"`
+	// CommitID is the SHA of the head commit of the branch.
+	CommitID      string     `json:"commitId" example:"8a4a5b4d8e8e2f0e6b6b2d1f0c6e3b9a1d2c3e4f"`
+	CommittedDate *time.Time `json:"committedDate" format:"date-time" extensions:"x-nullable"`
+}
+
+// branchMetadataKey returns the file-safe name of the branch metadata of a
+// Wharf project.
+func branchMetadataKey(wharfProjectID uint) string {
+	return fmt.Sprintf("wharf-project-%d", wharfProjectID)
+}
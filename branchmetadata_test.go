@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/response"
+	"github.com/iver-wharf/wharf-provider-gitlab/testdoubles"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestRefreshBranchesStoresBranchMetadata(t *testing.T) {
+	committed := time.Date(2022, 5, 10, 2, 30, 0, 0, time.UTC)
+	project := &gitlab.Project{ID: 84, DefaultBranch: "main"}
+	branches := []*gitlab.Branch{
+		{Name: "main", Default: true, Protected: true, Commit: &gitlab.Commit{ID: "8a4a5b4d", CommittedDate: &committed}},
+		{Name: "feature/login"},
+	}
+	config := ImportConfig{BranchMetadataDir: t.TempDir()}
+
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getBranches", 84, gitLabPageCursor{}).Return(branches, gitLabPaging{}, nil)
+	wharfMock := new(testdoubles.WharfClientAPIFetcherMock)
+	wharfMock.On("UpdateProjectBranchList", uint(1), mock.Anything).Return([]response.Branch{}, nil)
+
+	importer := gitLabImporter{
+		gitLabClient:   gitLabMock,
+		wharfClient:    wharfMock,
+		mapper:         mapper{tokenID: 2, providerID: 1},
+		branchMetadata: newJSONStore[[]BranchMetadata](config.BranchMetadataDir),
+	}
+	require.NoError(t, importer.refreshBranches(context.Background(), 1, project))
+
+	saved, ok, err := importer.branchMetadata.load(branchMetadataKey(1))
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, []BranchMetadata{
+		{Branch: "main", Default: true, Protected: true, CommitID: "8a4a5b4d", CommittedDate: &committed},
+		{Branch: "feature/login"},
+	}, saved)
+
+	gin.SetMode(gin.TestMode)
+	m := importModule{config: &Config{Import: config}, jobs: newImportJobRegistry()}
+	r := gin.New()
+	m.register(r)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/import/gitlab/projects/1/branches", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"protected":true`)
+	assert.Contains(t, w.Body.String(), `"committedDate":"2022-05-10T02:30:00Z"`)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/import/gitlab/projects/2/branches", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
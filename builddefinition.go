@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type buildDefinitionSeverity string
+
+const (
+	buildDefinitionError   buildDefinitionSeverity = "error"
+	buildDefinitionWarning buildDefinitionSeverity = "warning"
+)
+
+// BuildDefinitionDiagnostic is a problem found when validating a build
+// definition.
+type BuildDefinitionDiagnostic struct {
+	Severity buildDefinitionSeverity `json:"severity" enums:"error,warning"`
+	Message  string                  `json:"message" example:"step must be a map with a single step type, such as \"container\""`
+	// File is the included file with the problem, or empty if the problem
+	// is in the build definition itself. The path and line are relative to
+	// this file.
+	File string `json:"file,omitempty" example:"default/templates:go.yml@v1"`
+	// Path is the dot-separated path to the YAML node with the problem.
+	Path   string `json:"path,omitempty" example:"myStage.myStep"`
+	Line   int    `json:"line" example:"4"`
+	Column int    `json:"column" example:"5"`
+}
+
+const (
+	buildDefinitionInputsKey       = "inputs"
+	buildDefinitionEnvironmentsKey = "environments"
+)
+
+var buildDefinitionStepTypes = []string{
+	"container",
+	"docker",
+	"helm",
+	"helm-package",
+	"kubectl",
+	"nuget-package",
+}
+
+var buildDefinitionInputTypes = []string{
+	"string",
+	"choice",
+	"number",
+	"password",
+}
+
+// yamlErrorLineRegex matches the line number in the errors from the YAML
+// parser, such as "yaml: line 3: mapping values are not allowed in this
+// context".
+var yamlErrorLineRegex = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// lintBuildDefinition parses the build definition and checks its structure:
+// that the inputs and environments are well-formed, that each stage is a map
+// of steps, that each step is a map with a single step type, and that stages
+// only refer to environments that are defined. It does not check the fields
+// of each step type. Anchors and "<<" merge keys are resolved, and top-level
+// keys that start with a dot, such as ".defaults", are not linted as stages.
+func lintBuildDefinition(content string) []BuildDefinitionDiagnostic {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil {
+		return []BuildDefinitionDiagnostic{newYAMLErrorDiagnostic(err)}
+	}
+	return lintBuildDefinitionDocument(&doc, nil)
+}
+
+// lintBuildDefinitionDocument lints a parsed build definition. The sources
+// name the included files that nodes were parsed from, if any, and nodes
+// without a source are from the build definition itself.
+func lintBuildDefinitionDocument(doc *yaml.Node, sources map[*yaml.Node]string) []BuildDefinitionDiagnostic {
+	l := buildDefinitionLinter{environments: make(map[string]bool), sources: sources}
+	l.lintDocument(doc)
+	return l.diagnostics
+}
+
+func hasBuildDefinitionErrors(diagnostics []BuildDefinitionDiagnostic) bool {
+	for _, d := range diagnostics {
+		if d.Severity == buildDefinitionError {
+			return true
+		}
+	}
+	return false
+}
+
+func newYAMLErrorDiagnostic(err error) BuildDefinitionDiagnostic {
+	diagnostic := BuildDefinitionDiagnostic{
+		Severity: buildDefinitionError,
+		Message:  err.Error(),
+	}
+	if match := yamlErrorLineRegex.FindStringSubmatch(err.Error()); match != nil {
+		diagnostic.Line, _ = strconv.Atoi(match[1])
+		diagnostic.Message = match[2]
+	}
+	return diagnostic
+}
+
+type buildDefinitionLinter struct {
+	diagnostics  []BuildDefinitionDiagnostic
+	environments map[string]bool
+	sources      map[*yaml.Node]string
+}
+
+func (l *buildDefinitionLinter) report(severity buildDefinitionSeverity, node *yaml.Node, path []string, format string, args ...any) {
+	l.diagnostics = append(l.diagnostics, BuildDefinitionDiagnostic{
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+		File:     l.sources[node],
+		Path:     strings.Join(path, "."),
+		Line:     node.Line,
+		Column:   node.Column,
+	})
+}
+
+type yamlMapEntry struct {
+	key   *yaml.Node
+	value *yaml.Node
+}
+
+// mapEntries returns the key-value pairs of a YAML map, with aliases resolved
+// and the maps of any "<<" merge keys merged in, and reports any duplicate
+// keys. Keys in the map itself take precedence over merged keys.
+func (l *buildDefinitionLinter) mapEntries(node *yaml.Node, path []string) []yamlMapEntry {
+	var entries, merged []yamlMapEntry
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], resolveYAMLAlias(node.Content[i+1])
+		if isYAMLMergeKey(key) {
+			merged = append(merged, l.mergedEntries(value, path)...)
+			continue
+		}
+		if seen[key.Value] {
+			l.report(buildDefinitionError, key, append(path, key.Value), "duplicate key %q", key.Value)
+			continue
+		}
+		seen[key.Value] = true
+		entries = append(entries, yamlMapEntry{key, value})
+	}
+	for _, entry := range merged {
+		if !seen[entry.key.Value] {
+			seen[entry.key.Value] = true
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// mergedEntries returns the key-value pairs of the value of a "<<" merge key,
+// which is either a map or a list of maps. Earlier maps in the list take
+// precedence over later ones.
+func (l *buildDefinitionLinter) mergedEntries(node *yaml.Node, path []string) []yamlMapEntry {
+	if node.Kind == yaml.MappingNode {
+		return l.mapEntries(node, path)
+	}
+	if node.Kind != yaml.SequenceNode {
+		l.report(buildDefinitionError, node, path, "merge key must refer to a map or a list of maps")
+		return nil
+	}
+	var entries []yamlMapEntry
+	for _, item := range node.Content {
+		item = resolveYAMLAlias(item)
+		if item.Kind != yaml.MappingNode {
+			l.report(buildDefinitionError, item, path, "merge key must refer to a map or a list of maps")
+			continue
+		}
+		entries = append(entries, l.mapEntries(item, path)...)
+	}
+	return entries
+}
+
+func (l *buildDefinitionLinter) lintDocument(doc *yaml.Node) {
+	if len(doc.Content) == 0 {
+		l.diagnostics = append(l.diagnostics, BuildDefinitionDiagnostic{
+			Severity: buildDefinitionWarning,
+			Message:  "build definition is empty",
+			Line:     1,
+			Column:   1,
+		})
+		return
+	}
+	root := resolveYAMLAlias(doc.Content[0])
+	if root.Kind != yaml.MappingNode {
+		l.report(buildDefinitionError, root, nil, "build definition must be a map of stages")
+		return
+	}
+
+	entries := l.mapEntries(root, nil)
+	// Environments are collected first, as stages may refer to environments
+	// that are defined further down in the file.
+	for _, entry := range entries {
+		if entry.key.Value == buildDefinitionEnvironmentsKey {
+			l.lintEnvironments(entry.value, []string{entry.key.Value})
+		}
+	}
+	stages := 0
+	for _, entry := range entries {
+		path := []string{entry.key.Value}
+		switch entry.key.Value {
+		case buildDefinitionEnvironmentsKey:
+		case buildDefinitionIncludeKey:
+			l.report(buildDefinitionWarning, entry.key, path,
+				"includes are only resolved when the build definition is imported from GitLab with includes enabled")
+		case buildDefinitionInputsKey:
+			l.lintInputs(entry.value, path)
+		default:
+			if strings.HasPrefix(entry.key.Value, ".") {
+				// Hidden keys, such as ".defaults", hold anchors to reuse
+				// in stages and are not stages themselves.
+				continue
+			}
+			stages++
+			l.lintStage(entry.value, path)
+		}
+	}
+	if stages == 0 {
+		l.report(buildDefinitionWarning, root, nil, "build definition has no stages")
+	}
+}
+
+func (l *buildDefinitionLinter) lintInputs(node *yaml.Node, path []string) {
+	if node.Kind != yaml.SequenceNode {
+		l.report(buildDefinitionError, node, path, "inputs must be a list")
+		return
+	}
+	for i, input := range node.Content {
+		input = resolveYAMLAlias(input)
+		inputPath := append(path, strconv.Itoa(i))
+		if input.Kind != yaml.MappingNode {
+			l.report(buildDefinitionError, input, inputPath, "input must be a map")
+			continue
+		}
+		var name, inputType *yaml.Node
+		for _, entry := range l.mapEntries(input, inputPath) {
+			switch entry.key.Value {
+			case "name":
+				name = entry.value
+			case "type":
+				inputType = entry.value
+			}
+		}
+		if name == nil || name.Kind != yaml.ScalarNode || name.Value == "" {
+			l.report(buildDefinitionError, input, inputPath, "input must have a name")
+		}
+		if inputType == nil {
+			l.report(buildDefinitionError, input, inputPath, "input must have a type, one of: %s",
+				strings.Join(buildDefinitionInputTypes, ", "))
+		} else if !containsString(buildDefinitionInputTypes, inputType.Value) {
+			l.report(buildDefinitionError, inputType, append(inputPath, "type"), "unknown input type %q, must be one of: %s",
+				inputType.Value, strings.Join(buildDefinitionInputTypes, ", "))
+		}
+	}
+}
+
+func (l *buildDefinitionLinter) lintEnvironments(node *yaml.Node, path []string) {
+	if node.Kind != yaml.MappingNode {
+		l.report(buildDefinitionError, node, path, "environments must be a map of environments")
+		return
+	}
+	for _, entry := range l.mapEntries(node, path) {
+		envPath := append(path, entry.key.Value)
+		l.environments[entry.key.Value] = true
+		if isYAMLNull(entry.value) {
+			continue
+		}
+		if entry.value.Kind != yaml.MappingNode {
+			l.report(buildDefinitionError, entry.value, envPath, "environment must be a map of variables")
+			continue
+		}
+		for _, variable := range l.mapEntries(entry.value, envPath) {
+			if variable.value.Kind != yaml.ScalarNode {
+				l.report(buildDefinitionError, variable.value, append(envPath, variable.key.Value),
+					"environment variable must be a string, number, or boolean")
+			}
+		}
+	}
+}
+
+func (l *buildDefinitionLinter) lintStage(node *yaml.Node, path []string) {
+	if node.Kind != yaml.MappingNode {
+		l.report(buildDefinitionError, node, path, "stage must be a map of steps")
+		return
+	}
+	steps := 0
+	for _, entry := range l.mapEntries(node, path) {
+		entryPath := append(path, entry.key.Value)
+		if entry.key.Value == buildDefinitionEnvironmentsKey {
+			l.lintStageEnvironments(entry.value, entryPath)
+			continue
+		}
+		steps++
+		l.lintStep(entry.value, entryPath)
+	}
+	if steps == 0 {
+		l.report(buildDefinitionWarning, node, path, "stage has no steps")
+	}
+}
+
+func (l *buildDefinitionLinter) lintStageEnvironments(node *yaml.Node, path []string) {
+	if node.Kind != yaml.SequenceNode {
+		l.report(buildDefinitionError, node, path, "stage environments must be a list of environment names")
+		return
+	}
+	for _, env := range node.Content {
+		env = resolveYAMLAlias(env)
+		if env.Kind != yaml.ScalarNode {
+			l.report(buildDefinitionError, env, path, "environment name must be a string")
+			continue
+		}
+		if !l.environments[env.Value] {
+			l.report(buildDefinitionError, env, path, "undefined environment %q", env.Value)
+		}
+	}
+}
+
+func (l *buildDefinitionLinter) lintStep(node *yaml.Node, path []string) {
+	if node.Kind != yaml.MappingNode {
+		l.report(buildDefinitionError, node, path, "step must be a map with a single step type, such as \"container\"")
+		return
+	}
+	entries := l.mapEntries(node, path)
+	if len(entries) != 1 {
+		l.report(buildDefinitionError, node, path, "step must have exactly one step type, got %d", len(entries))
+		return
+	}
+	stepType := entries[0]
+	if !containsString(buildDefinitionStepTypes, stepType.key.Value) {
+		l.report(buildDefinitionWarning, stepType.key, append(path, stepType.key.Value), "unknown step type %q", stepType.key.Value)
+	}
+	if stepType.value.Kind != yaml.MappingNode {
+		l.report(buildDefinitionError, stepType.value, append(path, stepType.key.Value), "step type must be a map of fields")
+	}
+}
+
+// resolveYAMLAlias returns the node that an alias such as "*defaults" refers
+// to, or the node itself if it is not an alias.
+func resolveYAMLAlias(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	return node
+}
+
+func isYAMLMergeKey(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.Tag == "!!merge"
+}
+
+func isYAMLNull(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.Tag == "!!null"
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/request"
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/response"
+	"github.com/iver-wharf/wharf-provider-gitlab/testdoubles"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-gitlab"
+)
+
+const validBuildDefinition = `
+inputs:
+  - name: tag
+    type: string
+environments:
+  dev:
+    REPLICAS: 1
+  prod:
+myStage:
+  environments: [dev, prod]
+  myStep:
+    container:
+      image: alpine
+      cmds: [echo hello]
+`
+
+func TestLintBuildDefinitionValid(t *testing.T) {
+	assert.Empty(t, lintBuildDefinition(validBuildDefinition))
+}
+
+func TestLintBuildDefinitionAnchors(t *testing.T) {
+	type testCase struct {
+		name    string
+		content string
+	}
+	testCases := []testCase{
+		{"alias", `
+.defaults:
+  step: &step
+    container:
+      image: alpine
+      cmds: [echo hello]
+myStage:
+  myStep: *step
+`},
+		{"merge key", `
+.defaults:
+  container: &container
+    image: alpine
+myStage:
+  myStep:
+    container:
+      <<: *container
+      cmds: [echo hello]
+`},
+		{"merged steps", `
+.defaults:
+  steps: &steps
+    lint:
+      container:
+        image: golangci/golangci-lint
+myStage:
+  <<: *steps
+  test:
+    container:
+      image: golang
+`},
+		{"hidden key", `
+.defaults: &defaults
+  image: alpine
+myStage:
+  myStep:
+    container: *defaults
+`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Empty(t, lintBuildDefinition(tc.content))
+		})
+	}
+}
+
+func TestLintBuildDefinitionMergeKeyOverrides(t *testing.T) {
+	diagnostics := lintBuildDefinition(`
+.defaults:
+  step: &step
+    container: {image: alpine}
+    docker: {file: Dockerfile}
+myStage:
+  myStep:
+    <<: *step
+    docker: {file: Dockerfile}
+`)
+	require.Len(t, diagnostics, 1)
+	assert.Equal(t, "step must have exactly one step type, got 2", diagnostics[0].Message)
+}
+
+func TestLintBuildDefinition(t *testing.T) {
+	type testCase struct {
+		name         string
+		content      string
+		wantSeverity buildDefinitionSeverity
+		wantMessage  string
+		wantPath     string
+		wantLine     int
+		wantColumn   int
+	}
+	testCases := []testCase{
+		{
+			name:         "syntax error",
+			content:      "myStage:\n  myStep: [\n",
+			wantSeverity: buildDefinitionError,
+			wantLine:     2,
+		},
+		{
+			name:         "empty",
+			content:      "",
+			wantSeverity: buildDefinitionWarning,
+			wantMessage:  "build definition is empty",
+			wantLine:     1,
+			wantColumn:   1,
+		},
+		{
+			name:         "root not a map",
+			content:      "- myStage\n",
+			wantSeverity: buildDefinitionError,
+			wantMessage:  "build definition must be a map of stages",
+			wantLine:     1,
+			wantColumn:   1,
+		},
+		{
+			name:         "step not a map",
+			content:      "myStage:\n  myStep: echo hello\n",
+			wantSeverity: buildDefinitionError,
+			wantMessage:  `step must be a map with a single step type, such as "container"`,
+			wantPath:     "myStage.myStep",
+			wantLine:     2,
+			wantColumn:   11,
+		},
+		{
+			name:         "two step types",
+			content:      "myStage:\n  myStep:\n    container: {}\n    docker: {}\n",
+			wantSeverity: buildDefinitionError,
+			wantMessage:  "step must have exactly one step type, got 2",
+			wantPath:     "myStage.myStep",
+			wantLine:     3,
+			wantColumn:   5,
+		},
+		{
+			name:         "unknown step type",
+			content:      "myStage:\n  myStep:\n    contianer: {}\n",
+			wantSeverity: buildDefinitionWarning,
+			wantMessage:  `unknown step type "contianer"`,
+			wantPath:     "myStage.myStep.contianer",
+			wantLine:     3,
+			wantColumn:   5,
+		},
+		{
+			name:         "undefined environment",
+			content:      "myStage:\n  environments: [dev]\n  myStep:\n    container: {}\n",
+			wantSeverity: buildDefinitionError,
+			wantMessage:  `undefined environment "dev"`,
+			wantPath:     "myStage.environments",
+			wantLine:     2,
+			wantColumn:   18,
+		},
+		{
+			name:         "environment variable not a scalar",
+			content:      "environments:\n  dev:\n    HOSTS: [a, b]\nmyStage:\n  myStep:\n    container: {}\n",
+			wantSeverity: buildDefinitionError,
+			wantMessage:  "environment variable must be a string, number, or boolean",
+			wantPath:     "environments.dev.HOSTS",
+			wantLine:     3,
+			wantColumn:   12,
+		},
+		{
+			name:         "unknown input type",
+			content:      "inputs:\n  - name: tag\n    type: text\nmyStage:\n  myStep:\n    container: {}\n",
+			wantSeverity: buildDefinitionError,
+			wantMessage:  `unknown input type "text", must be one of: string, choice, number, password`,
+			wantPath:     "inputs.0.type",
+			wantLine:     3,
+			wantColumn:   11,
+		},
+		{
+			name:         "unresolved include",
+			content:      "include: [templates.yml]\nmyStage:\n  myStep:\n    container: {}\n",
+			wantSeverity: buildDefinitionWarning,
+			wantPath:     "include",
+			wantLine:     1,
+			wantColumn:   1,
+		},
+		{
+			name:         "duplicate stage",
+			content:      "myStage:\n  myStep:\n    container: {}\nmyStage:\n  myStep:\n    container: {}\n",
+			wantSeverity: buildDefinitionError,
+			wantMessage:  `duplicate key "myStage"`,
+			wantPath:     "myStage",
+			wantLine:     4,
+			wantColumn:   1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			diagnostics := lintBuildDefinition(tc.content)
+			require.Len(t, diagnostics, 1)
+			got := diagnostics[0]
+			assert.Equal(t, tc.wantSeverity, got.Severity)
+			if tc.wantMessage != "" {
+				assert.Equal(t, tc.wantMessage, got.Message)
+			}
+			assert.Equal(t, tc.wantPath, got.Path)
+			assert.Equal(t, tc.wantLine, got.Line, "line")
+			if tc.wantColumn != 0 {
+				assert.Equal(t, tc.wantColumn, got.Column, "column")
+			}
+		})
+	}
+}
+
+func TestPostProjectRejectsInvalidBuildDefinition(t *testing.T) {
+	project := gitlab.Project{ID: 84, Name: "web", DefaultBranch: "main"}
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getBuildDefinitionIfExists", 84, "main", []string{BuildDefinitionFileName}).
+		Return(buildDefinitionFile{Path: BuildDefinitionFileName, Content: "myStage: echo hello\n"}, nil)
+	wharfMock := new(testdoubles.WharfClientAPIFetcherMock)
+	wharfMock.On("CreateProject", mock.MatchedBy(func(p request.Project) bool { return p.BuildDefinition == "" })).
+		Return(response.Project{ProjectID: 1}, nil)
+
+	importer := gitLabImporter{
+		gitLabClient:                  gitLabMock,
+		wharfClient:                   wharfMock,
+		mapper:                        mapper{tokenID: 2, providerID: 1},
+		rejectInvalidBuildDefinitions: true,
+	}
+
+	_, buildDef, err := importer.postProject(context.Background(), project)
+	require.NoError(t, err)
+	assert.True(t, buildDef.Rejected)
+	require.Len(t, buildDef.Diagnostics, 1)
+	assert.Equal(t, "myStage", buildDef.Diagnostics[0].Path)
+	wharfMock.AssertExpectations(t)
+}
+
+func TestLintGitLabBuildDefinitionHandlerContent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	m := importModule{config: &Config{}, jobs: newImportJobRegistry()}
+	r := gin.New()
+	m.register(r)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/import/gitlab/lint",
+		strings.NewReader(`{"content":"myStage:\n  myStep: echo hello\n"}`))
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	var result BuildDefinitionLintResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.False(t, result.Valid)
+	require.Len(t, result.Diagnostics, 1)
+	assert.Equal(t, 2, result.Diagnostics[0].Line)
+	assert.Equal(t, 11, result.Diagnostics[0].Column)
+}
+
+func TestLintGitLabBuildDefinitionHandlerNothingToLint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	m := importModule{config: &Config{}, jobs: newImportJobRegistry()}
+	r := gin.New()
+	m.register(r)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/import/gitlab/lint", strings.NewReader(`{}`))
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestLintProjectBuildDefinition(t *testing.T) {
+	project := &gitlab.Project{ID: 84, DefaultBranch: "main"}
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getProject", "default", "web").Return(project, nil)
+	gitLabMock.On("getBuildDefinitionIfExists", 84, "feature/pipeline", []string{".wharf/ci.yml", BuildDefinitionFileName}).
+		Return(buildDefinitionFile{Path: BuildDefinitionFileName, Content: validBuildDefinition}, nil)
+	gitLabMock.On("getBuildDefinitionIfExists", 84, "main", []string{"ci/wharf.yml"}).
+		Return(buildDefinitionFile{}, nil)
+
+	importer := gitLabImporter{
+		gitLabClient:         gitLabMock,
+		buildDefinitionPaths: []string{".wharf/ci.yml", BuildDefinitionFileName},
+	}
+
+	result, found, err := importer.lintProjectBuildDefinition(context.Background(), "default/web", "feature/pipeline", "")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.True(t, result.Valid)
+	assert.Equal(t, BuildDefinitionFileName, result.Path)
+	assert.Equal(t, "feature/pipeline", result.Ref)
+	assert.Empty(t, result.Diagnostics)
+
+	result, found, err = importer.lintProjectBuildDefinition(context.Background(), "default/web", "", "ci/wharf.yml")
+	require.NoError(t, err)
+	assert.False(t, found)
+	assert.Equal(t, "main", result.Ref)
+	gitLabMock.AssertExpectations(t)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path"
+
+	"github.com/xanzy/go-gitlab"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	gitLabTreeNodeBlob = "blob"
+	gitLabTreeNodeTree = "tree"
+)
+
+// helmChartsDir is the conventional directory for Helm charts in a repository,
+// with one chart per subdirectory.
+const helmChartsDir = "charts"
+
+// BuildDefinitionSuggestion is a starter build definition generated from the
+// files found in a repository.
+type BuildDefinitionSuggestion struct {
+	// Content is the generated build definition, or empty if no known files
+	// were found.
+	Content string `json:"content"`
+	// Detected are the files and directories the build definition is based
+	// on.
+	Detected []string `json:"detected" example:"Dockerfile,go.mod"`
+}
+
+// repositoryLayout is what a build definition can be generated from.
+type repositoryLayout struct {
+	dockerfile bool
+	goModule   bool
+	npmPackage bool
+	// helmCharts are the paths of the Helm charts in the repository.
+	helmCharts []string
+}
+
+func (layout repositoryLayout) detected() []string {
+	var detected []string
+	if layout.dockerfile {
+		detected = append(detected, "Dockerfile")
+	}
+	if layout.goModule {
+		detected = append(detected, "go.mod")
+	}
+	if layout.npmPackage {
+		detected = append(detected, "package.json")
+	}
+	return append(detected, layout.helmCharts...)
+}
+
+// suggestBuildDefinition generates a build definition from the files in the
+// root of the repository, and the Helm charts in the charts directory.
+func (importer gitLabImporter) suggestBuildDefinition(ctx context.Context, gitLabProject *gitlab.Project, ref string) (BuildDefinitionSuggestion, error) {
+	root, err := importer.gitLabClient.listTree(ctx, gitLabProject.ID, ref, "")
+	if err != nil {
+		return BuildDefinitionSuggestion{}, err
+	}
+	var layout repositoryLayout
+	for _, node := range root {
+		switch {
+		case node.Type == gitLabTreeNodeBlob && node.Name == "Dockerfile":
+			layout.dockerfile = true
+		case node.Type == gitLabTreeNodeBlob && node.Name == "go.mod":
+			layout.goModule = true
+		case node.Type == gitLabTreeNodeBlob && node.Name == "package.json":
+			layout.npmPackage = true
+		case node.Type == gitLabTreeNodeBlob && node.Name == "Chart.yaml":
+			layout.helmCharts = append(layout.helmCharts, ".")
+		case node.Type == gitLabTreeNodeTree && node.Name == helmChartsDir:
+			charts, err := importer.gitLabClient.listTree(ctx, gitLabProject.ID, ref, helmChartsDir)
+			if err != nil {
+				return BuildDefinitionSuggestion{}, err
+			}
+			for _, chart := range charts {
+				if chart.Type == gitLabTreeNodeTree {
+					layout.helmCharts = append(layout.helmCharts, chart.Path)
+				}
+			}
+		}
+	}
+	return BuildDefinitionSuggestion{
+		Content:  generateBuildDefinition(layout),
+		Detected: layout.detected(),
+	}, nil
+}
+
+// generateBuildDefinition returns a starter build definition with a test
+// stage for Go and npm projects, a build stage for the Dockerfile, and a
+// package stage for the Helm charts, or an empty string if there is nothing
+// to build. It is built as YAML nodes, so that names from the repository are
+// quoted as needed.
+func generateBuildDefinition(layout repositoryLayout) string {
+	if len(layout.detected()) == 0 {
+		return ""
+	}
+	root := newYAMLMap()
+
+	if layout.goModule || layout.npmPackage {
+		test := newYAMLMap()
+		if layout.goModule {
+			addYAMLMapEntry(test, "go-test", newContainerStep("golang:latest", "go vet ./...", "go test ./..."))
+		}
+		if layout.npmPackage {
+			addYAMLMapEntry(test, "npm-test", newContainerStep("node:lts", "npm ci", "npm test"))
+		}
+		addYAMLMapEntry(root, "test", test)
+	}
+
+	if layout.dockerfile {
+		docker := newYAMLMap()
+		addYAMLMapEntry(docker, "file", newYAMLScalar("Dockerfile"))
+		addYAMLMapEntry(docker, "tag", newYAMLScalar("${GIT_COMMIT}"))
+		build := newYAMLMap()
+		addYAMLMapEntry(build, "docker", newYAMLStep("docker", docker))
+		addYAMLMapEntry(root, "build", build)
+	}
+
+	if len(layout.helmCharts) > 0 {
+		pkg := newYAMLMap()
+		for _, chart := range layout.helmCharts {
+			name := path.Base(chart)
+			if chart == "." {
+				name = "chart"
+			}
+			helmPackage := newYAMLMap()
+			addYAMLMapEntry(helmPackage, "chart-path", newYAMLScalar(chart))
+			addYAMLMapEntry(pkg, "helm-package-"+name, newYAMLStep("helm-package", helmPackage))
+		}
+		addYAMLMapEntry(root, "package", pkg)
+	}
+
+	doc := &yaml.Node{
+		Kind: yaml.DocumentNode,
+		HeadComment: "Generated by wharf-provider-gitlab from the files found in the repository.\n" +
+			"Review it and commit it to the repository as " + BuildDefinitionFileName + ".",
+		Content: []*yaml.Node{root},
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		log.Warn().WithError(err).Message("Failed to encode generated build definition.")
+		return ""
+	}
+	return buf.String()
+}
+
+func newContainerStep(image string, cmds ...string) *yaml.Node {
+	commands := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for _, cmd := range cmds {
+		commands.Content = append(commands.Content, newYAMLScalar(cmd))
+	}
+	container := newYAMLMap()
+	addYAMLMapEntry(container, "image", newYAMLScalar(image))
+	addYAMLMapEntry(container, "cmds", commands)
+	return newYAMLStep("container", container)
+}
+
+// newYAMLStep returns a step with a single step type.
+func newYAMLStep(stepType string, fields *yaml.Node) *yaml.Node {
+	step := newYAMLMap()
+	addYAMLMapEntry(step, stepType, fields)
+	return step
+}
+
+func newYAMLMap() *yaml.Node {
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+}
+
+func newYAMLScalar(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+func addYAMLMapEntry(node *yaml.Node, key string, value *yaml.Node) {
+	node.Content = append(node.Content, newYAMLScalar(key), value)
+}
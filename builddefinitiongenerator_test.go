@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-gitlab"
+	"gopkg.in/yaml.v3"
+)
+
+func TestGenerateBuildDefinition(t *testing.T) {
+	content := generateBuildDefinition(repositoryLayout{
+		dockerfile: true,
+		goModule:   true,
+		npmPackage: true,
+		helmCharts: []string{".", "charts/web"},
+	})
+	assert.Empty(t, lintBuildDefinition(content))
+	assert.Contains(t, content, "go test ./...")
+	assert.Contains(t, content, "npm test")
+	assert.Contains(t, content, "file: Dockerfile")
+	assert.Contains(t, content, "helm-package-chart:")
+	assert.Contains(t, content, "chart-path: charts/web")
+
+	assert.Empty(t, generateBuildDefinition(repositoryLayout{}))
+}
+
+func TestGenerateBuildDefinitionQuotesNames(t *testing.T) {
+	const chart = "charts/web: #1"
+	content := generateBuildDefinition(repositoryLayout{helmCharts: []string{chart}})
+	assert.Empty(t, lintBuildDefinition(content))
+
+	var parsed map[string]map[string]map[string]map[string]string
+	require.NoError(t, yaml.Unmarshal([]byte(content), &parsed))
+	assert.Equal(t, chart, parsed["package"]["helm-package-web: #1"]["helm-package"]["chart-path"])
+}
+
+func TestSuggestBuildDefinition(t *testing.T) {
+	project := &gitlab.Project{ID: 84, DefaultBranch: "main"}
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("listTree", 84, "main", "").Return([]*gitlab.TreeNode{
+		{Name: "Dockerfile", Path: "Dockerfile", Type: gitLabTreeNodeBlob},
+		{Name: "README.md", Path: "README.md", Type: gitLabTreeNodeBlob},
+		{Name: "go.mod", Path: "go.mod", Type: gitLabTreeNodeBlob},
+		{Name: "charts", Path: "charts", Type: gitLabTreeNodeTree},
+		{Name: "cmd", Path: "cmd", Type: gitLabTreeNodeTree},
+	}, nil)
+	gitLabMock.On("listTree", 84, "main", "charts").Return([]*gitlab.TreeNode{
+		{Name: "web", Path: "charts/web", Type: gitLabTreeNodeTree},
+		{Name: "README.md", Path: "charts/README.md", Type: gitLabTreeNodeBlob},
+	}, nil)
+
+	importer := gitLabImporter{gitLabClient: gitLabMock}
+	suggestion, err := importer.suggestBuildDefinition(context.Background(), project, "main")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Dockerfile", "go.mod", "charts/web"}, suggestion.Detected)
+	assert.Equal(t, generateBuildDefinition(repositoryLayout{
+		dockerfile: true,
+		goModule:   true,
+		helmCharts: []string{"charts/web"},
+	}), suggestion.Content)
+	gitLabMock.AssertExpectations(t)
+}
+
+func TestGetBuildDefinitionGeneratesMissing(t *testing.T) {
+	project := &gitlab.Project{ID: 84, DefaultBranch: "main"}
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getBuildDefinitionIfExists", 84, "main", []string{BuildDefinitionFileName}).
+		Return(buildDefinitionFile{}, nil)
+	gitLabMock.On("listTree", 84, "main", "").Return([]*gitlab.TreeNode{
+		{Name: "Dockerfile", Path: "Dockerfile", Type: gitLabTreeNodeBlob},
+	}, nil)
+
+	importer := gitLabImporter{
+		gitLabClient:                    gitLabMock,
+		generateMissingBuildDefinitions: true,
+	}
+	buildDef, err := importer.getBuildDefinition(context.Background(), project)
+	require.NoError(t, err)
+	assert.True(t, buildDef.Generated)
+	assert.Empty(t, buildDef.Path)
+	assert.Contains(t, buildDef.Content, "file: Dockerfile")
+}
+
+func TestGetBuildDefinitionReusesGeneratedDefinition(t *testing.T) {
+	project := &gitlab.Project{ID: 84, DefaultBranch: "main"}
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getBuildDefinitionIfExists", 84, "main", []string{BuildDefinitionFileName}).
+		Return(buildDefinitionFile{}, nil).Twice()
+	gitLabMock.On("listTree", 84, "main", "").Return([]*gitlab.TreeNode{
+		{Name: "Dockerfile", Path: "Dockerfile", Type: gitLabTreeNodeBlob},
+	}, nil).Once()
+
+	importer := gitLabImporter{
+		gitLabClient:                    gitLabMock,
+		mapper:                          mapper{tokenID: 2, providerID: 1},
+		projectStates:                   newJSONStore[projectState](t.TempDir()),
+		generateMissingBuildDefinitions: true,
+	}
+	first, err := importer.getBuildDefinition(context.Background(), project)
+	require.NoError(t, err, "first lookup")
+	second, err := importer.getBuildDefinition(context.Background(), project)
+	require.NoError(t, err, "second lookup")
+	assert.True(t, second.Generated)
+	assert.Equal(t, first.Content, second.Content)
+	gitLabMock.AssertExpectations(t)
+}
+
+func TestGetBuildDefinitionRejectsInvalidGeneratedDefinition(t *testing.T) {
+	project := &gitlab.Project{ID: 84, DefaultBranch: "main"}
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getBuildDefinitionIfExists", 84, "main", []string{BuildDefinitionFileName}).
+		Return(buildDefinitionFile{}, nil)
+
+	importer := gitLabImporter{
+		gitLabClient:                    gitLabMock,
+		mapper:                          mapper{tokenID: 2, providerID: 1},
+		projectStates:                   newJSONStore[projectState](t.TempDir()),
+		generateMissingBuildDefinitions: true,
+		rejectInvalidBuildDefinitions:   true,
+	}
+	key := projectStateKey(1, 84)
+	require.NoError(t, importer.projectStates.save(key, projectState{GeneratedBuildDefinition: "build: [docker]\n"}))
+
+	buildDef, err := importer.getBuildDefinition(context.Background(), project)
+	require.NoError(t, err)
+	assert.True(t, buildDef.Generated)
+	assert.True(t, buildDef.Rejected)
+	assert.NotEmpty(t, buildDef.Diagnostics)
+}
+
+func TestListTreeEmptyRepository(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message":"404 Tree Not Found"}`))
+	}))
+	defer server.Close()
+
+	client, err := newGitLabClient("token", server.URL)
+	require.NoError(t, err)
+
+	nodes, err := client.listTree(context.Background(), 84, "", "")
+	require.NoError(t, err)
+	assert.Empty(t, nodes)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const buildDefinitionIncludeKey = "include"
+
+// buildDefinitionInclude is a reference to a build definition file in another
+// project, or in the same project if Project is empty. An empty Ref means the
+// project's default branch.
+type buildDefinitionInclude struct {
+	Project string
+	Ref     string
+	File    string
+}
+
+func (inc buildDefinitionInclude) String() string {
+	s := inc.Project + ":" + inc.File
+	if inc.Ref != "" {
+		s += "@" + inc.Ref
+	}
+	return s
+}
+
+// buildDefinitionIncluder expands the includes in build definitions by
+// fetching the included files from GitLab and merging them into the build
+// definition. The nodes of each included file are kept as parsed, so that
+// problems in them are reported at their lines in that file.
+type buildDefinitionIncluder struct {
+	gitLabClient gitLabFetcher
+	maxDepth     int
+	self         buildDefinitionInclude
+	// isImported returns true if the project, by its path, is imported into
+	// Wharf using the same provider as the build definition's project. Only
+	// files from such projects may be included.
+	isImported  func(ctx context.Context, projectPath string) (bool, error)
+	imported    map[string]bool
+	sources     map[*yaml.Node]string
+	diagnostics []BuildDefinitionDiagnostic
+}
+
+// buildDefinitionExpansion is a build definition with its includes merged
+// into it.
+type buildDefinitionExpansion struct {
+	Content     string
+	Diagnostics []BuildDefinitionDiagnostic
+	// doc is the expanded document, or nil if the build definition has no
+	// includes. Its nodes have the lines from the files they were parsed
+	// from, which are named in sources by their include.
+	doc     *yaml.Node
+	sources map[*yaml.Node]string
+}
+
+// lint lints the expanded build definition, reporting the problems at the
+// lines of the files they are in rather than the lines of the merged content.
+func (e buildDefinitionExpansion) lint() []BuildDefinitionDiagnostic {
+	if e.doc == nil {
+		return lintBuildDefinition(e.Content)
+	}
+	return lintBuildDefinitionDocument(e.doc, e.sources)
+}
+
+// expandBuildDefinitionIncludes returns the build definition with all its
+// includes merged into it, and the problems found when resolving them. The
+// content is returned as-is if it has no includes, or if it cannot be parsed,
+// in which case the linter reports the problem instead. The self include is
+// where the build definition itself was fetched from, whose project is used
+// for includes that do not name a project.
+func expandBuildDefinitionIncludes(ctx context.Context, client gitLabFetcher, maxDepth int, self buildDefinitionInclude, content string, isImported func(ctx context.Context, projectPath string) (bool, error)) buildDefinitionExpansion {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil || len(doc.Content) == 0 {
+		return buildDefinitionExpansion{Content: content}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode || findMapValue(root, buildDefinitionIncludeKey) == nil {
+		return buildDefinitionExpansion{Content: content}
+	}
+
+	inc := buildDefinitionIncluder{
+		gitLabClient: client,
+		maxDepth:     maxDepth,
+		self:         self,
+		isImported:   isImported,
+		imported:     make(map[string]bool),
+		sources:      make(map[*yaml.Node]string),
+	}
+	expanded := inc.expand(ctx, root, self, "", nil)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(expanded); err != nil {
+		inc.diagnostics = append(inc.diagnostics, BuildDefinitionDiagnostic{
+			Severity: buildDefinitionError,
+			Message:  fmt.Sprintf("failed to encode expanded build definition: %v", err),
+			Line:     1,
+			Column:   1,
+		})
+		return buildDefinitionExpansion{Content: content, Diagnostics: inc.diagnostics}
+	}
+	return buildDefinitionExpansion{
+		Content:     buf.String(),
+		Diagnostics: inc.diagnostics,
+		doc:         &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{expanded}},
+		sources:     inc.sources,
+	}
+}
+
+// expand returns the build definition with its includes merged into it. The
+// file is the include the build definition came from, or empty for the
+// top-level file, and the chain is the includes that led to it, used to
+// detect cycles.
+func (inc *buildDefinitionIncluder) expand(ctx context.Context, root *yaml.Node, from buildDefinitionInclude, file string, chain []buildDefinitionInclude) *yaml.Node {
+	includes := findMapValue(root, buildDefinitionIncludeKey)
+	local := withoutMapKey(root, buildDefinitionIncludeKey)
+	if includes == nil {
+		return local
+	}
+	if includes.Kind != yaml.SequenceNode {
+		inc.report(includes, []string{buildDefinitionIncludeKey}, file,
+			"include must be a list of files to include")
+		return local
+	}
+
+	chain = append(append([]buildDefinitionInclude{}, chain...), from)
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for i, item := range includes.Content {
+		itemPath := []string{buildDefinitionIncludeKey, strconv.Itoa(i)}
+		include, ok := inc.parseInclude(item, from, itemPath, file)
+		if !ok {
+			continue
+		}
+		included, ok := inc.fetch(ctx, include, chain, item, itemPath, file)
+		if !ok {
+			continue
+		}
+		merged = mergeBuildDefinitions(merged, inc.expand(ctx, included, include, include.String(), chain))
+	}
+	return mergeBuildDefinitions(merged, local)
+}
+
+func (inc *buildDefinitionIncluder) parseInclude(item *yaml.Node, from buildDefinitionInclude, path []string, file string) (buildDefinitionInclude, bool) {
+	include := buildDefinitionInclude{Project: from.Project}
+	switch item.Kind {
+	case yaml.ScalarNode:
+		// A plain file name includes a file from the same project and ref.
+		include.File = item.Value
+		include.Ref = from.Ref
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(item.Content); i += 2 {
+			switch item.Content[i].Value {
+			case "project":
+				include.Project = item.Content[i+1].Value
+			case "ref":
+				include.Ref = item.Content[i+1].Value
+			case "file":
+				include.File = item.Content[i+1].Value
+			default:
+				inc.report(item.Content[i], append(path, item.Content[i].Value), file,
+					"unknown include field %q, must be one of: project, ref, file", item.Content[i].Value)
+			}
+		}
+		if findMapValue(item, "project") == nil && findMapValue(item, "ref") == nil {
+			include.Ref = from.Ref
+		}
+	default:
+		inc.report(item, path, file,
+			"include must be a file name, or a map with a project, ref, and file")
+		return include, false
+	}
+	include.File = strings.TrimPrefix(include.File, "/")
+	if include.File == "" {
+		inc.report(item, path, file, "include must have a file")
+		return include, false
+	}
+	return include, true
+}
+
+// fetch fetches and parses an included file, unless it would create a cycle,
+// nest the includes too deep, or read from a project that is not imported
+// using the same provider. Problems are reported at the include item.
+func (inc *buildDefinitionIncluder) fetch(ctx context.Context, include buildDefinitionInclude, chain []buildDefinitionInclude, item *yaml.Node, path []string, file string) (*yaml.Node, bool) {
+	for i, c := range chain {
+		if c.Project == include.Project && c.Ref == include.Ref && c.File == include.File {
+			inc.report(item, path, file, "include cycle: %s", formatIncludeChain(append(chain[i:], include)))
+			return nil, false
+		}
+	}
+	// The chain starts with the top-level file at depth 0, so the included
+	// file is len(chain) levels deep, and a max depth of 1 only allows the
+	// top-level file to include files.
+	if depth := len(chain); depth > inc.maxDepth {
+		inc.report(item, path, file, "includes are nested more than %d levels deep: %s",
+			inc.maxDepth, formatIncludeChain(append(chain, include)))
+		return nil, false
+	}
+	if ok, err := inc.isProjectImported(ctx, include.Project); err != nil {
+		inc.report(item, path, file, "failed to check if project %s is imported: %v", include.Project, err)
+		return nil, false
+	} else if !ok {
+		inc.report(item, path, file, "cannot include %s, as project %s is not imported into Wharf using the same provider",
+			include, include.Project)
+		return nil, false
+	}
+
+	content, ok, err := inc.gitLabClient.getFileIfExists(ctx, include.Project, include.Ref, include.File)
+	if err != nil {
+		inc.report(item, path, file, "failed to fetch included file %s: %v", include, err)
+		return nil, false
+	}
+	if !ok {
+		inc.report(item, path, file, "included file %s not found", include)
+		return nil, false
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil {
+		inc.report(item, path, file, "in included file %s: %v", include, err)
+		return nil, false
+	}
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}, true
+	}
+	if doc.Content[0].Kind != yaml.MappingNode {
+		inc.report(item, path, file, "included file %s must be a map of stages", include)
+		return nil, false
+	}
+	inc.setSource(doc.Content[0], include.String())
+	return doc.Content[0], true
+}
+
+// isProjectImported returns true if files may be included from the project,
+// which is always the case for the build definition's own project.
+func (inc *buildDefinitionIncluder) isProjectImported(ctx context.Context, project string) (bool, error) {
+	if project == inc.self.Project {
+		return true, nil
+	}
+	if imported, ok := inc.imported[project]; ok {
+		return imported, nil
+	}
+	imported, err := inc.isImported(ctx, project)
+	if err != nil {
+		return false, err
+	}
+	inc.imported[project] = imported
+	return imported, nil
+}
+
+// setSource records the included file that the node and its children were
+// parsed from.
+func (inc *buildDefinitionIncluder) setSource(node *yaml.Node, file string) {
+	inc.sources[node] = file
+	for _, child := range node.Content {
+		inc.setSource(child, file)
+	}
+}
+
+// report adds an error at the node in the file, which is empty for the
+// top-level file.
+func (inc *buildDefinitionIncluder) report(node *yaml.Node, path []string, file string, format string, args ...any) {
+	inc.diagnostics = append(inc.diagnostics, BuildDefinitionDiagnostic{
+		Severity: buildDefinitionError,
+		Message:  fmt.Sprintf(format, args...),
+		File:     file,
+		Path:     strings.Join(path, "."),
+		Line:     node.Line,
+		Column:   node.Column,
+	})
+}
+
+func formatIncludeChain(chain []buildDefinitionInclude) string {
+	names := make([]string, len(chain))
+	for i, c := range chain {
+		names[i] = c.String()
+	}
+	return strings.Join(names, " -> ")
+}
+
+// mergeBuildDefinitions returns the base build definition with the override
+// merged into it. Environments are merged one by one, and inputs by name,
+// while stages in the override replace the stages with the same name.
+func mergeBuildDefinitions(base, override *yaml.Node) *yaml.Node {
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	merged.Content = append(merged.Content, base.Content...)
+	for i := 0; i+1 < len(override.Content); i += 2 {
+		key, value := override.Content[i], override.Content[i+1]
+		existing := findMapValue(merged, key.Value)
+		switch {
+		case existing == nil:
+			merged.Content = append(merged.Content, key, value)
+			continue
+		case key.Value == buildDefinitionEnvironmentsKey && existing.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode:
+			value = mergeMaps(existing, value)
+		case key.Value == buildDefinitionInputsKey && existing.Kind == yaml.SequenceNode && value.Kind == yaml.SequenceNode:
+			value = mergeInputs(existing, value)
+		}
+		setMapValue(merged, key.Value, value)
+	}
+	return merged
+}
+
+func mergeMaps(base, override *yaml.Node) *yaml.Node {
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	merged.Content = append(merged.Content, base.Content...)
+	for i := 0; i+1 < len(override.Content); i += 2 {
+		if findMapValue(merged, override.Content[i].Value) == nil {
+			merged.Content = append(merged.Content, override.Content[i], override.Content[i+1])
+		} else {
+			setMapValue(merged, override.Content[i].Value, override.Content[i+1])
+		}
+	}
+	return merged
+}
+
+func mergeInputs(base, override *yaml.Node) *yaml.Node {
+	merged := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	overridden := make(map[string]bool)
+	for _, input := range override.Content {
+		if name := findMapValue(input, "name"); name != nil {
+			overridden[name.Value] = true
+		}
+	}
+	for _, input := range base.Content {
+		if name := findMapValue(input, "name"); name != nil && overridden[name.Value] {
+			continue
+		}
+		merged.Content = append(merged.Content, input)
+	}
+	merged.Content = append(merged.Content, override.Content...)
+	return merged
+}
+
+// findMapValue returns the value of the key in a YAML map, or nil if the node
+// is not a map or does not have the key.
+func findMapValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func setMapValue(node *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content[i+1] = value
+			return
+		}
+	}
+}
+
+func withoutMapKey(node *yaml.Node, key string) *yaml.Node {
+	result := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != key {
+			result.Content = append(result.Content, node.Content[i], node.Content[i+1])
+		}
+	}
+	return result
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestExpandBuildDefinitionIncludes(t *testing.T) {
+	content := `include:
+  - project: default/templates
+    ref: v1
+    file: /go.yml
+environments:
+  prod:
+    REPLICAS: 3
+test:
+  unit:
+    container:
+      image: golang:1.18
+      cmds: [go test -race ./...]
+deploy:
+  environments: [dev, prod]
+  helm:
+    helm:
+      chart: web
+`
+	template := `inputs:
+  - name: tag
+    type: string
+environments:
+  dev:
+    REPLICAS: 1
+  prod:
+    REPLICAS: 2
+build:
+  docker:
+    docker:
+      file: Dockerfile
+test:
+  unit:
+    container:
+      image: golang:1.18
+      cmds: [go test ./...]
+`
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getFileIfExists", "default/templates", "v1", "go.yml").Return(template, true, nil)
+
+	self := buildDefinitionInclude{Project: "default/web", Ref: "main", File: BuildDefinitionFileName}
+	expansion := expandBuildDefinitionIncludes(context.Background(), gitLabMock, 3, self, content, importedProjects("default/templates"))
+	assert.Empty(t, expansion.Diagnostics)
+	assert.Empty(t, expansion.lint())
+	expanded := expansion.Content
+
+	var got yaml.Node
+	require.NoError(t, yaml.Unmarshal([]byte(expanded), &got))
+	root := got.Content[0]
+	var keys []string
+	for i := 0; i < len(root.Content); i += 2 {
+		keys = append(keys, root.Content[i].Value)
+	}
+	assert.Equal(t, []string{"inputs", "environments", "build", "test", "deploy"}, keys)
+	assert.Contains(t, expanded, "go test -race ./...")
+	assert.NotContains(t, expanded, "- go test ./...")
+
+	var parsed map[string]any
+	require.NoError(t, yaml.Unmarshal([]byte(expanded), &parsed))
+	assert.Equal(t, map[string]any{
+		"dev":  map[string]any{"REPLICAS": 1},
+		"prod": map[string]any{"REPLICAS": 3},
+	}, parsed["environments"])
+}
+
+func TestExpandBuildDefinitionIncludesWithoutIncludes(t *testing.T) {
+	gitLabMock := new(gitLabClientMock)
+	self := buildDefinitionInclude{Project: "default/web", File: BuildDefinitionFileName}
+	expansion := expandBuildDefinitionIncludes(context.Background(), gitLabMock, 3, self, validBuildDefinition, importedProjects())
+	assert.Equal(t, validBuildDefinition, expansion.Content)
+	assert.Empty(t, expansion.Diagnostics)
+	assert.Empty(t, expansion.lint())
+	gitLabMock.AssertNotCalled(t, "getFileIfExists")
+}
+
+func TestExpandBuildDefinitionIncludesProblems(t *testing.T) {
+	type testCase struct {
+		name        string
+		maxDepth    int
+		files       map[string]string
+		wantMessage string
+		wantFile    string
+		wantLine    int
+	}
+	testCases := []testCase{
+		{
+			name: "cycle",
+			files: map[string]string{
+				"a.yml": "include: [b.yml]\n",
+				"b.yml": "include: [.wharf-ci.yml]\n",
+			},
+			wantMessage: "include cycle: default/web:.wharf-ci.yml@main -> default/web:a.yml@main -> " +
+				"default/web:b.yml@main -> default/web:.wharf-ci.yml@main",
+			wantFile: "default/web:b.yml@main",
+			wantLine: 1,
+		},
+		{
+			name:     "too deep",
+			maxDepth: 1,
+			files: map[string]string{
+				"a.yml": "include: [b.yml]\n",
+			},
+			wantMessage: "includes are nested more than 1 levels deep: default/web:.wharf-ci.yml@main -> " +
+				"default/web:a.yml@main -> default/web:b.yml@main",
+			wantFile: "default/web:a.yml@main",
+			wantLine: 1,
+		},
+		{
+			name: "not imported",
+			files: map[string]string{
+				"a.yml": "build: {}\ninclude:\n  - project: default/secrets\n    file: keys.yml\n",
+			},
+			wantMessage: "cannot include default/secrets:keys.yml, as project default/secrets " +
+				"is not imported into Wharf using the same provider",
+			wantFile: "default/web:a.yml@main",
+			wantLine: 3,
+		},
+		{
+			name:        "not found",
+			files:       map[string]string{},
+			wantMessage: "included file default/web:a.yml@main not found",
+			wantLine:    2,
+		},
+		{
+			name: "invalid YAML",
+			files: map[string]string{
+				"a.yml": "build: [\n",
+			},
+			wantMessage: "in included file default/web:a.yml@main: yaml: line 1: did not find expected node content",
+			wantLine:    2,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gitLabMock := new(gitLabClientMock)
+			for file, content := range tc.files {
+				gitLabMock.On("getFileIfExists", "default/web", "main", file).Return(content, true, nil)
+			}
+			gitLabMock.On("getFileIfExists", "default/web", "main", "a.yml").Return("", false, nil).Maybe()
+			maxDepth := tc.maxDepth
+			if maxDepth == 0 {
+				maxDepth = 3
+			}
+
+			content := "include:\n  - a.yml\nbuild:\n  docker:\n    docker: {}\n"
+			self := buildDefinitionInclude{Project: "default/web", Ref: "main", File: BuildDefinitionFileName}
+			expansion := expandBuildDefinitionIncludes(context.Background(), gitLabMock, maxDepth, self, content, importedProjects())
+			require.Len(t, expansion.Diagnostics, 1)
+			assert.Equal(t, tc.wantMessage, expansion.Diagnostics[0].Message)
+			assert.Equal(t, tc.wantFile, expansion.Diagnostics[0].File)
+			assert.Equal(t, "include.0", expansion.Diagnostics[0].Path)
+			assert.Equal(t, tc.wantLine, expansion.Diagnostics[0].Line)
+			gitLabMock.AssertNotCalled(t, "getFileIfExists", "default/secrets", "", "keys.yml")
+		})
+	}
+}
+
+func TestExpandBuildDefinitionIncludesMaxDepth(t *testing.T) {
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getFileIfExists", "default/web", "main", "a.yml").Return("include: [b.yml]\n", true, nil)
+	gitLabMock.On("getFileIfExists", "default/web", "main", "b.yml").Return("include: [c.yml]\n", true, nil)
+	gitLabMock.On("getFileIfExists", "default/web", "main", "c.yml").Return("build:\n  docker:\n    docker: {}\n", true, nil)
+
+	content := "include: [a.yml]\n"
+	self := buildDefinitionInclude{Project: "default/web", Ref: "main", File: BuildDefinitionFileName}
+	expansion := expandBuildDefinitionIncludes(context.Background(), gitLabMock, 3, self, content, importedProjects())
+	assert.Empty(t, expansion.Diagnostics, "includes nested exactly max depth levels deep")
+	assert.Contains(t, expansion.Content, "build:")
+
+	expansion = expandBuildDefinitionIncludes(context.Background(), gitLabMock, 2, self, content, importedProjects())
+	require.Len(t, expansion.Diagnostics, 1, "includes nested one level deeper than max depth")
+	assert.Equal(t, "default/web:b.yml@main", expansion.Diagnostics[0].File)
+}
+
+func TestExpandBuildDefinitionIncludesLintsAtIncludedLines(t *testing.T) {
+	content := `include:
+  - project: default/templates
+    file: go.yml
+test:
+  unit: not a map
+`
+	template := `build:
+  docker:
+    docker: {}
+deploy:
+  environments: [prod]
+  helm:
+    helm: {}
+`
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getFileIfExists", "default/templates", "", "go.yml").Return(template, true, nil)
+
+	self := buildDefinitionInclude{Project: "default/web", Ref: "main", File: BuildDefinitionFileName}
+	expansion := expandBuildDefinitionIncludes(context.Background(), gitLabMock, 3, self, content, importedProjects("default/templates"))
+	require.Empty(t, expansion.Diagnostics)
+
+	diagnostics := expansion.lint()
+	require.Len(t, diagnostics, 2)
+	assert.Equal(t, "default/templates:go.yml", diagnostics[0].File)
+	assert.Equal(t, "deploy.environments", diagnostics[0].Path)
+	assert.Equal(t, 5, diagnostics[0].Line)
+	assert.Equal(t, "", diagnostics[1].File)
+	assert.Equal(t, "test.unit", diagnostics[1].Path)
+	assert.Equal(t, 5, diagnostics[1].Line)
+}
+
+func importedProjects(paths ...string) func(ctx context.Context, projectPath string) (bool, error) {
+	return func(ctx context.Context, projectPath string) (bool, error) {
+		for _, path := range paths {
+			if path == projectPath {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
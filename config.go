@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"time"
 
 	"github.com/iver-wharf/wharf-core/pkg/config"
 	"github.com/iver-wharf/wharf-core/pkg/env"
@@ -27,9 +29,11 @@ import (
 // case-insensitive. Keeping camelCasing in YAML config files is recommended
 // for consistency.
 type Config struct {
-	API  WharfAPIConfig
-	HTTP HTTPConfig
-	CA   CertConfig
+	API      WharfAPIConfig
+	HTTP     HTTPConfig
+	CA       CertConfig
+	Import   ImportConfig
+	Schedule ScheduleConfig
 }
 
 // WharfAPIConfig holds settings for the connection to the Wharf API.
@@ -40,6 +44,13 @@ type WharfAPIConfig struct {
 	//
 	// Added in v1.3.0.
 	URL string
+
+	// AuthHeader is the value of the Authorization HTTP header used in
+	// requests to the Wharf API that are not made on behalf of an incoming
+	// request, such as from scheduled syncs. For example: "Bearer eyJhbGc..."
+	//
+	// Added in v2.1.0.
+	AuthHeader string
 }
 
 // HTTPConfig holds settings for the HTTP server.
@@ -81,6 +92,445 @@ type CertConfig struct {
 	//
 	// Added in v1.3.0.
 	CertsFile string
+
+	// InsecureSkipVerify disables the verification of TLS certificates in
+	// requests to the Wharf API and when downloading avatars. It is applied
+	// once on startup. Only use this for testing, and prefer adding the
+	// certificates using CertsFile instead.
+	//
+	// Added in v2.1.0.
+	InsecureSkipVerify bool
+}
+
+// ImportConfig holds settings for importing projects from GitLab.
+type ImportConfig struct {
+	// CheckpointDir is the path to a directory where the progress of group and
+	// instance-wide imports is saved after each page of projects. An import
+	// that is requested with "resume" set to true continues from the saved
+	// checkpoint instead of starting over from the first page. If the
+	// previous import got through all pages but some projects failed, then
+	// the resumed import retries those and then imports all projects again.
+	// Imports with different scope filters have separate checkpoints.
+	//
+	// The directory is created if it does not exist, and must be on a
+	// persistent volume for checkpoints to survive restarts. Empty, the
+	// default, disables checkpointing.
+	//
+	// Added in v2.1.0.
+	CheckpointDir string
+
+	// SyncStateDir is the path to a directory where the time of the last
+	// successful sync is saved, per provider, group and scope. It is used by
+	// scheduled syncs with OnlyActive enabled, and by import requests with
+	// "onlyActive" set to true.
+	//
+	// The directory is created if it does not exist, and must be on a
+	// persistent volume for the sync state to survive restarts. Empty, the
+	// default, disables saving the sync state.
+	//
+	// Added in v2.1.0.
+	SyncStateDir string
+
+	// ProjectStateDir is the path to a directory where details about each
+	// imported project that Wharf does not store are saved, such as which
+	// build definition file was found, or the build definition generated when
+	// none was found.
+	//
+	// The directory is created if it does not exist, and must be on a
+	// persistent volume for the project state to survive restarts. Empty, the
+	// default, disables saving the project state.
+	//
+	// Added in v2.1.0.
+	ProjectStateDir string
+
+	// FallbackDefaultBranch is the branch to fetch build definitions from for
+	// projects that GitLab does not report a default branch for, such as
+	// when the token may not read the repository. Empty means that GitLab
+	// picks the branch, which is the repository's HEAD.
+	//
+	// Empty repositories are imported without branches or build definition,
+	// regardless of this setting.
+	//
+	// Added in v2.1.0.
+	FallbackDefaultBranch string
+
+	// BuildDefinitionPaths is the list of paths in the repository to look for
+	// the build definition file at, in order. The first file that exists is
+	// used, and its path is saved so that it is looked for first on later
+	// refreshes of the project.
+	//
+	// Added in v2.1.0.
+	BuildDefinitionPaths []string
+
+	// RejectInvalidBuildDefinitions makes imports and refreshes not store
+	// build definitions that fail validation, such as a stage that is not a
+	// map of steps. Imported projects then get no build definition, while
+	// refreshed projects keep the one they had. The problems found are
+	// reported in the import result either way.
+	//
+	// Added in v2.1.0.
+	RejectInvalidBuildDefinitions bool
+
+	// GenerateMissingBuildDefinitions makes imports and refreshes of projects
+	// without a build definition file store a build definition generated from
+	// the files in the repository instead, such as a Dockerfile, go.mod,
+	// package.json, or Helm charts. The same build definition is suggested by
+	// the POST /import/gitlab/suggest endpoint regardless of this setting.
+	//
+	// Generated build definitions are validated like files, and are rejected
+	// by RejectInvalidBuildDefinitions. When ProjectStateDir is set, the
+	// generated build definition is saved and reused on later refreshes
+	// instead of being generated again, until a build definition file is
+	// added to the repository.
+	//
+	// Added in v2.1.0.
+	GenerateMissingBuildDefinitions bool
+
+	// BuildDefinitionIncludeMaxDepth is how deeply includes in build
+	// definitions may be nested, where 1 only allows the build definition in
+	// the repository to include other files, but not those files to include
+	// further files. Zero, the default, disables includes, leaving them
+	// as-is.
+	//
+	// Includes are listed under the top-level "include" key, each either a
+	// file name in the same project and ref, or a map with the full "project"
+	// path, the "file" path, and optionally the "ref" which defaults to the
+	// project's default branch. The included files are fetched with the
+	// provider's token, and are merged into the build definition before it is
+	// stored in Wharf. Stages in the including file replace included stages
+	// with the same name, while environments and inputs are merged.
+	//
+	// Files may only be included from the project itself, or from other
+	// projects that are imported into Wharf using the same provider. Problems
+	// in included files are reported with the file they are in, at the lines
+	// of that file.
+	//
+	// Enabling includes changes the meaning of existing build definitions
+	// that have a stage named "include".
+	//
+	// Added in v2.1.0.
+	BuildDefinitionIncludeMaxDepth int
+
+	// BranchBuildDefinitions makes imports and refreshes also fetch the build
+	// definition of each branch other than the default branch, or only of the
+	// branches matching BranchBuildDefinitionPatterns if set. They are looked
+	// for at the same paths as the project's build definition, and are stored
+	// in BranchBuildDefinitionDir, as Wharf only stores the build definition
+	// of the default branch. They are then served by the
+	// GET /import/gitlab/projects/{projectId}/build-definition endpoint.
+	//
+	// Added in v2.1.0.
+	BranchBuildDefinitions bool
+
+	// BranchBuildDefinitionPatterns limits BranchBuildDefinitions to the
+	// branches whose names match any of the patterns, such as "feature/*".
+	// The patterns use the syntax of Go's path.Match, where "*" does not
+	// match "/". Empty means all branches.
+	//
+	// Added in v2.1.0.
+	BranchBuildDefinitionPatterns []string
+
+	// BranchBuildDefinitionDir is the path to a directory where the build
+	// definitions of branches are stored, one file per Wharf project.
+	//
+	// The directory is created if it does not exist, and must be on a
+	// persistent volume for the build definitions to survive restarts. Empty,
+	// the default, disables per-branch build definitions.
+	//
+	// Added in v2.1.0.
+	BranchBuildDefinitionDir string
+
+	// BlobCacheDir is the path to a directory where build definition files
+	// and included files fetched from GitLab are cached by their blob SHA.
+	// Before downloading a file, only its metadata is fetched, and the file
+	// is downloaded only if its blob SHA is not already cached. This lessens
+	// the load on GitLab when refreshing many projects whose build
+	// definitions rarely change.
+	//
+	// The directory is created if it does not exist. Empty, the default,
+	// disables the cache.
+	//
+	// Added in v2.1.0.
+	BlobCacheDir string
+
+	// BlobCacheMaxSize is the most bytes the cached files may take up
+	// together. The files that were cached the longest time ago are removed
+	// when the cache grows larger than this. Zero means no limit.
+	//
+	// Added in v2.1.0.
+	BlobCacheMaxSize int64
+
+	// ProjectMetadataFields are the fields of GitLab projects that Wharf has
+	// no fields for, which are instead stored in ProjectMetadataDir on imports
+	// and refreshes. They are then served by the
+	// GET /import/gitlab/projects/{projectId}/metadata endpoint. The
+	// available fields are "webUrl", "visibility", "topics", "archived",
+	// "forkedFrom", "lastActivityAt", and "defaultBranch". Empty means all
+	// fields.
+	//
+	// Added in v2.1.0.
+	ProjectMetadataFields []string
+
+	// ProjectMetadataDir is the path to a directory where the metadata of
+	// imported projects is stored, one file per Wharf project.
+	//
+	// The directory is created if it does not exist. Empty, the default,
+	// disables project metadata.
+	//
+	// Added in v2.1.0.
+	ProjectMetadataDir string
+
+	// ImportTags makes imports and refreshes also add the tags of each
+	// project to its branches in Wharf, or only the tags matching TagPatterns
+	// if set, so that builds can be started from tags. Tags with the same name
+	// as a branch are skipped. Tag push webhooks sent to the
+	// POST /import/gitlab/trigger endpoint keep them in sync.
+	//
+	// Added in v2.1.0.
+	ImportTags bool
+
+	// TagPatterns limits ImportTags to the tags whose names match any of the
+	// patterns, such as "v*". The patterns use the syntax of Go's path.Match,
+	// where "*" does not match "/". Empty means all tags.
+	//
+	// Added in v2.1.0.
+	TagPatterns []string
+
+	// TriggerToken is the secret token that GitLab webhooks sent to the
+	// POST /import/gitlab/trigger endpoint must have in their X-Gitlab-Token
+	// header. Requests with another token are rejected before any work is
+	// done. This is the "Secret token" set on the webhook in GitLab.
+	//
+	// Empty, the default, accepts all requests but rejects tag push events
+	// with 403 Forbidden, as the sender cannot be verified.
+	//
+	// Added in v2.1.0.
+	TriggerToken string
+
+	// BranchMetadataDir is the path to a directory where details about the
+	// branches of imported projects that Wharf does not store are saved, one
+	// file per Wharf project. This includes whether the branch is protected,
+	// and the SHA and date of its head commit. They are then served by the
+	// GET /import/gitlab/projects/{projectId}/branches endpoint.
+	//
+	// The directory is created if it does not exist. Empty, the default,
+	// disables branch metadata.
+	//
+	// Added in v2.1.0.
+	BranchMetadataDir string
+
+	// AvatarProxy holds settings for serving the avatars of GitLab projects
+	// through wharf-provider-gitlab, for avatars that require signing in to
+	// GitLab, such as those of private projects.
+	//
+	// Added in v2.1.0.
+	AvatarProxy AvatarProxyConfig
+
+	// Providers are settings that only apply to projects imported using a
+	// given Wharf provider. Providers that are not listed use the defaults.
+	//
+	// Added in v2.1.0.
+	Providers []ProviderConfig
+
+	// CallTimeout is the longest time a single request to the GitLab API may
+	// take, including retries, before it is aborted. Zero means no limit.
+	//
+	// Added in v2.1.0.
+	CallTimeout time.Duration
+
+	// OperationTimeout is the longest time a whole import or refresh may
+	// take, such as importing all projects in a group, before it is aborted.
+	// Group and instance-wide imports that time out can be continued by
+	// resuming from their checkpoint. Zero means no limit.
+	//
+	// Added in v2.1.0.
+	OperationTimeout time.Duration
+}
+
+// AvatarProxyConfig holds settings for the
+// GET /import/gitlab/avatars/{projectId} endpoint, which downloads avatars from
+// GitLab using the provider's token, and caches them on disk.
+type AvatarProxyConfig struct {
+	// URL is the base URL that wharf-provider-gitlab is reached at from the
+	// Wharf web UI, such as "https://wharf.example.com". When set, the avatar
+	// URL stored on projects in Wharf points at the avatar endpoint instead of
+	// at GitLab. Empty keeps the avatar URLs from GitLab.
+	//
+	// The avatar endpoint does not authenticate its callers, so anyone who
+	// can reach wharf-provider-gitlab can read the avatars of the projects
+	// imported into Wharf, including private ones. The endpoint is always
+	// registered, but only serves projects that are imported using the
+	// requested provider.
+	//
+	// Added in v2.1.0.
+	URL string
+
+	// CacheDir is the path to a directory where downloaded avatars are
+	// cached.
+	//
+	// The directory is created if it does not exist. Empty, the default,
+	// disables the cache, so avatars are downloaded on every request.
+	//
+	// Added in v2.1.0.
+	CacheDir string
+
+	// CacheTTL is how long a downloaded avatar is served from the cache before
+	// it is downloaded again. Each request for a cached avatar still checks
+	// that the project is imported into Wharf.
+	//
+	// Added in v2.1.0.
+	CacheTTL time.Duration
+
+	// CacheMaxSize is the most bytes the cached avatars may take up together.
+	// The avatars that were downloaded the longest time ago are removed when
+	// the cache grows larger than this. Zero means no limit.
+	//
+	// Added in v2.1.0.
+	CacheMaxSize int64
+
+	// MaxSize is the most bytes a single avatar may be. Larger avatars are
+	// not served.
+	//
+	// Added in v2.1.0.
+	MaxSize int64
+}
+
+// ProviderConfig holds settings for projects imported using a single Wharf
+// provider.
+type ProviderConfig struct {
+	// ProviderID is the ID of the Wharf provider the settings apply to.
+	//
+	// Added in v2.1.0.
+	ProviderID uint
+
+	// GitURLProtocol is the protocol of the Git URL stored on projects in
+	// Wharf, which build clusters clone the repository from. Either "ssh" or
+	// "https", where the latter is for build clusters that can only reach
+	// GitLab over HTTPS with token authentication. Defaults to "ssh".
+	//
+	// Added in v2.1.0.
+	GitURLProtocol string
+
+	// GitURLHost replaces the host of the Git URL, with an optional port such
+	// as "gitlab-mirror.internal:2222", for build clusters that reach GitLab
+	// through an internal mirror or a different DNS name. Empty keeps the
+	// host reported by GitLab.
+	//
+	// Added in v2.1.0.
+	GitURLHost string
+
+	// StripGroupPrefix removes a leading namespace, such as "acme/platform",
+	// from the group name stored in Wharf, so that the group
+	// "acme/platform/tools" becomes "tools". Only whole path segments are
+	// removed, and a project directly in the namespace gets an empty group
+	// name.
+	//
+	// Added in v2.1.0.
+	StripGroupPrefix string
+
+	// GroupSeparator replaces the slashes between nested groups in the group
+	// name stored in Wharf, such as "-" to flatten "platform/tools" into
+	// "platform-tools". Empty keeps the slashes. It is applied after
+	// StripGroupPrefix.
+	//
+	// Added in v2.1.0.
+	GroupSeparator string
+
+	// ProjectNameSource is the GitLab project field that the project name
+	// stored in Wharf is taken from. Either "name", for the display name that
+	// may contain spaces and emojis, or "path", for the URL-safe path.
+	// Defaults to "name".
+	//
+	// Added in v2.1.0.
+	ProjectNameSource string
+
+	// GroupNameTemplate is a Go text/template that produces the group name
+	// stored in Wharf, such as "{{ .GroupName | lower }}". It is executed with
+	// .GroupName and .ProjectName, which are the names after the other naming
+	// settings are applied, and .Project, which is the GitLab project as
+	// returned by the GitLab API. The functions lower, upper, replace,
+	// trimPrefix and trimSuffix from Go's strings package are available.
+	// Empty keeps the group name as-is.
+	//
+	// Added in v2.1.0.
+	GroupNameTemplate string
+
+	// ProjectNameTemplate is a Go text/template that produces the project
+	// name stored in Wharf, such as "{{ .Project.Path }}". It is executed
+	// with the same data and functions as GroupNameTemplate. Empty keeps the
+	// project name as-is.
+	//
+	// Added in v2.1.0.
+	ProjectNameTemplate string
+}
+
+// ScheduleConfig holds settings for syncing projects from GitLab into Wharf
+// periodically in the background.
+type ScheduleConfig struct {
+	// Syncs is the list of scheduled syncs. Each sync imports or refreshes
+	// projects using the token and URL of a provider already stored in Wharf.
+	//
+	// The Wharf API is accessed using the API.AuthHeader setting.
+	//
+	// Added in v2.1.0.
+	Syncs []ScheduledSyncConfig
+}
+
+// ScheduledSyncConfig holds settings for a single scheduled sync.
+//
+// If ProjectID is set, then that Wharf project is refreshed. Otherwise, if
+// Group is set, then all projects in that GitLab group are imported, or only
+// the single project if Project is also set. If none of them are set, then
+// all projects in the GitLab instance are imported.
+type ScheduledSyncConfig struct {
+	// Name is used in logs to tell the scheduled syncs apart.
+	//
+	// Added in v2.1.0.
+	Name string
+
+	// Cron is a cron expression of when to run the sync, with the five fields
+	// minute, hour, day of month, month, and day of week, such as
+	// "30 2 * * *" for 02:30 every night. The descriptors "@hourly",
+	// "@daily", "@weekly", "@monthly", and "@yearly" are also accepted.
+	// Times are in the local timezone, as set by the TZ environment variable.
+	//
+	// Added in v2.1.0.
+	Cron string
+
+	// ProviderID is the ID of the Wharf provider whose token and GitLab URL
+	// are used.
+	//
+	// Added in v2.1.0.
+	ProviderID uint
+
+	// Group is the full path of a GitLab group to import.
+	//
+	// Added in v2.1.0.
+	Group string
+
+	// Project is the name of a GitLab project in the group to import.
+	//
+	// Added in v2.1.0.
+	Project string
+
+	// ProjectID is the ID of a Wharf project to refresh.
+	//
+	// Added in v2.1.0.
+	ProjectID uint
+
+	// OnlyActive makes group and instance-wide syncs only touch projects with
+	// activity in GitLab since the last successful run of this sync. The
+	// first run touches all projects.
+	//
+	// Added in v2.1.0.
+	OnlyActive bool
+
+	// Scope narrows down which projects are imported by group and
+	// instance-wide syncs, such as only the projects with a given topic. See
+	// the ImportScope type for the available fields.
+	//
+	// Added in v2.1.0.
+	Scope ImportScope
 }
 
 // DefaultConfig is the hard-coded default values for wharf-provider-gitlab's
@@ -89,6 +539,16 @@ var DefaultConfig = Config{
 	HTTP: HTTPConfig{
 		BindAddress: "0.0.0.0:8080",
 	},
+	Import: ImportConfig{
+		BuildDefinitionPaths: []string{BuildDefinitionFileName},
+		BlobCacheMaxSize:     50 * 1024 * 1024,
+		CallTimeout:          30 * time.Second,
+		AvatarProxy: AvatarProxyConfig{
+			CacheTTL:     24 * time.Hour,
+			CacheMaxSize: 50 * 1024 * 1024,
+			MaxSize:      1024 * 1024,
+		},
+	},
 }
 
 func loadConfig() (Config, error) {
@@ -108,9 +568,47 @@ func loadConfig() (Config, error) {
 	if err == nil {
 		err = cfg.addBackwardCompatibleConfigs()
 	}
+	if err == nil {
+		err = cfg.Import.validate()
+	}
 	return cfg, err
 }
 
+func (cfg ImportConfig) validate() error {
+	if err := validateBranchPatterns(cfg.BranchBuildDefinitionPatterns); err != nil {
+		return fmt.Errorf("import.branchBuildDefinitionPatterns: %w", err)
+	}
+	if err := validateBranchPatterns(cfg.TagPatterns); err != nil {
+		return fmt.Errorf("import.tagPatterns: %w", err)
+	}
+	if err := validateProjectMetadataFields(cfg.ProjectMetadataFields); err != nil {
+		return fmt.Errorf("import.projectMetadataFields: %w", err)
+	}
+	seenProviders := make(map[uint]bool, len(cfg.Providers))
+	for _, provider := range cfg.Providers {
+		if provider.ProviderID == 0 {
+			return fmt.Errorf("import.providers: providerId is required")
+		}
+		if seenProviders[provider.ProviderID] {
+			return fmt.Errorf("import.providers: provider with ID %d is listed more than once", provider.ProviderID)
+		}
+		seenProviders[provider.ProviderID] = true
+		if err := validateGitURLProtocol(provider.GitURLProtocol); err != nil {
+			return fmt.Errorf("import.providers: provider with ID %d: %w", provider.ProviderID, err)
+		}
+		if err := validateProjectNameSource(provider.ProjectNameSource); err != nil {
+			return fmt.Errorf("import.providers: provider with ID %d: %w", provider.ProviderID, err)
+		}
+		if err := validateNameTemplate("groupNameTemplate", provider.GroupNameTemplate); err != nil {
+			return fmt.Errorf("import.providers: provider with ID %d: %w", provider.ProviderID, err)
+		}
+		if err := validateNameTemplate("projectNameTemplate", provider.ProjectNameTemplate); err != nil {
+			return fmt.Errorf("import.providers: provider with ID %d: %w", provider.ProviderID, err)
+		}
+	}
+	return nil
+}
+
 func (cfg *Config) addBackwardCompatibleConfigs() error {
 	if value, ok := os.LookupEnv("ALLOW_CORS"); ok && value == "YES" {
 		cfg.HTTP.CORS.AllowAllOrigins = true
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed cron expression with the five standard fields:
+// minute, hour, day of month, month, and day of week. Each field is stored as
+// a bit set of the values it matches.
+type cronSchedule struct {
+	minute     uint64
+	hour       uint64
+	dayOfMonth uint64
+	month      uint64
+	dayOfWeek  uint64
+	// anyDayOfMonth and anyDayOfWeek are set when the respective field is
+	// "*", as a day then only has to match the other day field.
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+type cronField struct {
+	name string
+	min  int
+	max  int
+}
+
+var (
+	cronMinute     = cronField{"minute", 0, 59}
+	cronHour       = cronField{"hour", 0, 23}
+	cronDayOfMonth = cronField{"day of month", 1, 31}
+	cronMonth      = cronField{"month", 1, 12}
+	// Day of week allows 7 as an alias for Sunday, same as 0.
+	cronDayOfWeek = cronField{"day of week", 0, 7}
+)
+
+// parseCronSchedule parses a cron expression such as "30 2 * * 1-5", or one of
+// the descriptors such as "@daily". Each field accepts "*", single values,
+// ranges such as "1-5", steps such as "*/15" or "0-30/10", and comma-separated
+// lists of those.
+func parseCronSchedule(expr string) (cronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if descriptor, ok := cronDescriptors[expr]; ok {
+		expr = descriptor
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("cron expression %q: expected 5 fields, got %d", expr, len(fields))
+	}
+
+	var s cronSchedule
+	var err error
+	if s.minute, err = cronMinute.parse(fields[0]); err != nil {
+		return cronSchedule{}, err
+	}
+	if s.hour, err = cronHour.parse(fields[1]); err != nil {
+		return cronSchedule{}, err
+	}
+	if s.dayOfMonth, err = cronDayOfMonth.parse(fields[2]); err != nil {
+		return cronSchedule{}, err
+	}
+	if s.month, err = cronMonth.parse(fields[3]); err != nil {
+		return cronSchedule{}, err
+	}
+	if s.dayOfWeek, err = cronDayOfWeek.parse(fields[4]); err != nil {
+		return cronSchedule{}, err
+	}
+	if s.dayOfWeek&(1<<7) != 0 {
+		s.dayOfWeek |= 1 << 0
+	}
+	s.anyDayOfMonth = fields[2] == "*"
+	s.anyDayOfWeek = fields[4] == "*"
+	return s, nil
+}
+
+func (f cronField) parse(field string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			var err error
+			rangePart = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("cron %s field %q: invalid step", f.name, field)
+			}
+		}
+
+		low, high := f.min, f.max
+		if rangePart != "*" {
+			var err error
+			lowStr, highStr, isRange := strings.Cut(rangePart, "-")
+			if low, err = strconv.Atoi(lowStr); err != nil {
+				return 0, fmt.Errorf("cron %s field %q: invalid value", f.name, field)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(highStr); err != nil {
+					return 0, fmt.Errorf("cron %s field %q: invalid value", f.name, field)
+				}
+			} else if step > 1 {
+				// "5/15" means every 15th starting at 5.
+				high = f.max
+			}
+		}
+		if low < f.min || high > f.max || low > high {
+			return 0, fmt.Errorf("cron %s field %q: out of range %d-%d", f.name, field, f.min, f.max)
+		}
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first time after the given time that matches the
+// schedule, or the zero time if no such time exists within five years, such
+// as for "0 0 30 2 *".
+func (s cronSchedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// matchesDay follows the convention of the classic cron, where a day matches
+// if either of the day of month or day of week fields match, unless one of
+// them is "*".
+func (s cronSchedule) matchesDay(t time.Time) bool {
+	domMatch := s.dayOfMonth&(1<<uint(t.Day())) != 0
+	dowMatch := s.dayOfWeek&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.anyDayOfMonth && s.anyDayOfWeek:
+		return true
+	case s.anyDayOfMonth:
+		return dowMatch
+	case s.anyDayOfWeek:
+		return domMatch
+	default:
+		return domMatch || dowMatch
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	// 2022-05-11 was a Wednesday.
+	after := time.Date(2022, 5, 11, 14, 7, 30, 0, time.UTC)
+	testCases := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2022, 5, 11, 14, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2022, 5, 11, 14, 15, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2022, 5, 12, 2, 30, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2022, 5, 11, 15, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2022, 5, 12, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2022, 5, 12, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 6,7", time.Date(2022, 5, 14, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2022, 5, 13, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expr, func(t *testing.T) {
+			s, err := parseCronSchedule(tc.expr)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, s.next(after))
+		})
+	}
+}
+
+func TestParseCronScheduleInvalid(t *testing.T) {
+	testCases := []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+	}
+
+	for _, expr := range testCases {
+		t.Run(expr, func(t *testing.T) {
+			_, err := parseCronSchedule(expr)
+			assert.Error(t, err)
+		})
+	}
+}
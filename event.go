@@ -23,8 +23,36 @@ type RepositoryUpdate struct {
 	Refs []string `json:"refs"`
 }
 
+// TagPushEvent is the event type name for a GitLab tag push event, which is
+// sent both when a tag is created and when it is deleted.
+const TagPushEvent = "tag_push"
+
+// TagPush is a type of event regarding a tag being pushed to, or deleted
+// from, a GitLab repository.
+type TagPush struct {
+	Name      string `json:"event_name"`
+	Ref       string `json:"ref"`
+	ProjectID int    `json:"project_id"`
+	Project   struct {
+		Name              string `json:"name"`
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+}
+
 // Event is the base event type, used to figure out what event type the message
 // holds.
 type Event struct {
 	Name string `json:"event_name"`
+	// Kind is the event type name in project webhooks, which is set instead
+	// of Name in some of them.
+	Kind string `json:"object_kind"`
+}
+
+// typeName returns the event type name, regardless of whether it was sent by
+// a system hook or a project webhook.
+func (e Event) typeName() string {
+	if e.Name != "" {
+		return e.Name
+	}
+	return e.Kind
 }
@@ -1,28 +1,80 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/iver-wharf/wharf-core/pkg/ginutil"
 	"github.com/xanzy/go-gitlab"
 )
 
-// REF is a default branch name. Used when default not set.
-const REF = "master"
+// gitLabNamespaceKindUser is the kind of a GitLab namespace that belongs to a
+// user, as opposed to "group".
+const gitLabNamespaceKindUser = "user"
 
 type gitLabClient struct {
 	*gitlab.Client
+	// token is only used for requests outside the GitLab API, such as for
+	// downloading avatars.
+	token           string
 	repositoryFiles gitLabRepoFilesReader
 	branches        gitLabBranchesReader
+	tags            gitLabTagsReader
 	projects        gitLabProjectsReader
+	repositories    gitLabRepositoriesReader
+
+	// keysetUnsupported is set when the GitLab instance has responded that it
+	// does not support keyset pagination, so that following requests use
+	// offset pagination directly.
+	keysetUnsupported bool
+
+	// callTimeout is the longest time a single request to the GitLab API may
+	// take, including retries. Zero means no limit.
+	callTimeout time.Duration
+
+	// blobCache caches fetched files by their blob SHA. Nil means files are
+	// always downloaded.
+	blobCache *blobCache
 }
 
-func getGitLabClientWritesProblem(c *gin.Context, token string, url string) (*gitLabClient, bool) {
+func newGitLabClient(token string, url string) (*gitLabClient, error) {
 	git, err := gitlab.NewClient(token, gitlab.WithBaseURL(url))
+	if err != nil {
+		return nil, err
+	}
+
+	return &gitLabClient{
+		Client:          git,
+		token:           token,
+		repositoryFiles: git.RepositoryFiles,
+		branches:        git.Branches,
+		tags:            git.Tags,
+		projects:        git.Projects,
+		repositories:    git.Repositories,
+	}, nil
+}
+
+// callOptions returns a context for a single request to the GitLab API,
+// limited by the per-call timeout, and the request option that binds the
+// request to it.
+func (client *gitLabClient) callOptions(ctx context.Context) ([]gitlab.RequestOptionFunc, context.CancelFunc) {
+	cancel := context.CancelFunc(func() {})
+	if client.callTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, client.callTimeout)
+	}
+	return []gitlab.RequestOptionFunc{gitlab.WithContext(ctx)}, cancel
+}
+
+func getGitLabClientWritesProblem(c *gin.Context, token string, url string) (*gitLabClient, bool) {
+	client, err := newGitLabClient(token, url)
 	if err != nil {
 		ginutil.WriteInvalidBindError(c, err,
 			"Creating the GitLab client failed because of an invalid URL. Please double check the Upload URL.")
@@ -30,29 +82,169 @@ func getGitLabClientWritesProblem(c *gin.Context, token string, url string) (*gi
 		return nil, false
 	}
 
-	return &gitLabClient{git, git.RepositoryFiles, git.Branches, git.Projects}, true
+	return client, true
+}
+
+// gitLabProjectFilter narrows down which projects are listed when importing a
+// group or a whole GitLab instance. The zero value lists all projects.
+type gitLabProjectFilter struct {
+	// LastActivityAfter only includes projects with activity after this time.
+	LastActivityAfter *time.Time
+	// Membership only includes projects the user is a member of. Only applies
+	// when listing all projects, as group projects are always listed by
+	// membership of the group.
+	Membership bool
+	// Owned only includes projects owned by the user.
+	Owned bool
+	// Starred only includes projects starred by the user.
+	Starred bool
+	// Topic only includes projects with this topic.
+	Topic string
+	// MinAccessLevel only includes projects where the user has at least this
+	// access level. Zero means no limit.
+	MinAccessLevel gitlab.AccessLevelValue
 }
 
-func (client *gitLabClient) listProjects(page int) ([]*gitlab.Project, gitLabPaging, error) {
-	opt := gitlab.ListProjectsOptions{OrderBy: gitlab.String("id")}
-	if page != 0 {
-		opt.Page = page
+// apply removes the projects that do not match the filter. GitLab filters the
+// projects as well, but not all endpoints and versions support all filters.
+func (f gitLabProjectFilter) apply(projects []*gitlab.Project) []*gitlab.Project {
+	if f.LastActivityAfter == nil && f.Topic == "" {
+		return projects
 	}
+	var matching []*gitlab.Project
+	for _, project := range projects {
+		if f.matches(project) {
+			matching = append(matching, project)
+		}
+	}
+	return matching
+}
 
-	projects, resp, err := client.Projects.ListProjects(&opt)
+func (f gitLabProjectFilter) matches(project *gitlab.Project) bool {
+	if f.LastActivityAfter != nil && project.LastActivityAt != nil &&
+		!project.LastActivityAt.After(*f.LastActivityAfter) {
+		return false
+	}
+	if f.Topic != "" && !containsString(project.Topics, f.Topic) && !containsString(project.TagList, f.Topic) {
+		return false
+	}
+	return true
+}
+
+// key returns a file-safe name of the filters that narrow down which projects
+// are listed, or an empty string if there are none. LastActivityAfter is left
+// out, as it changes between syncs of the same projects. The topic is last,
+// as it may contain the separator.
+func (f gitLabProjectFilter) key() string {
+	var parts []string
+	if f.Membership {
+		parts = append(parts, "membership")
+	}
+	if f.Owned {
+		parts = append(parts, "owned")
+	}
+	if f.Starred {
+		parts = append(parts, "starred")
+	}
+	if f.MinAccessLevel != 0 {
+		parts = append(parts, fmt.Sprintf("minaccess-%d", f.MinAccessLevel))
+	}
+	if f.Topic != "" {
+		parts = append(parts, "topic-"+url.PathEscape(f.Topic))
+	}
+	return strings.Join(parts, "-")
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func optionalBool(value bool) *bool {
+	if !value {
+		return nil
+	}
+	return gitlab.Bool(true)
+}
+
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return gitlab.String(value)
+}
+
+func optionalAccessLevel(value gitlab.AccessLevelValue) *gitlab.AccessLevelValue {
+	if value == gitlab.NoPermissions {
+		return nil
+	}
+	return gitlab.AccessLevel(value)
+}
+
+// requestOptions returns the options that adds the filter to a GitLab API
+// request whose options struct lacks the filter fields.
+func (f gitLabProjectFilter) requestOptions() []gitlab.RequestOptionFunc {
+	var options []gitlab.RequestOptionFunc
+	if f.LastActivityAfter != nil {
+		options = append(options, withQueryParam("last_activity_after", f.LastActivityAfter.Format(time.RFC3339)))
+	}
+	if f.Topic != "" {
+		options = append(options, withQueryParam("topic", f.Topic))
+	}
+	return options
+}
+
+func (client *gitLabClient) listProjects(ctx context.Context, filter gitLabProjectFilter, cursor gitLabPageCursor) ([]*gitlab.Project, gitLabPaging, error) {
+	opt := gitlab.ListProjectsOptions{
+		OrderBy:           gitlab.String("id"),
+		Sort:              gitlab.String("asc"),
+		LastActivityAfter: filter.LastActivityAfter,
+		Membership:        optionalBool(filter.Membership),
+		Owned:             optionalBool(filter.Owned),
+		Starred:           optionalBool(filter.Starred),
+		Topic:             optionalString(filter.Topic),
+		MinAccessLevel:    optionalAccessLevel(filter.MinAccessLevel),
+	}
+	opt.Page = cursor.Page
+
+	options, cancel := client.callOptions(ctx)
+	defer cancel()
+	options = append(options, cursor.requestOptions()...)
+	useKeyset := cursor.isFirst() && !client.keysetUnsupported
+	if useKeyset {
+		options = append(options, withKeysetPagination())
+	}
+
+	projects, resp, err := client.projects.ListProjects(&opt, options...)
+	if err != nil && useKeyset && resp != nil &&
+		(resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusMethodNotAllowed) {
+		log.Warn().
+			WithError(err).
+			WithString("status", resp.Status).
+			Message("Keyset pagination not supported, falling back to offset pagination.")
+		client.keysetUnsupported = true
+		return client.listProjects(ctx, filter, cursor)
+	}
 	if err != nil {
 		log.Error().
 			WithError(err).
-			WithInt("page", page).
+			WithInt("page", cursor.Page).
+			WithString("nextQuery", cursor.NextQuery).
 			Message("Failed to list projects.")
 		return nil, mapToPaging(resp), err
 	}
 
-	return projects, mapToPaging(resp), nil
+	return filter.apply(projects), mapToPaging(resp), nil
 }
 
-func (client *gitLabClient) getProject(groupName string, projectName string) (*gitlab.Project, error) {
-	project, resp, err := client.Projects.GetProject(fmt.Sprintf("%v/%v", groupName, projectName), nil, nil)
+func (client *gitLabClient) getProject(ctx context.Context, groupName string, projectName string) (*gitlab.Project, error) {
+	options, cancel := client.callOptions(ctx)
+	project, resp, err := client.Projects.GetProject(fmt.Sprintf("%v/%v", groupName, projectName), nil, options...)
+	cancel()
 	ev := log.Error().
 		WithString("group", groupName).
 		WithString("project", projectName)
@@ -71,7 +263,9 @@ func (client *gitLabClient) getProject(groupName string, projectName string) (*g
 
 	if resp.StatusCode == http.StatusNotFound {
 		ev.Message("Project not found.")
-		projects, _, err := client.Search.Projects(projectName, &gitlab.SearchOptions{})
+		searchOptions, cancelSearch := client.callOptions(ctx)
+		defer cancelSearch()
+		projects, _, err := client.Search.Projects(projectName, &gitlab.SearchOptions{}, searchOptions...)
 		if err != nil {
 			ev.WithError(err).Message("Failed searching by project name as fallback.")
 			return nil, err
@@ -92,84 +286,393 @@ func (client *gitLabClient) getProject(groupName string, projectName string) (*g
 	return project, nil
 }
 
-func (client *gitLabClient) listProjectsFromGroup(groupName string, page int) ([]*gitlab.Project, gitLabPaging, error) {
-	opt := gitlab.ListGroupProjectsOptions{
-		OrderBy: gitlab.String("id"),
+func (client *gitLabClient) getProjectByID(ctx context.Context, projectID int) (*gitlab.Project, error) {
+	options, cancel := client.callOptions(ctx)
+	defer cancel()
+	project, _, err := client.Projects.GetProject(projectID, nil, options...)
+	if err != nil {
+		log.Error().
+			WithError(err).
+			WithInt("gitLabProjectId", projectID).
+			Message("Failed to get project by ID.")
+		return nil, err
 	}
-	if page != 0 {
-		opt.Page = page
+	return project, nil
+}
+
+func (client *gitLabClient) listProjectsFromGroup(ctx context.Context, groupName string, filter gitLabProjectFilter, cursor gitLabPageCursor) ([]*gitlab.Project, gitLabPaging, error) {
+	opt := gitlab.ListGroupProjectsOptions{
+		OrderBy:        gitlab.String("id"),
+		Sort:           gitlab.String("asc"),
+		Owned:          optionalBool(filter.Owned),
+		Starred:        optionalBool(filter.Starred),
+		MinAccessLevel: optionalAccessLevel(filter.MinAccessLevel),
 	}
+	opt.Page = cursor.Page
 
 	log.Debug().
 		WithString("groupName", groupName).
-		WithInt("page", page).
+		WithInt("page", cursor.Page).
+		WithString("nextQuery", cursor.NextQuery).
 		Message("Listing projects for group.")
 
-	projects, resp, err := client.Groups.ListGroupProjects(groupName, &opt, nil)
+	options, cancel := client.callOptions(ctx)
+	defer cancel()
+	options = append(options, filter.requestOptions()...)
+	options = append(options, cursor.requestOptions()...)
+	projects, resp, err := client.Groups.ListGroupProjects(groupName, &opt, options...)
 	if err != nil {
-		log.Error().
+		ev := log.Error().
 			WithError(err).
-			WithString("URL", resp.Request.URL.String()).
-			WithString("status", resp.Status).
 			WithString("group", groupName).
-			WithInt("page", page).
-			Message("Failed to list projects for group.")
+			WithInt("page", cursor.Page).
+			WithString("nextQuery", cursor.NextQuery)
+		if resp != nil {
+			ev = ev.WithString("URL", resp.Request.URL.String()).
+				WithString("status", resp.Status)
+		}
+		ev.Message("Failed to list projects for group.")
 		return nil, mapToPaging(resp), err
 	}
 
 	log.Debug().
 		WithString("groupName", groupName).
-		WithInt("page", page).
+		WithInt("page", cursor.Page).
+		WithString("nextQuery", cursor.NextQuery).
 		Message("Successfully listed projects for group.")
 
-	return projects, mapToPaging(resp), nil
+	return filter.apply(projects), mapToPaging(resp), nil
+}
+
+func (client *gitLabClient) getNamespace(ctx context.Context, fullPath string) (*gitlab.Namespace, error) {
+	options, cancel := client.callOptions(ctx)
+	defer cancel()
+	namespace, _, err := client.Namespaces.GetNamespace(fullPath, options...)
+	if err != nil {
+		log.Error().
+			WithError(err).
+			WithString("namespace", fullPath).
+			Message("Failed to get namespace.")
+		return nil, err
+	}
+	return namespace, nil
 }
 
-func (client *gitLabClient) getBuildDefinitionIfExists(projectID int, defaultBranch string) (string, error) {
-	if defaultBranch == "" {
-		log.Debug().Message("Default branch name cannot be empty.")
-		defaultBranch = REF
+func (client *gitLabClient) listUserProjects(ctx context.Context, userName string, filter gitLabProjectFilter, cursor gitLabPageCursor) ([]*gitlab.Project, gitLabPaging, error) {
+	opt := gitlab.ListProjectsOptions{
+		OrderBy:           gitlab.String("id"),
+		Sort:              gitlab.String("asc"),
+		LastActivityAfter: filter.LastActivityAfter,
+		Owned:             optionalBool(filter.Owned),
+		Starred:           optionalBool(filter.Starred),
+		Topic:             optionalString(filter.Topic),
+		MinAccessLevel:    optionalAccessLevel(filter.MinAccessLevel),
+	}
+	opt.Page = cursor.Page
+
+	log.Debug().
+		WithString("userName", userName).
+		WithInt("page", cursor.Page).
+		WithString("nextQuery", cursor.NextQuery).
+		Message("Listing projects for user.")
+
+	options, cancel := client.callOptions(ctx)
+	defer cancel()
+	options = append(options, cursor.requestOptions()...)
+	projects, resp, err := client.Projects.ListUserProjects(userName, &opt, options...)
+	if err != nil {
+		log.Error().
+			WithError(err).
+			WithString("userName", userName).
+			WithInt("page", cursor.Page).
+			WithString("nextQuery", cursor.NextQuery).
+			Message("Failed to list projects for user.")
+		return nil, mapToPaging(resp), err
 	}
 
-	ref := defaultBranch
-	opts := &gitlab.GetRawFileOptions{Ref: &ref}
-	bytes, resp, err := client.repositoryFiles.GetRawFile(projectID, BuildDefinitionFileName, opts)
+	return filter.apply(projects), mapToPaging(resp), nil
+}
+
+// buildDefinitionFile is a build definition file fetched from a repository.
+// The zero value means that no build definition file was found.
+type buildDefinitionFile struct {
+	Path    string
+	Content string
+	// Diagnostics are the problems found when validating the content.
+	Diagnostics []BuildDefinitionDiagnostic
+	// Rejected is set when the content is invalid and is not to be stored.
+	Rejected bool
+	// Generated is set when no file was found and the content was generated
+	// from the files in the repository instead.
+	Generated bool
+	// expansion is set when the includes in the content have been merged
+	// into it, and is used to lint the content.
+	expansion *buildDefinitionExpansion
+}
+
+// lint lints the content, at the lines of the included files for the parts
+// that were included.
+func (f buildDefinitionFile) lint() []BuildDefinitionDiagnostic {
+	if f.expansion != nil {
+		return f.expansion.lint()
+	}
+	return lintBuildDefinition(f.Content)
+}
+
+// getBuildDefinitionIfExists returns the first of the files at the given paths
+// that exists in the repository. An empty ref means the project's default
+// branch.
+func (client *gitLabClient) getBuildDefinitionIfExists(ctx context.Context, projectID int, ref string, paths []string) (buildDefinitionFile, error) {
+	for _, path := range paths {
+		content, ok, err := client.getRawFileIfExists(ctx, projectID, ref, path)
+		if err != nil {
+			return buildDefinitionFile{}, err
+		}
+		if ok {
+			return buildDefinitionFile{Path: path, Content: content}, nil
+		}
+	}
+	log.Debug().
+		WithInt("projectId", projectID).
+		WithString("ref", ref).
+		WithStringf("paths", "%q", paths).
+		Message("No build definition file found.")
+	return buildDefinitionFile{}, nil
+}
+
+// getFileIfExists returns the content of a file in a project given by its full
+// path, or false if there is no such file. An empty ref means the project's
+// default branch.
+func (client *gitLabClient) getFileIfExists(ctx context.Context, project string, ref, path string) (string, bool, error) {
+	return client.getRawFileIfExists(ctx, project, ref, path)
+}
+
+// getRawFileIfExists fetches a file from a project given by its ID or full
+// path. An empty ref means the project's default branch.
+func (client *gitLabClient) getRawFileIfExists(ctx context.Context, pid any, ref, path string) (string, bool, error) {
+	// Fetching the metadata requires a ref, so the default branch is always
+	// downloaded.
+	if client.blobCache != nil && ref != "" {
+		return client.getCachedFileIfExists(ctx, pid, ref, path)
+	}
+	opts := &gitlab.GetRawFileOptions{Ref: optionalString(ref)}
+	options, cancel := client.callOptions(ctx)
+	defer cancel()
+	bytes, resp, err := client.repositoryFiles.GetRawFile(pid, path, opts, options...)
 	if resp == nil {
-		return "", err
+		return "", false, err
 	}
 
 	if resp.StatusCode == http.StatusNotFound {
-		return "", nil
+		return "", false, nil
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		log.Error().
 			WithError(err).
-			WithInt("projectId", projectID).
-			WithString("branch", defaultBranch).
+			WithStringf("project", "%v", pid).
+			WithString("ref", ref).
 			WithString("status", resp.Status).
-			Messagef("Unable to get %s file.", BuildDefinitionFileName)
-		return "", err
+			Messagef("Unable to get %s file.", path)
+		return "", false, err
 	}
 
-	return string(bytes), err
+	return string(bytes), err == nil, err
 }
 
-func (client *gitLabClient) getBranches(gitLabProjectID int, page int) ([]*gitlab.Branch, gitLabPaging, error) {
-	opt := gitlab.ListBranchesOptions{}
-	if page != 0 {
-		opt.Page = page
+// getCachedFileIfExists fetches only the metadata of a file, and downloads
+// the file by its blob SHA if it is not already cached.
+func (client *gitLabClient) getCachedFileIfExists(ctx context.Context, pid any, ref, path string) (string, bool, error) {
+	opts := &gitlab.GetFileMetaDataOptions{Ref: gitlab.String(ref)}
+	metaDataOptions, cancelMetaData := client.callOptions(ctx)
+	file, resp, err := client.repositoryFiles.GetFileMetaData(pid, path, opts, metaDataOptions...)
+	cancelMetaData()
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	}
+	if err != nil {
+		log.Error().
+			WithError(err).
+			WithStringf("project", "%v", pid).
+			WithString("ref", ref).
+			Messagef("Unable to get metadata of %s file.", path)
+		return "", false, err
+	}
+
+	content, ok, err := client.blobCache.load(file.BlobID)
+	if err != nil {
+		log.Warn().
+			WithError(err).
+			WithString("blobId", file.BlobID).
+			Message("Failed to load cached file, downloading it instead.")
+	}
+	if ok {
+		log.Debug().
+			WithStringf("project", "%v", pid).
+			WithString("ref", ref).
+			WithString("path", path).
+			WithString("blobId", file.BlobID).
+			Message("Using cached file.")
+		return content, true, nil
+	}
+
+	// The download gets a timeout of its own, as it is a separate request
+	// and may take longer than fetching the metadata did.
+	blobOptions, cancelBlob := client.callOptions(ctx)
+	defer cancelBlob()
+	bytes, _, err := client.repositories.RawBlobContent(pid, file.BlobID, blobOptions...)
+	if err != nil {
+		log.Error().
+			WithError(err).
+			WithStringf("project", "%v", pid).
+			WithString("ref", ref).
+			WithString("blobId", file.BlobID).
+			Messagef("Unable to get %s file.", path)
+		return "", false, err
+	}
+	if err := client.blobCache.save(file.BlobID, string(bytes)); err != nil {
+		log.Warn().
+			WithError(err).
+			WithString("blobId", file.BlobID).
+			Message("Failed to cache file.")
+	}
+	return string(bytes), true, nil
+}
+
+// listTree returns the files and directories directly in the given directory
+// of the repository, or in its root if the path is empty. Only the first 100
+// entries are returned, which is enough for detecting well-known files. An
+// empty repository has no entries.
+func (client *gitLabClient) listTree(ctx context.Context, projectID int, ref, path string) ([]*gitlab.TreeNode, error) {
+	opts := &gitlab.ListTreeOptions{
+		ListOptions: gitlab.ListOptions{PerPage: 100},
+		Ref:         optionalString(ref),
+		Path:        optionalString(path),
+	}
+	options, cancel := client.callOptions(ctx)
+	defer cancel()
+	nodes, resp, err := client.repositories.ListTree(projectID, opts, options...)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		log.Error().
+			WithError(err).
+			WithInt("projectId", projectID).
+			WithString("ref", ref).
+			WithString("path", path).
+			Message("Failed to list repository tree.")
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// errAvatarTooLarge is returned when an avatar is larger than the configured
+// limit.
+var errAvatarTooLarge = errors.New("avatar is too large")
+
+// avatarContentTypes are the types of images that are served as avatars.
+// Only raster images are allowed, as vector images such as SVG may contain
+// scripts.
+var avatarContentTypes = map[string]bool{
+	"image/png":                true,
+	"image/jpeg":               true,
+	"image/gif":                true,
+	"image/webp":               true,
+	"image/bmp":                true,
+	"image/x-icon":             true,
+	"image/vnd.microsoft.icon": true,
+}
+
+// avatar is an image downloaded from GitLab.
+type avatar struct {
+	ContentType string `json:"contentType"`
+	Content     []byte `json:"content"`
+}
+
+// getAvatar downloads an avatar that is at most maxSize bytes. The token is
+// only sent if the avatar is on the GitLab instance itself, so that it is
+// not leaked to other hosts such as Gravatar.
+func (client *gitLabClient) getAvatar(ctx context.Context, avatarURL string, maxSize int64) (avatar, error) {
+	if client.callTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.callTimeout)
+		defer cancel()
+	}
+	u, err := url.Parse(avatarURL)
+	if err != nil {
+		return avatar{}, fmt.Errorf("parse avatar URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return avatar{}, fmt.Errorf("avatar URL must use http or https: %q", avatarURL)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return avatar{}, err
+	}
+	if u.Host == client.BaseURL().Host {
+		req.Header.Set("PRIVATE-TOKEN", client.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return avatar{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return avatar{}, fmt.Errorf("get avatar %q: %s", avatarURL, resp.Status)
+	}
+	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !avatarContentTypes[contentType] {
+		return avatar{}, fmt.Errorf("get avatar %q: not a raster image: %q", avatarURL, resp.Header.Get("Content-Type"))
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return avatar{}, err
+	}
+	if int64(len(content)) > maxSize {
+		return avatar{}, fmt.Errorf("%w: larger than %d bytes", errAvatarTooLarge, maxSize)
 	}
+	return avatar{ContentType: contentType, Content: content}, nil
+}
+
+func (client *gitLabClient) getBranches(ctx context.Context, gitLabProjectID int, cursor gitLabPageCursor) ([]*gitlab.Branch, gitLabPaging, error) {
+	opt := gitlab.ListBranchesOptions{}
+	opt.Page = cursor.Page
 
-	branches, resp, err := client.branches.ListBranches(gitLabProjectID, &opt)
+	options, cancel := client.callOptions(ctx)
+	defer cancel()
+	options = append(options, cursor.requestOptions()...)
+	branches, resp, err := client.branches.ListBranches(gitLabProjectID, &opt, options...)
 	if err != nil {
 		log.Error().
 			WithError(err).
 			WithInt("gitLabProjectId", gitLabProjectID).
-			WithInt("page", page).
+			WithInt("page", cursor.Page).
+			WithString("nextQuery", cursor.NextQuery).
 			Message("Failed to list branches.")
 		return nil, mapToPaging(resp), err
 	}
 
 	return branches, mapToPaging(resp), nil
 }
+
+func (client *gitLabClient) getTags(ctx context.Context, gitLabProjectID int, cursor gitLabPageCursor) ([]*gitlab.Tag, gitLabPaging, error) {
+	opt := gitlab.ListTagsOptions{}
+	opt.Page = cursor.Page
+
+	options, cancel := client.callOptions(ctx)
+	defer cancel()
+	options = append(options, cursor.requestOptions()...)
+	tags, resp, err := client.tags.ListTags(gitLabProjectID, &opt, options...)
+	if err != nil {
+		log.Error().
+			WithError(err).
+			WithInt("gitLabProjectId", gitLabProjectID).
+			WithInt("page", cursor.Page).
+			WithString("nextQuery", cursor.NextQuery).
+			Message("Failed to list tags.")
+		return nil, mapToPaging(resp), err
+	}
+
+	return tags, mapToPaging(resp), nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+
 	"github.com/stretchr/testify/mock"
 	"github.com/xanzy/go-gitlab"
 )
@@ -9,27 +11,71 @@ type gitLabClientMock struct {
 	mock.Mock
 }
 
-func (m *gitLabClientMock) listProjects(page int) ([]*gitlab.Project, gitLabPaging, error) {
-	args := m.Called(page)
+func (m *gitLabClientMock) listProjects(_ context.Context, filter gitLabProjectFilter, cursor gitLabPageCursor) ([]*gitlab.Project, gitLabPaging, error) {
+	args := m.Called(filter, cursor)
+	return args.Get(0).([]*gitlab.Project), args.Get(1).(gitLabPaging), args.Error(2)
+}
+
+func (m *gitLabClientMock) listProjectsFromGroup(_ context.Context, groupName string, filter gitLabProjectFilter, cursor gitLabPageCursor) ([]*gitlab.Project, gitLabPaging, error) {
+	args := m.Called(groupName, filter, cursor)
 	return args.Get(0).([]*gitlab.Project), args.Get(1).(gitLabPaging), args.Error(2)
 }
 
-func (m *gitLabClientMock) listProjectsFromGroup(groupName string, page int) ([]*gitlab.Project, gitLabPaging, error) {
-	args := m.Called(groupName, page)
+func (m *gitLabClientMock) listUserProjects(_ context.Context, userName string, filter gitLabProjectFilter, cursor gitLabPageCursor) ([]*gitlab.Project, gitLabPaging, error) {
+	args := m.Called(userName, filter, cursor)
 	return args.Get(0).([]*gitlab.Project), args.Get(1).(gitLabPaging), args.Error(2)
 }
 
-func (m *gitLabClientMock) getProject(groupName string, projectName string) (*gitlab.Project, error) {
+func (m *gitLabClientMock) getNamespace(_ context.Context, fullPath string) (*gitlab.Namespace, error) {
+	args := m.Called(fullPath)
+	return args.Get(0).(*gitlab.Namespace), args.Error(1)
+}
+
+func (m *gitLabClientMock) getProject(_ context.Context, groupName string, projectName string) (*gitlab.Project, error) {
 	args := m.Called(groupName, projectName)
 	return args.Get(0).(*gitlab.Project), args.Error(1)
 }
 
-func (m *gitLabClientMock) getBuildDefinitionIfExists(projectID int, defaultBranch string) (string, error) {
-	args := m.Called(projectID, defaultBranch)
-	return args.String(0), args.Error(1)
+func (m *gitLabClientMock) getProjectByID(_ context.Context, projectID int) (*gitlab.Project, error) {
+	args := m.Called(projectID)
+	return args.Get(0).(*gitlab.Project), args.Error(1)
+}
+
+func (m *gitLabClientMock) getBuildDefinitionIfExists(_ context.Context, projectID int, ref string, paths []string) (buildDefinitionFile, error) {
+	args := m.Called(projectID, ref, paths)
+	return args.Get(0).(buildDefinitionFile), args.Error(1)
+}
+
+func (m *gitLabClientMock) getFileIfExists(_ context.Context, project string, ref, path string) (string, bool, error) {
+	args := m.Called(project, ref, path)
+	return args.String(0), args.Bool(1), args.Error(2)
 }
 
-func (m *gitLabClientMock) getBranches(gitLabProjectID int, page int) ([]*gitlab.Branch, gitLabPaging, error) {
-	args := m.Called(gitLabProjectID, page)
+func (m *gitLabClientMock) getBranches(_ context.Context, gitLabProjectID int, cursor gitLabPageCursor) ([]*gitlab.Branch, gitLabPaging, error) {
+	args := m.Called(gitLabProjectID, cursor)
 	return args.Get(0).([]*gitlab.Branch), args.Get(1).(gitLabPaging), args.Error(2)
 }
+
+func (m *gitLabClientMock) getTags(_ context.Context, gitLabProjectID int, cursor gitLabPageCursor) ([]*gitlab.Tag, gitLabPaging, error) {
+	args := m.Called(gitLabProjectID, cursor)
+	return args.Get(0).([]*gitlab.Tag), args.Get(1).(gitLabPaging), args.Error(2)
+}
+
+func (m *gitLabClientMock) getAvatar(_ context.Context, avatarURL string, maxSize int64) (avatar, error) {
+	args := m.Called(avatarURL, maxSize)
+	return args.Get(0).(avatar), args.Error(1)
+}
+
+func (m *gitLabClientMock) listTree(_ context.Context, projectID int, ref, path string) ([]*gitlab.TreeNode, error) {
+	args := m.Called(projectID, ref, path)
+	return args.Get(0).([]*gitlab.TreeNode), args.Error(1)
+}
+
+type gitLabProjectsReaderMock struct {
+	mock.Mock
+}
+
+func (m *gitLabProjectsReaderMock) ListProjects(opt *gitlab.ListProjectsOptions, options ...gitlab.RequestOptionFunc) ([]*gitlab.Project, *gitlab.Response, error) {
+	args := m.Called(opt, options)
+	return args.Get(0).([]*gitlab.Project), args.Get(1).(*gitlab.Response), args.Error(2)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBuildDefinitionIfExistsTriesPathsInOrder(t *testing.T) {
+	var gotPaths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "/api/v4/projects/84/repository/files/"
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			return
+		}
+		path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, prefix), "/raw")
+		gotPaths = append(gotPaths, path)
+		if path != ".wharf-ci.yaml" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("myStage:\n"))
+	}))
+	defer server.Close()
+
+	client, err := newGitLabClient("token", server.URL)
+	require.NoError(t, err)
+
+	buildDef, err := client.getBuildDefinitionIfExists(context.Background(), 84, "main",
+		[]string{".wharf-ci.yml", ".wharf-ci.yaml", ".wharf/ci.yml"})
+	require.NoError(t, err)
+	assert.Equal(t, buildDefinitionFile{Path: ".wharf-ci.yaml", Content: "myStage:\n"}, buildDef)
+	assert.Equal(t, []string{".wharf-ci.yml", ".wharf-ci.yaml"}, gotPaths)
+}
+
+func TestGetCachedFileIfExistsTimesOutEachRequest(t *testing.T) {
+	const delay = 120 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/projects/84/repository/files/.wharf-ci.yml":
+			time.Sleep(delay)
+			w.Header().Set("X-Gitlab-Blob-Id", "abc123")
+		case "/api/v4/projects/84/repository/blobs/abc123/raw":
+			time.Sleep(delay)
+			w.Write([]byte("myStage:\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := newGitLabClient("token", server.URL)
+	require.NoError(t, err)
+	// Both requests together take longer than the timeout, but each one
+	// alone does not.
+	client.callTimeout = 200 * time.Millisecond
+
+	content, ok, err := client.getCachedFileIfExists(context.Background(), 84, "main", ".wharf-ci.yml")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "myStage:\n", content)
+}
@@ -1,11 +1,69 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"net/url"
+	"strings"
 
+	"github.com/hashicorp/go-retryablehttp"
 	"github.com/xanzy/go-gitlab"
 )
 
+// gitLabPageCursor points out which page of a collection to fetch. The zero
+// value points at the first page.
+//
+// GitLab responds with a "next" Link header for both offset and keyset
+// pagination, and it is followed whenever it is present. The page number is
+// only used as a fallback for when the header is missing.
+type gitLabPageCursor struct {
+	// Page is the page number to fetch, when using offset pagination.
+	Page int `json:"page,omitempty"`
+	// NextQuery is the query string from the "next" Link header of the
+	// previous page, which includes the page number or keyset to fetch.
+	NextQuery string `json:"nextQuery,omitempty"`
+}
+
+func (c gitLabPageCursor) isFirst() bool {
+	return c == gitLabPageCursor{}
+}
+
+// requestOptions returns the options that makes a GitLab API request fetch
+// the page the cursor points at.
+func (c gitLabPageCursor) requestOptions() []gitlab.RequestOptionFunc {
+	if c.NextQuery == "" {
+		return nil
+	}
+	return []gitlab.RequestOptionFunc{withRawQuery(c.NextQuery)}
+}
+
+// withRawQuery replaces the whole query string of the request. The query from
+// a "next" Link header already contains all the filters and sorting from the
+// first request, so nothing is merged.
+func withRawQuery(rawQuery string) gitlab.RequestOptionFunc {
+	return func(req *retryablehttp.Request) error {
+		req.URL.RawQuery = rawQuery
+		return nil
+	}
+}
+
+// withQueryParam sets a query parameter on the request.
+func withQueryParam(key, value string) gitlab.RequestOptionFunc {
+	return func(req *retryablehttp.Request) error {
+		q := req.URL.Query()
+		q.Set(key, value)
+		req.URL.RawQuery = q.Encode()
+		return nil
+	}
+}
+
+// withKeysetPagination makes a GitLab API request use keyset pagination
+// instead of offset pagination. GitLab only supports this on some endpoints,
+// such as when listing all projects ordered by ID, and responds with an error
+// on the others.
+func withKeysetPagination() gitlab.RequestOptionFunc {
+	return withQueryParam("pagination", "keyset")
+}
+
 type gitLabPaging struct {
 	totalItems   int
 	totalPages   int
@@ -13,9 +71,13 @@ type gitLabPaging struct {
 	currentPage  int
 	nextPage     int
 	previousPage int
+	nextQuery    string
 }
 
 func mapToPaging(resp *gitlab.Response) gitLabPaging {
+	if resp == nil {
+		return gitLabPaging{}
+	}
 	return gitLabPaging{
 		totalItems:   resp.TotalItems,
 		totalPages:   resp.TotalPages,
@@ -23,13 +85,57 @@ func mapToPaging(resp *gitlab.Response) gitLabPaging {
 		currentPage:  resp.CurrentPage,
 		nextPage:     resp.NextPage,
 		previousPage: resp.PreviousPage,
+		nextQuery:    parseNextLinkQuery(resp.Header.Get("Link")),
 	}
 }
 
-func (p gitLabPaging) next() int {
-	if p.currentPage >= p.totalPages {
-		log.Debug().WithInt("page", p.totalPages).Message("Found end of collection.")
-		return -1
+// parseNextLinkQuery returns the query string of the URL in a Link header
+// that has rel="next", or an empty string if there is none. The header holds
+// a comma-separated list of links, such as
+// <https://gitlab.example.com/api/v4/projects?id_after=42>; rel="next".
+func parseNextLinkQuery(linkHeader string) string {
+	for _, link := range strings.Split(linkHeader, ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+		isNext := false
+		for _, param := range parts[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				isNext = true
+				break
+			}
+		}
+		if !isNext {
+			continue
+		}
+		u, err := url.Parse(strings.Trim(strings.TrimSpace(parts[0]), "<>"))
+		if err != nil {
+			log.Warn().WithError(err).WithString("link", link).Message("Failed to parse next page Link header.")
+			return ""
+		}
+		return u.RawQuery
+	}
+	return ""
+}
+
+// next returns the cursor for the next page, or false if this was the last
+// page.
+//
+// GitLab omits the total number of pages for collections of more than 10,000
+// items, so the total is only relied on when it is known.
+func (p gitLabPaging) next() (gitLabPageCursor, bool) {
+	if p.nextQuery != "" {
+		log.Debug().
+			WithInt("currentPage", p.currentPage).
+			WithString("nextQuery", p.nextQuery).
+			Message("Fetching next page.")
+		return gitLabPageCursor{NextQuery: p.nextQuery}, true
+	}
+
+	if p.nextPage == 0 || (p.totalPages > 0 && p.currentPage >= p.totalPages) {
+		log.Debug().WithInt("page", p.currentPage).Message("Found end of collection.")
+		return gitLabPageCursor{}, false
 	}
 
 	log.Debug().
@@ -37,32 +143,72 @@ func (p gitLabPaging) next() int {
 		WithInt("nextPage", p.nextPage).
 		WithInt("totalPages", p.totalPages).
 		Message("Fetching next page.")
-	return p.nextPage
+	return gitLabPageCursor{Page: p.nextPage}, true
 }
 
-type getProjects func(int) ([]*gitlab.Project, gitLabPaging, error)
-type postProjects func([]*gitlab.Project) string
+type getProjects func(gitLabPageCursor) ([]*gitlab.Project, gitLabPaging, error)
+type postProjects func([]*gitlab.Project) []importFailure
+type saveCheckpoint func(importCheckpoint)
 
-func importPaginatedProjects(get getProjects, post postProjects) error {
-	errMessage := ""
-	page := 0
-	for page >= 0 {
-		projects, paging, err := get(page)
+// importPaginatedProjects imports all pages of projects, starting from the page
+// in the checkpoint and skipping projects that were already handled. The
+// checkpoint is updated and saved after each page, and an event is emitted to
+// the job for each page fetched.
+//
+// If the context is canceled in the middle of a page, then the checkpoint is
+// not saved for that page, so that a resumed import starts over from it. Once
+// the last page is handled, the checkpoint only keeps the failed projects, so
+// that a resumed import retries them and then lists all projects again.
+func importPaginatedProjects(ctx context.Context, get getProjects, post postProjects, job *importJob, checkpoint *importCheckpoint, save saveCheckpoint) error {
+	cursor, hasMore := checkpoint.Cursor, true
+	for hasMore {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		projects, paging, err := get(cursor)
 		if err != nil {
 			log.Error().WithError(err).Message("Failed to get projects.")
 			return err
 		}
+		job.emit(ImportEvent{
+			Type:  importEventPageFetched,
+			Page:  paging.currentPage,
+			Count: len(projects),
+		})
 
+		projects = skipHandledProjects(projects, checkpoint.LastProjectID)
 		if len(projects) > 0 {
-			errMessage += post(projects)
+			failed := post(projects)
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			checkpoint.Failed = append(checkpoint.Failed, failed...)
+			for _, project := range projects {
+				if project.ID > checkpoint.LastProjectID {
+					checkpoint.LastProjectID = project.ID
+				}
+			}
 		}
+		checkpoint.Cursor = cursor
+		save(*checkpoint)
 
-		page = paging.next()
+		cursor, hasMore = paging.next()
 	}
 
-	if errMessage != "" {
-		return fmt.Errorf(errMessage)
-	}
+	*checkpoint = importCheckpoint{Failed: checkpoint.Failed}
+	save(*checkpoint)
+	return importFailuresError(checkpoint.Failed)
+}
 
-	return nil
+func skipHandledProjects(projects []*gitlab.Project, lastProjectID int) []*gitlab.Project {
+	if lastProjectID == 0 {
+		return projects
+	}
+	var unhandled []*gitlab.Project
+	for _, project := range projects {
+		if project.ID > lastProjectID {
+			unhandled = append(unhandled, project)
+		}
+	}
+	return unhandled
 }
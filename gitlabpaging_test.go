@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestParseNextLinkQuery(t *testing.T) {
+	testCases := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{
+			name:   "empty",
+			header: "",
+			want:   "",
+		},
+		{
+			name:   "keyset",
+			header: `<https://gitlab.example.com/api/v4/projects?id_after=42&order_by=id&pagination=keyset&sort=asc>; rel="next"`,
+			want:   "id_after=42&order_by=id&pagination=keyset&sort=asc",
+		},
+		{
+			name: "offset with first and last",
+			header: `<https://gitlab.example.com/api/v4/projects?page=1&per_page=20>; rel="prev", ` +
+				`<https://gitlab.example.com/api/v4/projects?page=3&per_page=20>; rel="next", ` +
+				`<https://gitlab.example.com/api/v4/projects?page=1&per_page=20>; rel="first"`,
+			want: "page=3&per_page=20",
+		},
+		{
+			name:   "no next",
+			header: `<https://gitlab.example.com/api/v4/projects?page=1&per_page=20>; rel="first"`,
+			want:   "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, parseNextLinkQuery(tc.header))
+		})
+	}
+}
+
+func TestGitLabPagingNext(t *testing.T) {
+	testCases := []struct {
+		name       string
+		paging     gitLabPaging
+		wantCursor gitLabPageCursor
+		wantMore   bool
+	}{
+		{
+			name:       "follows next link",
+			paging:     gitLabPaging{currentPage: 1, nextPage: 2, totalPages: 5, nextQuery: "page=2"},
+			wantCursor: gitLabPageCursor{NextQuery: "page=2"},
+			wantMore:   true,
+		},
+		{
+			name:       "next page without link",
+			paging:     gitLabPaging{currentPage: 1, nextPage: 2, totalPages: 5},
+			wantCursor: gitLabPageCursor{Page: 2},
+			wantMore:   true,
+		},
+		{
+			name:       "next page when total pages is omitted",
+			paging:     gitLabPaging{currentPage: 1, nextPage: 2, totalPages: 0},
+			wantCursor: gitLabPageCursor{Page: 2},
+			wantMore:   true,
+		},
+		{
+			name:     "last page",
+			paging:   gitLabPaging{currentPage: 5, nextPage: 0, totalPages: 5},
+			wantMore: false,
+		},
+		{
+			name:     "last page when total pages is omitted",
+			paging:   gitLabPaging{currentPage: 600, nextPage: 0, totalPages: 0},
+			wantMore: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gotCursor, gotMore := tc.paging.next()
+			assert.Equal(t, tc.wantMore, gotMore)
+			assert.Equal(t, tc.wantCursor, gotCursor)
+		})
+	}
+}
+
+func newGitLabResponse(statusCode int, linkHeader string) *gitlab.Response {
+	resp := &http.Response{StatusCode: statusCode, Status: http.StatusText(statusCode), Header: http.Header{}}
+	if linkHeader != "" {
+		resp.Header.Set("Link", linkHeader)
+	}
+	return &gitlab.Response{Response: resp}
+}
+
+// hasQueryParam matches request options that set the query parameter to the
+// value when applied to a request.
+func hasQueryParam(key, value string) any {
+	return mock.MatchedBy(func(options []gitlab.RequestOptionFunc) bool {
+		req, err := retryablehttp.NewRequest(http.MethodGet, "https://gitlab.example.com/api/v4/projects", nil)
+		if err != nil {
+			return false
+		}
+		for _, opt := range options {
+			if err := opt(req); err != nil {
+				return false
+			}
+		}
+		return req.URL.Query().Get(key) == value
+	})
+}
+
+func TestListProjectsUsesKeysetPagination(t *testing.T) {
+	projectsReader := &gitLabProjectsReaderMock{}
+	projectsReader.
+		On("ListProjects", mock.Anything, hasQueryParam("pagination", "keyset")).
+		Return([]*gitlab.Project{{ID: 1}},
+			newGitLabResponse(http.StatusOK, `<https://gitlab.example.com/api/v4/projects?id_after=1&pagination=keyset>; rel="next"`),
+			nil).
+		Once()
+	client := &gitLabClient{projects: projectsReader}
+
+	projects, paging, err := client.listProjects(context.Background(), gitLabProjectFilter{}, gitLabPageCursor{})
+	require.NoError(t, err)
+	assert.Len(t, projects, 1)
+	assert.False(t, client.keysetUnsupported)
+	projectsReader.AssertExpectations(t)
+
+	cursor, hasMore := paging.next()
+	assert.True(t, hasMore)
+	assert.Equal(t, gitLabPageCursor{NextQuery: "id_after=1&pagination=keyset"}, cursor)
+}
+
+func TestListProjectsFallsBackToOffsetPaginationWhenUnsupported(t *testing.T) {
+	for _, statusCode := range []int{http.StatusBadRequest, http.StatusMethodNotAllowed} {
+		t.Run(http.StatusText(statusCode), func(t *testing.T) {
+			projectsReader := &gitLabProjectsReaderMock{}
+			projectsReader.
+				On("ListProjects", mock.Anything, hasQueryParam("pagination", "keyset")).
+				Return([]*gitlab.Project(nil), newGitLabResponse(statusCode, ""), errors.New("keyset not supported")).
+				Once()
+			projectsReader.
+				On("ListProjects", mock.Anything, hasQueryParam("pagination", "")).
+				Return([]*gitlab.Project{{ID: 1}}, newGitLabResponse(http.StatusOK, ""), nil).
+				Twice()
+			client := &gitLabClient{projects: projectsReader}
+
+			projects, _, err := client.listProjects(context.Background(), gitLabProjectFilter{}, gitLabPageCursor{})
+			require.NoError(t, err)
+			assert.Len(t, projects, 1)
+			assert.True(t, client.keysetUnsupported)
+
+			_, _, err = client.listProjects(context.Background(), gitLabProjectFilter{}, gitLabPageCursor{})
+			require.NoError(t, err)
+			projectsReader.AssertExpectations(t)
+		})
+	}
+}
+
+func TestListProjectsDoesNotFallBackOnOtherErrors(t *testing.T) {
+	projectsReader := &gitLabProjectsReaderMock{}
+	projectsReader.
+		On("ListProjects", mock.Anything, hasQueryParam("pagination", "keyset")).
+		Return([]*gitlab.Project(nil), newGitLabResponse(http.StatusInternalServerError, ""), errors.New("internal error")).
+		Once()
+	client := &gitLabClient{projects: projectsReader}
+
+	_, _, err := client.listProjects(context.Background(), gitLabProjectFilter{}, gitLabPageCursor{})
+	assert.Error(t, err)
+	assert.False(t, client.keysetUnsupported)
+	projectsReader.AssertExpectations(t)
+}
+
+func TestListProjectsFallsBackToOffsetPagination(t *testing.T) {
+	var gotQueries []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/projects" {
+			return
+		}
+		gotQueries = append(gotQueries, r.URL.Query())
+		if r.URL.Query().Get("pagination") == "keyset" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("X-Page", "1")
+		w.Write([]byte(`[{"id":1}]`))
+	}))
+	defer server.Close()
+
+	git, err := gitlab.NewClient("token", gitlab.WithBaseURL(server.URL))
+	require.NoError(t, err)
+	client := &gitLabClient{Client: git, projects: git.Projects}
+
+	projects, paging, err := client.listProjects(context.Background(), gitLabProjectFilter{}, gitLabPageCursor{})
+	require.NoError(t, err)
+	assert.Len(t, projects, 1)
+	assert.True(t, client.keysetUnsupported)
+	require.Len(t, gotQueries, 2)
+	assert.Equal(t, "keyset", gotQueries[0].Get("pagination"))
+	assert.Equal(t, "", gotQueries[1].Get("pagination"))
+
+	_, hasMore := paging.next()
+	assert.False(t, hasMore)
+}
+
+func TestListProjectsCallTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/projects" {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	git, err := gitlab.NewClient("token", gitlab.WithBaseURL(server.URL))
+	require.NoError(t, err)
+	client := &gitLabClient{Client: git, projects: git.Projects, callTimeout: 10 * time.Millisecond}
+
+	_, _, err = client.listProjects(context.Background(), gitLabProjectFilter{}, gitLabPageCursor{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// Protocols of the Git URL stored on projects in Wharf, as set by the
+// import.providers[].gitUrlProtocol config.
+const (
+	gitURLProtocolSSH   = "ssh"
+	gitURLProtocolHTTPS = "https"
+)
+
+// gitURLMapping chooses the Git URL of a project that is stored in Wharf.
+// The zero value uses the SSH URL as reported by GitLab.
+type gitURLMapping struct {
+	protocol string
+	host     string
+}
+
+// newGitURLMapping returns the Git URL settings of the provider, or the
+// defaults if the provider has none.
+func newGitURLMapping(config ImportConfig, providerID uint) gitURLMapping {
+	for _, provider := range config.Providers {
+		if provider.ProviderID == providerID {
+			return gitURLMapping{provider.GitURLProtocol, provider.GitURLHost}
+		}
+	}
+	return gitURLMapping{}
+}
+
+func (g gitURLMapping) mapGitURL(proj gitlab.Project) string {
+	gitURL := proj.SSHURLToRepo
+	if g.protocol == gitURLProtocolHTTPS {
+		gitURL = proj.HTTPURLToRepo
+	}
+	if g.host == "" || gitURL == "" {
+		return gitURL
+	}
+	rewritten, err := rewriteGitURLHost(gitURL, g.host)
+	if err != nil {
+		log.Warn().
+			WithError(err).
+			WithString("gitUrl", gitURL).
+			WithString("host", g.host).
+			Message("Failed to rewrite host of Git URL, using it as-is.")
+		return gitURL
+	}
+	return rewritten
+}
+
+// rewriteGitURLHost replaces the host, and the port if the new host has one,
+// of either a URL such as "https://gitlab.local/group/project.git" or an
+// SCP-like SSH address such as "git@gitlab.local:group/project.git". SCP-like
+// addresses cannot have a port, so they are turned into "ssh://" URLs if the
+// new host has one.
+func rewriteGitURLHost(gitURL, host string) (string, error) {
+	if strings.Contains(gitURL, "://") {
+		u, err := url.Parse(gitURL)
+		if err != nil {
+			return "", err
+		}
+		if !strings.Contains(host, ":") && u.Port() != "" {
+			host += ":" + u.Port()
+		}
+		u.Host = host
+		return u.String(), nil
+	}
+
+	userAndHost, path, ok := strings.Cut(gitURL, ":")
+	if !ok {
+		return "", fmt.Errorf("not a URL nor an SCP-like address: %q", gitURL)
+	}
+	user, _, hasUser := strings.Cut(userAndHost, "@")
+	if !hasUser {
+		user = ""
+	}
+	if strings.Contains(host, ":") {
+		u := url.URL{Scheme: gitURLProtocolSSH, Host: host, Path: "/" + strings.TrimPrefix(path, "/")}
+		if user != "" {
+			u.User = url.User(user)
+		}
+		return u.String(), nil
+	}
+	if user != "" {
+		return user + "@" + host + ":" + path, nil
+	}
+	return host + ":" + path, nil
+}
+
+// gitURLPath returns the path of the repository in either a URL such as
+// "https://gitlab.local/group/project.git" or an SCP-like SSH address such as
+// "git@gitlab.local:group/project.git", without the ".git" suffix, or false
+// if there is no path.
+func gitURLPath(gitURL string) (string, bool) {
+	var path string
+	if strings.Contains(gitURL, "://") {
+		u, err := url.Parse(gitURL)
+		if err != nil {
+			return "", false
+		}
+		path = u.Path
+	} else {
+		var ok bool
+		if _, path, ok = strings.Cut(gitURL, ":"); !ok {
+			return "", false
+		}
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	return path, path != ""
+}
+
+func validateGitURLProtocol(protocol string) error {
+	switch protocol {
+	case "", gitURLProtocolSSH, gitURLProtocolHTTPS:
+		return nil
+	default:
+		return fmt.Errorf("invalid gitUrlProtocol %q, must be one of: %s, %s",
+			protocol, gitURLProtocolSSH, gitURLProtocolHTTPS)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/request"
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/response"
+	"github.com/iver-wharf/wharf-provider-gitlab/testdoubles"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestMapGitURL(t *testing.T) {
+	proj := gitlab.Project{
+		SSHURLToRepo:  "git@gitlab.local:default/web.git",
+		HTTPURLToRepo: "https://gitlab.local/default/web.git",
+	}
+	type testCase struct {
+		name    string
+		mapping gitURLMapping
+		want    string
+	}
+	testCases := []testCase{
+		{"default", gitURLMapping{}, "git@gitlab.local:default/web.git"},
+		{"ssh", gitURLMapping{protocol: gitURLProtocolSSH}, "git@gitlab.local:default/web.git"},
+		{"https", gitURLMapping{protocol: gitURLProtocolHTTPS}, "https://gitlab.local/default/web.git"},
+		{"ssh with host", gitURLMapping{host: "mirror.internal"}, "git@mirror.internal:default/web.git"},
+		{"ssh with host and port", gitURLMapping{host: "mirror.internal:2222"}, "ssh://git@mirror.internal:2222/default/web.git"},
+		{"https with host", gitURLMapping{protocol: gitURLProtocolHTTPS, host: "mirror.internal:8443"}, "https://mirror.internal:8443/default/web.git"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.mapping.mapGitURL(proj))
+		})
+	}
+}
+
+func TestRewriteGitURLHostKeepsPort(t *testing.T) {
+	got, err := rewriteGitURLHost("ssh://git@gitlab.local:2222/default/web.git", "mirror.internal")
+	require.NoError(t, err)
+	assert.Equal(t, "ssh://git@mirror.internal:2222/default/web.git", got)
+}
+
+func TestGitURLPath(t *testing.T) {
+	for gitURL, want := range map[string]string{
+		"git@gitlab.local:default/web.git":          "default/web",
+		"https://gitlab.local/default/web.git":      "default/web",
+		"ssh://git@gitlab.local:2222/default/web":   "default/web",
+		"gitlab.local:/group/subgroup/project.git/": "group/subgroup/project",
+	} {
+		path, ok := gitURLPath(gitURL)
+		assert.True(t, ok, gitURL)
+		assert.Equal(t, want, path, gitURL)
+	}
+	_, ok := gitURLPath("")
+	assert.False(t, ok)
+}
+
+func TestImportConfigValidateProviders(t *testing.T) {
+	assert.NoError(t, ImportConfig{Providers: []ProviderConfig{{ProviderID: 1, GitURLProtocol: "https"}}}.validate())
+	assert.Error(t, ImportConfig{Providers: []ProviderConfig{{ProviderID: 1, GitURLProtocol: "http"}}}.validate())
+	assert.Error(t, ImportConfig{Providers: []ProviderConfig{{GitURLProtocol: "ssh"}}}.validate())
+	assert.Error(t, ImportConfig{Providers: []ProviderConfig{{ProviderID: 1}, {ProviderID: 1}}}.validate())
+}
+
+func TestRefreshProjectUsesProviderGitURL(t *testing.T) {
+	gitLabProject := &gitlab.Project{
+		ID:            84,
+		Name:          "web",
+		DefaultBranch: "main",
+		SSHURLToRepo:  "git@gitlab.local:default/web.git",
+		HTTPURLToRepo: "https://gitlab.local/default/web.git",
+		Namespace:     &gitlab.ProjectNamespace{FullPath: "default"},
+	}
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getProjectByID", 84).Return(gitLabProject, nil)
+	gitLabMock.On("getBuildDefinitionIfExists", 84, "main", []string{BuildDefinitionFileName}).
+		Return(buildDefinitionFile{}, nil)
+	gitLabMock.On("getBranches", 84, gitLabPageCursor{}).Return([]*gitlab.Branch{}, gitLabPaging{}, nil)
+
+	wharfMock := new(testdoubles.WharfClientAPIFetcherMock)
+	wharfMock.On("GetProject", uint(1)).Return(response.Project{
+		ProjectID:       1,
+		RemoteProjectID: "84",
+		Name:            "web",
+		GroupName:       "default",
+		GitURL:          "git@gitlab.local:default/web.git",
+	}, nil)
+	wharfMock.On("UpdateProject", uint(1), mock.Anything).Return(response.Project{}, nil)
+	wharfMock.On("UpdateProjectBranchList", uint(1), mock.Anything).Return([]response.Branch{}, nil)
+
+	config := ImportConfig{Providers: []ProviderConfig{{ProviderID: 1, GitURLProtocol: gitURLProtocolHTTPS}}}
+	importer := gitLabImporter{
+		gitLabClient: gitLabMock,
+		wharfClient:  wharfMock,
+		mapper:       newMapper(2, 1, config),
+	}
+	_, err := importer.refreshProject(context.Background(), 2, 1, 1)
+	require.NoError(t, err)
+	wharfMock.AssertCalled(t, "UpdateProject", uint(1), mock.MatchedBy(func(p request.ProjectUpdate) bool {
+		return p.GitURL == "https://gitlab.local/default/web.git"
+	}))
+}
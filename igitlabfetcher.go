@@ -1,23 +1,44 @@
 package main
 
-import "github.com/xanzy/go-gitlab"
+import (
+	"context"
+
+	"github.com/xanzy/go-gitlab"
+)
 
 type gitLabFetcher interface {
-	listProjects(page int) ([]*gitlab.Project, gitLabPaging, error)
-	listProjectsFromGroup(groupName string, page int) ([]*gitlab.Project, gitLabPaging, error)
-	getProject(groupName string, projectName string) (*gitlab.Project, error)
-	getBuildDefinitionIfExists(projectID int, defaultBranch string) (string, error)
-	getBranches(gitLabProjectID int, page int) ([]*gitlab.Branch, gitLabPaging, error)
+	listProjects(ctx context.Context, filter gitLabProjectFilter, cursor gitLabPageCursor) ([]*gitlab.Project, gitLabPaging, error)
+	listProjectsFromGroup(ctx context.Context, groupName string, filter gitLabProjectFilter, cursor gitLabPageCursor) ([]*gitlab.Project, gitLabPaging, error)
+	listUserProjects(ctx context.Context, userName string, filter gitLabProjectFilter, cursor gitLabPageCursor) ([]*gitlab.Project, gitLabPaging, error)
+	getNamespace(ctx context.Context, fullPath string) (*gitlab.Namespace, error)
+	getProject(ctx context.Context, groupName string, projectName string) (*gitlab.Project, error)
+	getProjectByID(ctx context.Context, projectID int) (*gitlab.Project, error)
+	getBuildDefinitionIfExists(ctx context.Context, projectID int, ref string, paths []string) (buildDefinitionFile, error)
+	getFileIfExists(ctx context.Context, project string, ref, path string) (string, bool, error)
+	getBranches(ctx context.Context, gitLabProjectID int, cursor gitLabPageCursor) ([]*gitlab.Branch, gitLabPaging, error)
+	getTags(ctx context.Context, gitLabProjectID int, cursor gitLabPageCursor) ([]*gitlab.Tag, gitLabPaging, error)
+	listTree(ctx context.Context, projectID int, ref, path string) ([]*gitlab.TreeNode, error)
+	getAvatar(ctx context.Context, avatarURL string, maxSize int64) (avatar, error)
 }
 
 type gitLabRepoFilesReader interface {
 	GetRawFile(pid any, fileName string, opt *gitlab.GetRawFileOptions, options ...gitlab.RequestOptionFunc) ([]byte, *gitlab.Response, error)
+	GetFileMetaData(pid any, fileName string, opt *gitlab.GetFileMetaDataOptions, options ...gitlab.RequestOptionFunc) (*gitlab.File, *gitlab.Response, error)
 }
 
 type gitLabBranchesReader interface {
 	ListBranches(pid any, opts *gitlab.ListBranchesOptions, options ...gitlab.RequestOptionFunc) ([]*gitlab.Branch, *gitlab.Response, error)
 }
 
+type gitLabTagsReader interface {
+	ListTags(pid any, opt *gitlab.ListTagsOptions, options ...gitlab.RequestOptionFunc) ([]*gitlab.Tag, *gitlab.Response, error)
+}
+
+type gitLabRepositoriesReader interface {
+	ListTree(pid any, opt *gitlab.ListTreeOptions, options ...gitlab.RequestOptionFunc) ([]*gitlab.TreeNode, *gitlab.Response, error)
+	RawBlobContent(pid any, sha string, options ...gitlab.RequestOptionFunc) ([]byte, *gitlab.Response, error)
+}
+
 type gitLabProjectsReader interface {
 	ListProjects(opt *gitlab.ListProjectsOptions, options ...gitlab.RequestOptionFunc) ([]*gitlab.Project, *gitlab.Response, error)
 }
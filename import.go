@@ -1,39 +1,64 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/request"
 	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/response"
 	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/wharfapi"
 	"github.com/iver-wharf/wharf-core/pkg/ginutil"
+	"github.com/iver-wharf/wharf-core/pkg/problem"
 	"github.com/xanzy/go-gitlab"
 )
 
 type importModule struct {
+	// ctx is canceled when the server shuts down. It is the parent of the
+	// context of imports that outlive their request.
+	ctx    context.Context
 	config *Config
+	jobs   *importJobRegistry
 }
 
 func (m importModule) register(r gin.IRouter) {
 	r.POST("/import/gitlab", m.runGitLabHandler)
+	r.POST("/import/gitlab/bulk", m.runGitLabBulkHandler)
+	r.POST("/import/gitlab/trigger", m.runGitLabTriggerHandler)
+	r.POST("/import/gitlab/lint", m.lintGitLabBuildDefinitionHandler)
+	r.POST("/import/gitlab/suggest", m.suggestGitLabBuildDefinitionHandler)
+	r.GET("/import/gitlab/projects/:projectId/build-definition", m.getBranchBuildDefinitionHandler)
+	r.GET("/import/gitlab/projects/:projectId/metadata", m.getProjectMetadataHandler)
+	r.GET("/import/gitlab/projects/:projectId/branches", m.getBranchMetadataHandler)
+	r.GET("/import/gitlab/avatars/:projectId", m.getAvatarHandler)
+	r.GET("/import/gitlab/jobs/:id/events", m.getImportJobEventsHandler)
 }
 
 // runGitLabHandler godoc
 // @Summary Import projects from gitlab or refresh existing one
+// @Description When "async" is set to true, the import is run in the
+// @Description background and its progress can be followed from the
+// @Description GET /import/gitlab/jobs/{id}/events endpoint.
+// @Description Only one import of the same projects may run at a time. If
+// @Description one is already running, then an async request joins it and
+// @Description responds with the running job, while other requests fail.
 // @Accept  json
 // @Produce  json
 // @Param import body main.Import _ "import object"
-// @Success 201 "Successfully imported"
+// @Success 201 {object} main.RefreshResult "Successfully imported or refreshed"
+// @Success 202 {object} main.ImportJob "Import started in the background"
 // @Failure 400 {object} problem.Response "Bad request"
 // @Failure 401 {object} problem.Response "Unauthorized or missing jwt token"
+// @Failure 409 {object} problem.Response "Import of the same projects already running"
 // @Failure 502 {object} problem.Response "Bad gateway"
 // @Router /gitlab [post]
 func (m importModule) runGitLabHandler(c *gin.Context) {
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-
 	i := Import{}
 	err := c.ShouldBindJSON(&i)
 	if err != nil {
@@ -42,56 +67,606 @@ func (m importModule) runGitLabHandler(c *gin.Context) {
 		return
 	}
 
-	wharfClient := wharfapi.Client{
-		AuthHeader: c.GetHeader("Authorization"),
-		APIURL:     m.config.API.URL,
+	if i.ProjectID == 0 && i.whatToImport() == invalidImport {
+		err = fmt.Errorf("invalid import data")
+		detail := fmt.Sprintf("You need to specify either group, group and project, or neither. "+
+			"Specifying only project is invalid. "+
+			"Group=%q, Project=%q", i.Group, i.Project)
+		ginutil.WriteInvalidParamError(c, err, "Group or Project", detail)
+		return
+	}
+
+	if err := i.Scope.validate(); err != nil {
+		ginutil.WriteInvalidParamError(c, err, "scope.minAccessLevel",
+			"The minimum access level must be one of the GitLab access levels: 0, 5, 10, 20, 30, 40, or 50.")
+		return
 	}
 
-	importer, ok := newGitLabImporterWritesProblem(c, &wharfClient, &i)
+	wharfClient := newWharfAPIClient(c.GetHeader("Authorization"), m.config.API.URL)
+	importer, ok := newGitLabImporterWritesProblem(c, wharfClient, &i, m.config.Import)
 	if !ok {
 		return
 	}
+	importer.filter = i.Scope.toFilter()
+	job, started := m.jobs.start(i.lockKey(importer.mapper.providerID))
+	if !started && i.Async {
+		// Join the running import, as the response would be the same.
+		c.Header("Location", job.eventsURL())
+		c.JSON(http.StatusAccepted, job.response())
+		return
+	}
+	if !started {
+		writeImportConflictProblem(c, job)
+		return
+	}
+	importer.job = job
 
-	var detail string
-	if i.ProjectID == 0 {
-		switch i.whatToImport() {
-		case importProject:
-			err = importer.importProject(i.Group, i.Project)
-			detail = fmt.Sprintf("Unable to import GitLab project %q", i.Project)
-		case importGroup:
-			err = importer.importGroup(i.Group)
-			detail = fmt.Sprintf("Unable to import GitLab group %q", i.Group)
-		case importAllGroups:
-			err = importer.importAll()
-			detail = "Unable to import GitLab groups"
-		default:
-			err = fmt.Errorf("invalid import data")
-			detail = fmt.Sprintf("You need to specify either group, group and project, or neither. "+
-				"Specifying only project is invalid. "+
-				"Group=%q, Project=%q", i.Group, i.Project)
-			ginutil.WriteInvalidParamError(c, err, "Group or Project", detail)
-			return
-		}
-	} else {
-		err = importer.refreshProject(i.TokenID, i.ProviderID, i.ProjectID)
-		detail = fmt.Sprintf("Unable to refresh GitLab project %q", i.Project)
+	if i.Async {
+		go func() {
+			// The import outlives the request, so it must not be canceled
+			// when the client disconnects, only when the server shuts down.
+			m.jobs.run(importer.job, func() error {
+				_, err := importer.runImport(m.ctx, i)
+				return err
+			})
+		}()
+		c.Header("Location", importer.job.eventsURL())
+		c.JSON(http.StatusAccepted, importer.job.response())
+		return
 	}
 
+	var result *RefreshResult
+	err = m.jobs.run(importer.job, func() error {
+		var err error
+		result, err = importer.runImport(c.Request.Context(), i)
+		return err
+	})
 	if err != nil {
-		ginutil.WriteAPIClientWriteError(c, err, detail)
+		writeImportErrorProblem(c, err, i.errorDetail())
 		return
 	}
 
+	if result != nil {
+		c.JSON(http.StatusCreated, result)
+		return
+	}
 	c.Status(http.StatusCreated)
 }
 
+// runGitLabBulkHandler godoc
+// @Summary Import a list of projects from gitlab
+// @Description Imports each project in the list, given either as a
+// @Description "group/project" path or as a numeric GitLab project ID. The
+// @Description token and provider are resolved once for all projects. A
+// @Description project failing to import does not stop the others.
+// @Accept  json
+// @Produce  json
+// @Param import body main.BulkImport _ "bulk import object"
+// @Success 201 {object} main.BulkImportResult "Successfully imported all projects"
+// @Success 207 {object} main.BulkImportResult "One or more projects failed to import"
+// @Failure 400 {object} problem.Response "Bad request"
+// @Failure 401 {object} problem.Response "Unauthorized or missing jwt token"
+// @Failure 409 {object} problem.Response "Import of the same projects already running"
+// @Failure 502 {object} problem.Response "Bad gateway"
+// @Router /gitlab/bulk [post]
+func (m importModule) runGitLabBulkHandler(c *gin.Context) {
+	bulk := BulkImport{}
+	if err := c.ShouldBindJSON(&bulk); err != nil {
+		ginutil.WriteInvalidBindError(c, err,
+			"One or more parameters failed to parse when reading the request body for GitLab bulk import")
+		return
+	}
+
+	if len(bulk.Projects) == 0 {
+		err := fmt.Errorf("no projects to import")
+		ginutil.WriteInvalidParamError(c, err, "projects",
+			"You need to specify at least one project, either as a group/project path or a GitLab project ID.")
+		return
+	}
+
+	wharfClient := newWharfAPIClient(c.GetHeader("Authorization"), m.config.API.URL)
+	i := bulk.toImport()
+	importer, ok := newGitLabImporterWritesProblem(c, wharfClient, &i, m.config.Import)
+	if !ok {
+		return
+	}
+	job, started := m.jobs.start(bulk.lockKey(importer.mapper.providerID))
+	if !started {
+		writeImportConflictProblem(c, job)
+		return
+	}
+	importer.job = job
+
+	var result BulkImportResult
+	m.jobs.run(importer.job, func() error {
+		result = importer.importBulk(c.Request.Context(), bulk.Projects)
+		if result.Failed > 0 {
+			return fmt.Errorf("%d of %d projects failed to import", result.Failed, len(result.Projects))
+		}
+		return nil
+	})
+
+	if result.Failed > 0 {
+		c.JSON(http.StatusMultiStatus, result)
+		return
+	}
+	c.JSON(http.StatusCreated, result)
+}
+
+// lintGitLabBuildDefinitionHandler godoc
+// @Summary Lint a build definition
+// @Description Checks the YAML syntax and structure of a build definition,
+// @Description given either as raw YAML in "content" or as a project and ref
+// @Description to fetch it from in GitLab. The response lists the problems
+// @Description found, with their line and column. Nothing is stored in Wharf.
+// @Accept  json
+// @Produce  json
+// @Param lint body main.BuildDefinitionLint _ "lint object"
+// @Success 200 {object} main.BuildDefinitionLintResult "Linted build definition"
+// @Failure 400 {object} problem.Response "Bad request"
+// @Failure 401 {object} problem.Response "Unauthorized or missing jwt token"
+// @Failure 404 {object} problem.Response "Build definition not found"
+// @Failure 502 {object} problem.Response "Bad gateway"
+// @Router /gitlab/lint [post]
+func (m importModule) lintGitLabBuildDefinitionHandler(c *gin.Context) {
+	lint := BuildDefinitionLint{}
+	if err := c.ShouldBindJSON(&lint); err != nil {
+		ginutil.WriteInvalidBindError(c, err,
+			"One or more parameters failed to parse when reading the request body for GitLab build definition lint")
+		return
+	}
+
+	if lint.Content != "" {
+		c.JSON(http.StatusOK, newBuildDefinitionLintResult(lintBuildDefinition(lint.Content)))
+		return
+	}
+
+	if lint.Project == "" {
+		err := fmt.Errorf("nothing to lint")
+		ginutil.WriteInvalidParamError(c, err, "content or project",
+			"You need to specify either the content of a build definition, or a project to fetch it from.")
+		return
+	}
+
+	wharfClient := newWharfAPIClient(c.GetHeader("Authorization"), m.config.API.URL)
+	i := lint.toImport()
+	importer, ok := newGitLabImporterWritesProblem(c, wharfClient, &i, m.config.Import)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := importer.operationContext(c.Request.Context())
+	defer cancel()
+	result, found, err := importer.lintProjectBuildDefinition(ctx, lint.Project, lint.Ref, lint.Path)
+	if err != nil {
+		writeImportErrorProblem(c, err,
+			fmt.Sprintf("Unable to fetch build definition of GitLab project %q", lint.Project))
+		return
+	}
+	if !found {
+		ginutil.WriteProblem(c, problem.Response{
+			Type:   "/prob/provider/gitlab/build-definition-not-found",
+			Title:  "Build definition not found.",
+			Status: http.StatusNotFound,
+			Detail: fmt.Sprintf("No build definition was found in GitLab project %q at ref %q.",
+				lint.Project, result.Ref),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// getBranchBuildDefinitionHandler godoc
+// @Summary Get the build definition of a branch
+// @Description Returns the build definition of a branch other than the
+// @Description default branch, as fetched when the project was last imported
+// @Description or refreshed. Requires the import.branchBuildDefinitions
+// @Description config. The build definition of the default branch is stored
+// @Description on the project in Wharf.
+// @Tags import
+// @Produce json
+// @Param projectId path uint true "Wharf project ID" minimum(0)
+// @Param branch query string true "branch name"
+// @Success 200 {object} main.BranchBuildDefinition "Build definition of the branch"
+// @Failure 400 {object} problem.Response "Bad request"
+// @Failure 404 {object} problem.Response "No build definition stored for the branch"
+// @Failure 500 {object} problem.Response "Failed to read stored build definitions"
+// @Router /gitlab/projects/{projectId}/build-definition [get]
+func (m importModule) getBranchBuildDefinitionHandler(c *gin.Context) {
+	projectID, ok := ginutil.ParseParamUint(c, "projectId")
+	if !ok {
+		return
+	}
+	branch, ok := ginutil.RequireQueryString(c, "branch")
+	if !ok {
+		return
+	}
+
+	store := newBranchBuildDefinitionStore(m.config.Import)
+	if store == nil {
+		writeBranchBuildDefinitionNotFoundProblem(c,
+			"Per-branch build definitions are disabled, as set by the import.branchBuildDefinitions config.")
+		return
+	}
+	defs, _, err := store.load(branchBuildDefinitionsKey(projectID))
+	if err != nil {
+		ginutil.WriteProblemError(c, err, problem.Response{
+			Type:   "/prob/provider/gitlab/branch-build-definition-unreadable",
+			Title:  "Unable to read branch build definitions.",
+			Status: http.StatusInternalServerError,
+			Detail: fmt.Sprintf("Unable to read the stored branch build definitions of project with ID %d.", projectID),
+		})
+		return
+	}
+	def, ok := defs[branch]
+	if !ok {
+		writeBranchBuildDefinitionNotFoundProblem(c, fmt.Sprintf(
+			"No build definition is stored for branch %q of project with ID %d. "+
+				"It may be the default branch, not match the configured patterns, or have no build definition file.",
+			branch, projectID))
+		return
+	}
+	c.JSON(http.StatusOK, def)
+}
+
+func writeBranchBuildDefinitionNotFoundProblem(c *gin.Context, detail string) {
+	ginutil.WriteProblem(c, problem.Response{
+		Type:   "/prob/provider/gitlab/branch-build-definition-not-found",
+		Title:  "Branch build definition not found.",
+		Status: http.StatusNotFound,
+		Detail: detail,
+	})
+}
+
+// getBranchMetadataHandler godoc
+// @Summary Get the GitLab metadata of the branches of a project
+// @Description Returns details about the branches of the GitLab project that
+// @Description Wharf has no fields for, such as whether they are protected
+// @Description and their head commit, as fetched when the project was last
+// @Description imported or refreshed.
+// @Tags import
+// @Produce json
+// @Param projectId path uint true "Wharf project ID" minimum(0)
+// @Success 200 {object} []main.BranchMetadata "Metadata of the branches"
+// @Failure 400 {object} problem.Response "Bad request"
+// @Failure 404 {object} problem.Response "No branch metadata stored for the project"
+// @Failure 500 {object} problem.Response "Failed to read stored metadata"
+// @Router /gitlab/projects/{projectId}/branches [get]
+func (m importModule) getBranchMetadataHandler(c *gin.Context) {
+	projectID, ok := ginutil.ParseParamUint(c, "projectId")
+	if !ok {
+		return
+	}
+
+	branches, ok, err := newJSONStore[[]BranchMetadata](m.config.Import.BranchMetadataDir).load(branchMetadataKey(projectID))
+	if err != nil {
+		ginutil.WriteProblemError(c, err, problem.Response{
+			Type:   "/prob/provider/gitlab/branch-metadata-unreadable",
+			Title:  "Unable to read branch metadata.",
+			Status: http.StatusInternalServerError,
+			Detail: fmt.Sprintf("Unable to read the stored branch metadata of project with ID %d.", projectID),
+		})
+		return
+	}
+	if !ok {
+		ginutil.WriteProblem(c, problem.Response{
+			Type:   "/prob/provider/gitlab/branch-metadata-not-found",
+			Title:  "Branch metadata not found.",
+			Status: http.StatusNotFound,
+			Detail: fmt.Sprintf(
+				"No branch metadata is stored for project with ID %d. It may not have been imported or refreshed "+
+					"since branch metadata was enabled, as set by the import.branchMetadataDir config.",
+				projectID),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, branches)
+}
+
+// getProjectMetadataHandler godoc
+// @Summary Get the GitLab metadata of a project
+// @Description Returns details about the GitLab project that Wharf has no
+// @Description fields for, such as the URL of the project's page in GitLab,
+// @Description as fetched when the project was last imported or refreshed.
+// @Description Only the fields set by the import.projectMetadataFields config
+// @Description are included.
+// @Tags import
+// @Produce json
+// @Param projectId path uint true "Wharf project ID" minimum(0)
+// @Success 200 {object} main.ProjectMetadata "Metadata of the project"
+// @Failure 400 {object} problem.Response "Bad request"
+// @Failure 404 {object} problem.Response "No metadata stored for the project"
+// @Failure 500 {object} problem.Response "Failed to read stored metadata"
+// @Router /gitlab/projects/{projectId}/metadata [get]
+func (m importModule) getProjectMetadataHandler(c *gin.Context) {
+	projectID, ok := ginutil.ParseParamUint(c, "projectId")
+	if !ok {
+		return
+	}
+
+	metadata, ok, err := newJSONStore[ProjectMetadata](m.config.Import.ProjectMetadataDir).load(projectMetadataKey(projectID))
+	if err != nil {
+		ginutil.WriteProblemError(c, err, problem.Response{
+			Type:   "/prob/provider/gitlab/project-metadata-unreadable",
+			Title:  "Unable to read project metadata.",
+			Status: http.StatusInternalServerError,
+			Detail: fmt.Sprintf("Unable to read the stored metadata of project with ID %d.", projectID),
+		})
+		return
+	}
+	if !ok {
+		ginutil.WriteProblem(c, problem.Response{
+			Type:   "/prob/provider/gitlab/project-metadata-not-found",
+			Title:  "Project metadata not found.",
+			Status: http.StatusNotFound,
+			Detail: fmt.Sprintf(
+				"No metadata is stored for project with ID %d. It may not have been imported or refreshed "+
+					"since project metadata was enabled, as set by the import.projectMetadataFields config.",
+				projectID),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, metadata)
+}
+
+// suggestGitLabBuildDefinitionHandler godoc
+// @Summary Suggest a build definition for a project
+// @Description Generates a starter build definition from the files in the
+// @Description root of the repository, such as a Dockerfile, go.mod,
+// @Description package.json, and Helm charts in the charts directory. The
+// @Description content is empty if none of them were found. Nothing is
+// @Description stored in Wharf.
+// @Accept  json
+// @Produce  json
+// @Param suggest body main.BuildDefinitionSuggest _ "suggest object"
+// @Success 200 {object} main.BuildDefinitionSuggestion "Suggested build definition"
+// @Failure 400 {object} problem.Response "Bad request"
+// @Failure 401 {object} problem.Response "Unauthorized or missing jwt token"
+// @Failure 502 {object} problem.Response "Bad gateway"
+// @Router /gitlab/suggest [post]
+func (m importModule) suggestGitLabBuildDefinitionHandler(c *gin.Context) {
+	suggest := BuildDefinitionSuggest{}
+	if err := c.ShouldBindJSON(&suggest); err != nil {
+		ginutil.WriteInvalidBindError(c, err,
+			"One or more parameters failed to parse when reading the request body for GitLab build definition suggestion")
+		return
+	}
+	if suggest.Project == "" {
+		err := fmt.Errorf("no project")
+		ginutil.WriteInvalidParamError(c, err, "project",
+			"You need to specify the project, either as a group/project path or a GitLab project ID.")
+		return
+	}
+
+	wharfClient := newWharfAPIClient(c.GetHeader("Authorization"), m.config.API.URL)
+	i := suggest.toImport()
+	importer, ok := newGitLabImporterWritesProblem(c, wharfClient, &i, m.config.Import)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := importer.operationContext(c.Request.Context())
+	defer cancel()
+	detail := fmt.Sprintf("Unable to suggest build definition for GitLab project %q", suggest.Project)
+	gitLabProject, err := importer.getGitLabProjectByPathOrID(ctx, suggest.Project)
+	if err != nil {
+		writeImportErrorProblem(c, err, detail)
+		return
+	}
+	ref := suggest.Ref
+	if ref == "" {
+		ref = importer.defaultBranch(gitLabProject)
+	}
+	suggestion, err := importer.suggestBuildDefinition(ctx, gitLabProject, ref)
+	if err != nil {
+		writeImportErrorProblem(c, err, detail)
+		return
+	}
+	c.JSON(http.StatusOK, suggestion)
+}
+
+// writeImportErrorProblem writes a 504 Gateway Timeout problem if the import
+// was aborted by the operation timeout, and otherwise the same problem as for
+// any other failed request to a remote API.
+func writeImportErrorProblem(c *gin.Context, err error, detail string) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		ginutil.WriteProblem(c, problem.Response{
+			Type:   "/prob/provider/gitlab/import-timeout",
+			Title:  "Import timed out.",
+			Status: http.StatusGatewayTimeout,
+			Detail: detail + ", because it did not finish in time.",
+		})
+		return
+	}
+	ginutil.WriteAPIClientWriteError(c, err, detail)
+}
+
+// writeImportConflictProblem writes a 409 Conflict problem that points out
+// the already running job, whose progress the client can follow instead.
+func writeImportConflictProblem(c *gin.Context, job *importJob) {
+	c.Header("Location", job.eventsURL())
+	ginutil.WriteProblem(c, problem.Response{
+		Type:   "/prob/provider/gitlab/import-already-running",
+		Title:  "Import already running.",
+		Status: http.StatusConflict,
+		Detail: fmt.Sprintf("An import of the same projects is already running as job %q, started at %s. "+
+			"Its progress can be followed from %s.",
+			job.id, job.startedAt.Format(time.RFC3339), job.eventsURL()),
+	})
+}
+
+// getImportJobEventsHandler godoc
+// @Summary Stream progress events of an import job
+// @Description Server-Sent Events stream of the progress of an import job.
+// @Description Events that were emitted before subscribing are sent first.
+// @Description The stream ends when the job has finished.
+// @Tags import
+// @Produce text/event-stream
+// @Param id path string true "import job ID"
+// @Success 200 {object} main.ImportEvent "Stream of events"
+// @Failure 404 {object} problem.Response "Import job not found"
+// @Router /gitlab/jobs/{id}/events [get]
+func (m importModule) getImportJobEventsHandler(c *gin.Context) {
+	id := c.Param("id")
+	job, ok := m.jobs.get(id)
+	if !ok {
+		ginutil.WriteProblem(c, problem.Response{
+			Type:   "/prob/provider/gitlab/import-job-not-found",
+			Title:  "Import job not found.",
+			Status: http.StatusNotFound,
+			Detail: fmt.Sprintf("No import job with ID %q was found. Jobs are removed %s after they have finished.",
+				id, importJobRetention),
+		})
+		return
+	}
+
+	history, events, unsubscribe := job.subscribe()
+	defer unsubscribe()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	for _, ev := range history {
+		c.SSEvent(string(ev.Type), ev)
+	}
+	c.Writer.Flush()
+	if events == nil {
+		return
+	}
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return false
+			}
+			c.SSEvent(string(ev.Type), ev)
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
 type gitLabImporter struct {
 	gitLabClient gitLabFetcher
 	wharfClient  wharfClientAPIFetcher
 	mapper       mapper
+	checkpoints  *jsonStore[importCheckpoint]
+	job          *importJob
+	filter       gitLabProjectFilter
+	// operationTimeout is the longest time a whole import or refresh may
+	// take. Zero means no limit.
+	operationTimeout time.Duration
+	syncStates       *jsonStore[syncState]
+	projectStates    *jsonStore[projectState]
+	currentTime      func() time.Time
+	// buildDefinitionPaths are the paths to look for the build definition
+	// file at, in order.
+	buildDefinitionPaths          []string
+	rejectInvalidBuildDefinitions bool
+	branchBuildDefinitions        *jsonStore[branchBuildDefinitions]
+	branchBuildDefinitionPatterns []string
+	importTags                    bool
+	tagPatterns                   []string
+	projectMetadata               *jsonStore[ProjectMetadata]
+	// projectMetadataFields are the fields to store in projectMetadata.
+	projectMetadataFields []string
+	branchMetadata        *jsonStore[[]BranchMetadata]
+	// includeMaxDepth is how deeply includes in build definitions may be
+	// nested. Zero means includes are not resolved.
+	includeMaxDepth                 int
+	generateMissingBuildDefinitions bool
+	// fallbackDefaultBranch is the branch to fetch build definitions from
+	// when GitLab does not report a default branch for a project. Empty
+	// means GitLab decides.
+	fallbackDefaultBranch string
+}
+
+// defaultBranch returns the default branch of the project, or the configured
+// fallback if GitLab does not report one.
+func (importer gitLabImporter) defaultBranch(gitLabProject *gitlab.Project) string {
+	if gitLabProject.DefaultBranch != "" {
+		return gitLabProject.DefaultBranch
+	}
+	return importer.fallbackDefaultBranch
+}
+
+// operationContext returns a context limited by the operation timeout.
+func (importer *gitLabImporter) operationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if importer.operationTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, importer.operationTimeout)
 }
 
-func newGitLabImporterWritesProblem(c *gin.Context, wharfClient wharfClientAPIFetcher, importData *Import) (*gitLabImporter, bool) {
+// runImport imports or refreshes what the import data points out. Only
+// refreshes have a result.
+func (importer *gitLabImporter) runImport(ctx context.Context, i Import) (*RefreshResult, error) {
+	ctx, cancel := importer.operationContext(ctx)
+	defer cancel()
+	if i.ProjectID != 0 {
+		result, err := importer.refreshProject(ctx, i.TokenID, i.ProviderID, i.ProjectID)
+		if err != nil {
+			return nil, err
+		}
+		return &result, nil
+	}
+	switch i.whatToImport() {
+	case importProject:
+		return nil, importer.importProject(ctx, i.Group, i.Project)
+	case importGroup, importAllGroups:
+		return nil, importer.syncProjects(ctx, i)
+	default:
+		return nil, fmt.Errorf("invalid import data: group=%q, project=%q", i.Group, i.Project)
+	}
+}
+
+// syncProjects imports all projects in a group, or in the whole GitLab
+// instance if no group is set. The time of the last successful sync is saved,
+// so that a later sync with OnlyActive set only imports the projects with
+// activity in GitLab since then.
+func (importer *gitLabImporter) syncProjects(ctx context.Context, i Import) error {
+	key := syncStateKey(importer.mapper.providerID, i.Group, "", importer.filter)
+	startedAt := importer.now()
+	if i.OnlyActive {
+		state, ok, err := importer.syncStates.load(key)
+		if err != nil {
+			log.Warn().
+				WithError(err).
+				WithString("syncState", key).
+				Message("Failed to load sync state, importing all projects.")
+		} else if ok {
+			log.Info().
+				WithString("syncState", key).
+				WithTime("lastSuccessfulSync", state.LastSuccessfulSync).
+				Message("Only importing projects with activity since the last successful sync.")
+			importer.filter.LastActivityAfter = &state.LastSuccessfulSync
+		}
+	}
+
+	var err error
+	if i.Group != "" {
+		err = importer.importGroup(ctx, i.Group, i.Resume)
+	} else {
+		err = importer.importAll(ctx, i.Resume)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := importer.syncStates.save(key, syncState{LastSuccessfulSync: startedAt}); err != nil {
+		log.Warn().WithError(err).WithString("syncState", key).Message("Failed to save sync state.")
+	}
+	return nil
+}
+
+func (importer *gitLabImporter) now() time.Time {
+	if importer.currentTime == nil {
+		return time.Now()
+	}
+	return importer.currentTime()
+}
+
+func newGitLabImporterWritesProblem(c *gin.Context, wharfClient wharfClientAPIFetcher, importData *Import, config ImportConfig) (*gitLabImporter, bool) {
 	token, ok := obtainTokenWritesProblem(c, wharfClient, importData)
 	if !ok {
 		return nil, false
@@ -106,17 +681,68 @@ func newGitLabImporterWritesProblem(c *gin.Context, wharfClient wharfClientAPIFe
 	if !ok {
 		return nil, false
 	}
+	return newGitLabImporter(wharfClient, gitLabClient, token, provider, config), true
+}
+
+// newGitLabImporterForProvider creates an importer using the token and GitLab
+// URL of a provider that is already stored in Wharf. It is meant for imports
+// that are not made on behalf of an incoming request.
+func newGitLabImporterForProvider(ctx context.Context, wharfClient wharfClientAPIFetcher, providerID uint, config ImportConfig) (*gitLabImporter, error) {
+	provider, err := wharfClient.GetProvider(ctx, providerID)
+	if err != nil {
+		return nil, fmt.Errorf("get provider by ID %d: %w", providerID, err)
+	}
+	if provider.ProviderID == 0 {
+		return nil, fmt.Errorf("provider with ID %d not found", providerID)
+	}
+
+	token, err := wharfClient.GetToken(ctx, provider.TokenID)
+	if err != nil {
+		return nil, fmt.Errorf("get token by ID %d: %w", provider.TokenID, err)
+	}
+	if token.TokenID == 0 {
+		return nil, fmt.Errorf("token with ID %d not found", provider.TokenID)
+	}
+
+	gitLabClient, err := newGitLabClient(token.Token, provider.URL)
+	if err != nil {
+		return nil, fmt.Errorf("create GitLab client for %q: %w", provider.URL, err)
+	}
+	return newGitLabImporter(wharfClient, gitLabClient, token, provider, config), nil
+}
+
+// newGitLabImporter creates an importer for the provider with the settings
+// and stores from the config. The stores of disabled features are nil.
+func newGitLabImporter(wharfClient wharfClientAPIFetcher, gitLabClient *gitLabClient, token response.Token, provider response.Provider, config ImportConfig) *gitLabImporter {
+	gitLabClient.callTimeout = config.CallTimeout
+	gitLabClient.blobCache = newBlobCache(config)
 
 	return &gitLabImporter{
-		wharfClient:  wharfClient,
-		gitLabClient: gitLabClient,
-		mapper:       mapper{token.TokenID, provider.ProviderID},
-	}, true
+		wharfClient:                     wharfClient,
+		gitLabClient:                    gitLabClient,
+		mapper:                          newMapper(token.TokenID, provider.ProviderID, config),
+		operationTimeout:                config.OperationTimeout,
+		checkpoints:                     newJSONStore[importCheckpoint](config.CheckpointDir),
+		syncStates:                      newJSONStore[syncState](config.SyncStateDir),
+		projectStates:                   newJSONStore[projectState](config.ProjectStateDir),
+		buildDefinitionPaths:            config.BuildDefinitionPaths,
+		rejectInvalidBuildDefinitions:   config.RejectInvalidBuildDefinitions,
+		branchBuildDefinitions:          newBranchBuildDefinitionStore(config),
+		branchBuildDefinitionPatterns:   config.BranchBuildDefinitionPatterns,
+		includeMaxDepth:                 config.BuildDefinitionIncludeMaxDepth,
+		generateMissingBuildDefinitions: config.GenerateMissingBuildDefinitions,
+		fallbackDefaultBranch:           config.FallbackDefaultBranch,
+		importTags:                      config.ImportTags,
+		tagPatterns:                     config.TagPatterns,
+		projectMetadata:                 newJSONStore[ProjectMetadata](config.ProjectMetadataDir),
+		projectMetadataFields:           projectMetadataFields(config),
+		branchMetadata:                  newJSONStore[[]BranchMetadata](config.BranchMetadataDir),
+	}
 }
 
 func obtainTokenWritesProblem(c *gin.Context, wharfClient wharfClientAPIFetcher, importData *Import) (response.Token, bool) {
 	if importData.TokenID != 0 {
-		token, err := wharfClient.GetToken(importData.TokenID)
+		token, err := wharfClient.GetToken(c.Request.Context(), importData.TokenID)
 		if err != nil {
 			ginutil.WriteAPIClientReadError(c, err,
 				fmt.Sprintf(
@@ -137,7 +763,7 @@ func obtainTokenWritesProblem(c *gin.Context, wharfClient wharfClientAPIFetcher,
 	search := wharfapi.TokenSearch{
 		UserName: &importData.User,
 	}
-	tokens, err := wharfClient.GetTokenList(search)
+	tokens, err := wharfClient.GetTokenList(c.Request.Context(), search)
 	if err != nil {
 		ginutil.WriteAPIClientReadError(c, err,
 			"Unable to get token from the API. This issue might be temporary. Please try again later.")
@@ -146,7 +772,7 @@ func obtainTokenWritesProblem(c *gin.Context, wharfClient wharfClientAPIFetcher,
 	}
 	token, ok := findTokenByTokenString(tokens.List, importData.Token)
 	if !ok {
-		token, err = wharfClient.CreateToken(request.Token{Token: importData.Token, UserName: importData.User})
+		token, err = wharfClient.CreateToken(c.Request.Context(), request.Token{Token: importData.Token, UserName: importData.User})
 		if authErr, ok := err.(*wharfapi.AuthError); ok {
 			c.Header("WWW-Authenticate", authErr.Realm)
 			ginutil.WriteUnauthorizedError(c, authErr,
@@ -178,7 +804,7 @@ func findTokenByTokenString(tokens []response.Token, tokenStr string) (response.
 
 func obtainProviderWritesProblem(c *gin.Context, wharfClient wharfClientAPIFetcher, tokenID uint, importData *Import) (response.Provider, bool) {
 	if importData.ProviderID != 0 {
-		provider, err := wharfClient.GetProvider(importData.ProviderID)
+		provider, err := wharfClient.GetProvider(c.Request.Context(), importData.ProviderID)
 		if err != nil || provider.ProviderID == 0 {
 			ginutil.WriteAPIClientReadError(c, err,
 				fmt.Sprintf("Unable to get provider by ID %d.", importData.ProjectID))
@@ -195,7 +821,7 @@ func obtainProviderWritesProblem(c *gin.Context, wharfClient wharfClientAPIFetch
 	}
 
 	var provider response.Provider
-	providers, err := wharfClient.GetProviderList(search)
+	providers, err := wharfClient.GetProviderList(c.Request.Context(), search)
 	if authErr, ok := err.(*wharfapi.AuthError); ok {
 		c.Header("WWW-Authenticate", authErr.Realm)
 		ginutil.WriteUnauthorizedError(c, authErr,
@@ -211,7 +837,7 @@ func obtainProviderWritesProblem(c *gin.Context, wharfClient wharfClientAPIFetch
 
 	provider, ok := findProviderByTokenID(providers.List, tokenID)
 	if !ok {
-		provider, err = wharfClient.CreateProvider(request.Provider{
+		provider, err = wharfClient.CreateProvider(c.Request.Context(), request.Provider{
 			Name:    ProviderName,
 			URL:     importData.URL,
 			TokenID: tokenID})
@@ -242,132 +868,671 @@ func findProviderByTokenID(providers []response.Provider, tokenID uint) (respons
 	return provider, ok
 }
 
-func (importer *gitLabImporter) importProject(groupName string, projectName string) error {
-	gitLabProject, err := importer.gitLabClient.getProject(groupName, projectName)
+func (importer *gitLabImporter) importProject(ctx context.Context, groupName string, projectName string) error {
+	gitLabProject, err := importer.gitLabClient.getProject(ctx, groupName, projectName)
 	if err != nil {
 		log.Error().WithError(err).Message("Failed to get project.")
 		return err
 	}
 
-	wharfProject, err := importer.postProject(*gitLabProject)
+	_, _, err = importer.importGitLabProject(ctx, gitLabProject)
+	return err
+}
+
+// importGitLabProject creates the project in Wharf, or updates it if it
+// already exists, and then adds its branches.
+func (importer gitLabImporter) importGitLabProject(ctx context.Context, gitLabProject *gitlab.Project) (response.Project, buildDefinitionFile, error) {
+	unlock, err := importer.job.lockProject(ctx, importer.mapper.providerID, gitLabProject.ID)
+	if err != nil {
+		return response.Project{}, buildDefinitionFile{}, err
+	}
+	defer unlock()
+
+	importer.job.emit(ImportEvent{
+		Type:            importEventProjectStarted,
+		GitLabProjectID: gitLabProject.ID,
+		Project:         gitLabProject.PathWithNamespace,
+	})
+
+	wharfProject, buildDef, err := importer.postProject(ctx, *gitLabProject)
 	if err != nil {
 		log.Error().
 			WithError(err).
 			WithString("gitLabProject", gitLabProject.NameWithNamespace).
 			Message("Failed to create project.")
-		return err
+		importer.emitProjectFailed(gitLabProject, 0, err)
+		return response.Project{}, buildDef, err
 	}
 
-	err = importer.importBranches(wharfProject.ProjectID, gitLabProject.ID)
+	importer.saveProjectMetadata(wharfProject.ProjectID, gitLabProject)
+	err = importer.importBranches(ctx, wharfProject.ProjectID, gitLabProject)
 	if err != nil {
 		log.Error().
 			WithString("gitLabProject", gitLabProject.NameWithNamespace).
 			WithStringf("wharfProject", "%s/%s", wharfProject.GroupName, wharfProject.Name).
 			Message("Unable to import branches.")
-		return err
+		importer.emitProjectFailed(gitLabProject, wharfProject.ProjectID, err)
+		return wharfProject, buildDef, err
 	}
 
-	return nil
+	importer.job.emit(ImportEvent{
+		Type:            importEventProjectFinished,
+		GitLabProjectID: gitLabProject.ID,
+		WharfProjectID:  wharfProject.ProjectID,
+		Project:         gitLabProject.PathWithNamespace,
+		Diagnostics:     buildDef.Diagnostics,
+		EmptyRepository: gitLabProject.EmptyRepo,
+	})
+	return wharfProject, buildDef, nil
 }
 
-func (importer *gitLabImporter) importGroup(groupName string) error {
-	return importPaginatedProjects(func(page int) ([]*gitlab.Project, gitLabPaging, error) {
-		return importer.gitLabClient.listProjectsFromGroup(groupName, page)
-	}, importer.importProjects)
+// saveProjectMetadata stores the fields of the project that Wharf does not
+// store. A failure is only logged, as the project is already imported.
+func (importer gitLabImporter) saveProjectMetadata(wharfProjectID uint, gitLabProject *gitlab.Project) {
+	if importer.projectMetadata == nil {
+		return
+	}
+	metadata := importer.mapper.mapProjectMetadata(*gitLabProject, importer.projectMetadataFields)
+	if err := importer.projectMetadata.save(projectMetadataKey(wharfProjectID), metadata); err != nil {
+		log.Warn().
+			WithError(err).
+			WithUint("projectId", wharfProjectID).
+			WithInt("gitLabProjectId", gitLabProject.ID).
+			Message("Failed to save project metadata.")
+	}
 }
 
-func (importer *gitLabImporter) importAll() error {
-	return importPaginatedProjects(importer.gitLabClient.listProjects, importer.importProjects)
+// saveBranchMetadata stores the fields of the branches that Wharf does not
+// store. A failure is only logged, as the branches are already imported.
+func (importer gitLabImporter) saveBranchMetadata(wharfProjectID uint, branches []BranchMetadata) {
+	if branches == nil {
+		branches = []BranchMetadata{}
+	}
+	// Replaces the saved metadata, so that branches that were deleted are
+	// removed.
+	if err := importer.branchMetadata.save(branchMetadataKey(wharfProjectID), branches); err != nil {
+		log.Warn().
+			WithError(err).
+			WithUint("projectId", wharfProjectID).
+			Message("Failed to save branch metadata.")
+	}
 }
 
-func (importer gitLabImporter) importProjects(projects []*gitlab.Project) string {
-	var errMessage string
-	for _, project := range projects {
-		wharfProject, err := importer.postProject(*project)
+func (importer gitLabImporter) emitProjectFailed(gitLabProject *gitlab.Project, wharfProjectID uint, err error) {
+	importer.job.emit(ImportEvent{
+		Type:            importEventProjectFailed,
+		GitLabProjectID: gitLabProject.ID,
+		WharfProjectID:  wharfProjectID,
+		Project:         gitLabProject.PathWithNamespace,
+		Error:           err.Error(),
+	})
+}
+
+// importGroup imports all projects in a GitLab namespace, which is either a
+// group or a user's personal namespace.
+func (importer *gitLabImporter) importGroup(ctx context.Context, groupName string, resume bool) error {
+	list := importer.gitLabClient.listProjectsFromGroup
+	namespace, err := importer.gitLabClient.getNamespace(ctx, groupName)
+	if err != nil {
+		log.Warn().
+			WithError(err).
+			WithString("group", groupName).
+			Message("Failed to look up namespace kind, assuming it is a group.")
+	} else if namespace.Kind == gitLabNamespaceKindUser {
+		log.Debug().
+			WithString("userName", namespace.FullPath).
+			Message("Namespace is a user namespace, listing the user's projects.")
+		list = importer.gitLabClient.listUserProjects
+	}
+	return importer.importPaginatedProjects(ctx, groupName, resume, func(cursor gitLabPageCursor) ([]*gitlab.Project, gitLabPaging, error) {
+		return list(ctx, groupName, importer.filter, cursor)
+	})
+}
+
+func (importer *gitLabImporter) importAll(ctx context.Context, resume bool) error {
+	return importer.importPaginatedProjects(ctx, "", resume, func(cursor gitLabPageCursor) ([]*gitlab.Project, gitLabPaging, error) {
+		return importer.gitLabClient.listProjects(ctx, importer.filter, cursor)
+	})
+}
+
+// importPaginatedProjects imports all projects from a group, or from the whole
+// GitLab instance if the group name is empty, while saving a checkpoint after
+// each page. If resume is true, the import continues from the last saved
+// checkpoint, starting by retrying the projects that previously failed.
+func (importer *gitLabImporter) importPaginatedProjects(ctx context.Context, groupName string, resume bool, get getProjects) error {
+	key := importCheckpointKey(importer.mapper.providerID, groupName, importer.filter)
+	var checkpoint importCheckpoint
+	// The retried projects may be listed again if the previous import got
+	// through all pages, and are not imported twice.
+	retried := make(map[int]bool)
+	if resume {
+		saved, ok, err := importer.checkpoints.load(key)
 		if err != nil {
-			log.Error().
-				WithError(err).
-				WithString("gitLabProject", project.NameWithNamespace).
-				Message("Failed to create project")
-			errMessage += fmt.Sprintf("proj: %v err: %+v \n", project, err)
+			log.Error().WithError(err).WithString("checkpoint", key).Message("Failed to load import checkpoint.")
+			return err
+		}
+		if ok {
+			log.Info().
+				WithString("checkpoint", key).
+				WithInt("page", saved.Cursor.Page).
+				WithString("nextQuery", saved.Cursor.NextQuery).
+				WithInt("lastGitLabProjectId", saved.LastProjectID).
+				WithInt("failed", len(saved.Failed)).
+				Message("Resuming import from checkpoint.")
+			checkpoint = saved
+			checkpoint.Failed = importer.retryFailedProjects(ctx, saved.Failed)
+			for _, failure := range saved.Failed {
+				retried[failure.GitLabProjectID] = true
+			}
+		}
+	}
+
+	post := func(projects []*gitlab.Project) []importFailure {
+		var notRetried []*gitlab.Project
+		for _, project := range projects {
+			if !retried[project.ID] {
+				notRetried = append(notRetried, project)
+			}
+		}
+		return importer.importProjects(ctx, notRetried)
+	}
+	err := importPaginatedProjects(ctx, get, post, importer.job, &checkpoint, func(cp importCheckpoint) {
+		cp.UpdatedAt = time.Now()
+		if err := importer.checkpoints.save(key, cp); err != nil {
+			log.Warn().WithError(err).WithString("checkpoint", key).Message("Failed to save import checkpoint.")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err := importer.checkpoints.remove(key); err != nil {
+		log.Warn().WithError(err).WithString("checkpoint", key).Message("Failed to remove import checkpoint.")
+	}
+	return nil
+}
+
+func (importer gitLabImporter) retryFailedProjects(ctx context.Context, failures []importFailure) []importFailure {
+	var stillFailing []importFailure
+	for _, failure := range failures {
+		project, err := importer.gitLabClient.getProjectByID(ctx, failure.GitLabProjectID)
+		if err != nil {
+			failure.Error = err.Error()
+			stillFailing = append(stillFailing, failure)
 			continue
 		}
+		stillFailing = append(stillFailing, importer.importProjects(ctx, []*gitlab.Project{project})...)
+	}
+	return stillFailing
+}
 
-		err = importer.importBranches(wharfProject.ProjectID, project.ID)
+// importBulk imports each of the projects, given as "group/project" paths or
+// numeric GitLab project IDs, and carries on with the rest when one fails.
+func (importer gitLabImporter) importBulk(ctx context.Context, entries []string) BulkImportResult {
+	ctx, cancel := importer.operationContext(ctx)
+	defer cancel()
+	result := BulkImportResult{Projects: make([]BulkImportProjectResult, 0, len(entries))}
+	for _, entry := range entries {
+		projectResult := BulkImportProjectResult{Entry: entry}
+		gitLabProject, err := importer.getGitLabProjectByPathOrID(ctx, entry)
+		if err == nil {
+			projectResult.GitLabProjectID = gitLabProject.ID
+			projectResult.Path = gitLabProject.PathWithNamespace
+			var wharfProject response.Project
+			var buildDef buildDefinitionFile
+			wharfProject, buildDef, err = importer.importGitLabProject(ctx, gitLabProject)
+			projectResult.WharfProjectID = wharfProject.ProjectID
+			projectResult.BuildDefinitionPath = buildDef.Path
+			projectResult.BuildDefinitionDiagnostics = buildDef.Diagnostics
+			projectResult.BuildDefinitionRejected = buildDef.Rejected
+			projectResult.BuildDefinitionGenerated = buildDef.Generated
+			projectResult.EmptyRepository = gitLabProject.EmptyRepo
+		}
 		if err != nil {
-			log.Error().
-				WithString("gitLabProject", project.NameWithNamespace).
-				WithStringf("wharfProject", "%s/%s", wharfProject.GroupName, wharfProject.Name).
-				Message("Unable to import branches.")
-			errMessage += fmt.Sprintf("proj: %v err: %+v \n", wharfProject, err)
+			log.Warn().
+				WithError(err).
+				WithString("entry", entry).
+				Message("Failed to import project in bulk import.")
+			projectResult.Error = err.Error()
+			result.Failed++
+		} else {
+			projectResult.Imported = true
+			result.Imported++
 		}
+		result.Projects = append(result.Projects, projectResult)
 	}
-	return errMessage
+	return result
 }
 
-func (importer gitLabImporter) refreshProject(tokenID, providerID, projectID uint) error {
-	proj, err := importer.wharfClient.GetProject(projectID)
+func (importer gitLabImporter) getGitLabProjectByPathOrID(ctx context.Context, entry string) (*gitlab.Project, error) {
+	entry = strings.Trim(strings.TrimSpace(entry), "/")
+	if gitLabProjectID, err := strconv.Atoi(entry); err == nil {
+		return importer.gitLabClient.getProjectByID(ctx, gitLabProjectID)
+	}
+	lastSlash := strings.LastIndexByte(entry, '/')
+	if lastSlash == -1 {
+		return nil, fmt.Errorf("invalid project %q: must be a group/project path or a GitLab project ID", entry)
+	}
+	return importer.gitLabClient.getProject(ctx, entry[:lastSlash], entry[lastSlash+1:])
+}
+
+// importProjects imports the projects and returns the ones that failed. It
+// stops early if the context is canceled, leaving the rest of the projects
+// unhandled rather than failed.
+func (importer gitLabImporter) importProjects(ctx context.Context, projects []*gitlab.Project) []importFailure {
+	var failures []importFailure
+	for _, project := range projects {
+		if ctx.Err() != nil {
+			break
+		}
+		if _, _, err := importer.importGitLabProject(ctx, project); err != nil {
+			failures = append(failures, newImportFailure(project, err))
+		}
+	}
+	return failures
+}
+
+func (importer gitLabImporter) refreshProject(ctx context.Context, tokenID, providerID, projectID uint) (RefreshResult, error) {
+	proj, err := importer.wharfClient.GetProject(ctx, projectID)
 	if err != nil {
 		log.Error().
 			WithUint("projectID", projectID).
 			Message("Unable to fetch project from Wharf database.")
-		return err
+		return RefreshResult{}, err
 	}
-	// TODO: Use remote project ID if available.
-	gitLabProject, err := importer.gitLabClient.getProject(proj.GroupName, proj.Name)
+	gitLabProject, err := importer.getGitLabProjectForWharfProject(ctx, proj)
 	if err != nil {
 		log.Error().
 			WithStringf("wharfProject", "%s/%s", proj.GroupName, proj.Name).
+			WithString("remoteProjectId", proj.RemoteProjectID).
 			Message("Unable to get project from GitLab.")
-		return err
+		return RefreshResult{}, err
 	}
+	unlock, err := importer.job.lockProject(ctx, importer.mapper.providerID, gitLabProject.ID)
+	if err != nil {
+		return RefreshResult{}, err
+	}
+	defer unlock()
+
+	importer.job.emit(ImportEvent{
+		Type:            importEventProjectStarted,
+		GitLabProjectID: gitLabProject.ID,
+		WharfProjectID:  projectID,
+		Project:         gitLabProject.PathWithNamespace,
+	})
 
-	buildDef, err := importer.gitLabClient.getBuildDefinitionIfExists(gitLabProject.ID, gitLabProject.DefaultBranch)
+	buildDef, err := importer.getBuildDefinition(ctx, gitLabProject)
 	if err != nil {
-		return err
+		importer.emitProjectFailed(gitLabProject, projectID, err)
+		return RefreshResult{}, err
+	}
+	groupName, projectName := importer.mapper.names.mapNames(*gitLabProject)
+	result := RefreshResult{
+		ProjectID:                  projectID,
+		OldPath:                    joinProjectPath(proj.GroupName, proj.Name),
+		NewPath:                    joinProjectPath(groupName, projectName),
+		BuildDefinitionPath:        buildDef.Path,
+		BuildDefinitionDiagnostics: buildDef.Diagnostics,
+		BuildDefinitionRejected:    buildDef.Rejected,
+		BuildDefinitionGenerated:   buildDef.Generated,
+		EmptyRepository:            gitLabProject.EmptyRepo,
 	}
-	groupName := ""
-	if gitLabProject.Namespace != nil {
-		groupName = gitLabProject.Namespace.FullPath
+	buildDefContent := buildDef.Content
+	if buildDef.Rejected {
+		// Keep the build definition that is already stored.
+		buildDefContent = proj.BuildDefinition
 	}
-	_, err = importer.wharfClient.UpdateProject(projectID, request.ProjectUpdate{
-		Name:            gitLabProject.Name,
-		BuildDefinition: buildDef,
+	update := request.ProjectUpdate{
+		Name:            projectName,
+		BuildDefinition: buildDefContent,
 		Description:     gitLabProject.Description,
-		AvatarURL:       gitLabProject.AvatarURL,
-		GitURL:          gitLabProject.SSHURLToRepo,
+		AvatarURL:       importer.mapper.mapAvatarURL(*gitLabProject),
+		GitURL:          importer.mapper.gitURL.mapGitURL(*gitLabProject),
 		TokenID:         tokenID,
 		ProviderID:      providerID,
 		GroupName:       groupName,
+	}
+	renamed := result.OldPath != result.NewPath
+	if renamed {
+		result.Moved, err = isMovedInGitLab(proj, update.GitURL, *gitLabProject, importer.mapper.names)
+		if err != nil {
+			importer.emitProjectFailed(gitLabProject, projectID, err)
+			return RefreshResult{}, err
+		}
+	}
+	if isProjectUpToDate(proj, update) {
+		log.Debug().
+			WithUint("projectId", projectID).
+			WithString("project", result.NewPath).
+			Message("Project is unchanged, skipping update.")
+		result.Unchanged = true
+	} else if _, err := importer.wharfClient.UpdateProject(ctx, projectID, update); err != nil {
+		importer.emitProjectFailed(gitLabProject, projectID, err)
+		return RefreshResult{}, err
+	}
+	if result.Moved {
+		auditLog.Info().
+			WithUint("projectId", projectID).
+			WithInt("gitLabProjectId", gitLabProject.ID).
+			WithString("oldPath", result.OldPath).
+			WithString("newPath", result.NewPath).
+			WithString("oldGitUrl", proj.GitURL).
+			WithString("newGitUrl", update.GitURL).
+			Message("Project was renamed or moved in GitLab; followed the change.")
+	} else if renamed {
+		auditLog.Info().
+			WithUint("projectId", projectID).
+			WithInt("gitLabProjectId", gitLabProject.ID).
+			WithString("oldPath", result.OldPath).
+			WithString("newPath", result.NewPath).
+			Message("Project was renamed by the naming rules of its provider.")
+	}
+	importer.saveProjectMetadata(projectID, gitLabProject)
+	if err := importer.refreshBranches(ctx, projectID, gitLabProject); err != nil {
+		log.Error().
+			WithError(err).
+			WithUint("projectId", projectID).
+			WithString("gitLabProject", gitLabProject.PathWithNamespace).
+			Message("Unable to refresh branches.")
+		importer.emitProjectFailed(gitLabProject, projectID, err)
+		return RefreshResult{}, err
+	}
+	importer.job.emit(ImportEvent{
+		Type:            importEventProjectFinished,
+		GitLabProjectID: gitLabProject.ID,
+		WharfProjectID:  projectID,
+		Project:         gitLabProject.PathWithNamespace,
+		Diagnostics:     buildDef.Diagnostics,
+		EmptyRepository: gitLabProject.EmptyRepo,
 	})
-	if err == nil {
-		importer.refreshBranches(projectID, gitLabProject.ID)
+	return result, nil
+}
+
+// isProjectUpToDate returns true if updating the project in Wharf would not
+// change anything.
+func isProjectUpToDate(proj response.Project, update request.ProjectUpdate) bool {
+	return proj.Name == update.Name &&
+		proj.GroupName == update.GroupName &&
+		proj.Description == update.Description &&
+		proj.AvatarURL == update.AvatarURL &&
+		proj.GitURL == update.GitURL &&
+		proj.TokenID == update.TokenID &&
+		proj.ProviderID == update.ProviderID &&
+		proj.BuildDefinition == update.BuildDefinition
+}
+
+// getGitLabProjectForWharfProject looks up the GitLab project using the
+// remote project ID stored in Wharf, so that renames and namespace transfers
+// in GitLab are followed. Projects imported before the remote project ID was
+// stored are instead looked up by their group and project name.
+func (importer gitLabImporter) getGitLabProjectForWharfProject(ctx context.Context, proj response.Project) (*gitlab.Project, error) {
+	if proj.RemoteProjectID != "" {
+		gitLabProjectID, err := strconv.Atoi(proj.RemoteProjectID)
+		if err == nil {
+			return importer.gitLabClient.getProjectByID(ctx, gitLabProjectID)
+		}
+		log.Warn().
+			WithError(err).
+			WithUint("projectId", proj.ProjectID).
+			WithString("remoteProjectId", proj.RemoteProjectID).
+			Message("Invalid remote project ID, falling back to lookup by name.")
 	}
-	return err
+	return importer.gitLabClient.getProject(ctx, proj.GroupName, proj.Name)
+}
+
+// isMovedInGitLab returns true if the path of the GitLab project changed since
+// the Wharf project was last imported or refreshed, as opposed to only the
+// naming rules of the provider. The old path is taken from the Git URL stored
+// in Wharf, which the naming rules do not affect.
+//
+// Projects without a Git URL are instead compared by the names GitLab gives
+// them, which only works for providers without naming rules. For other
+// providers an error is returned, as the old path cannot be told apart from
+// the names the rules gave the project.
+func isMovedInGitLab(proj response.Project, newGitURL string, gitLabProject gitlab.Project, names nameMapping) (bool, error) {
+	oldPath, oldOK := gitURLPath(proj.GitURL)
+	newPath, newOK := gitURLPath(newGitURL)
+	if oldOK && newOK {
+		return oldPath != newPath, nil
+	}
+	if !names.isDefault() {
+		return false, fmt.Errorf("cannot tell if project %q was moved in GitLab: "+
+			"it has no Git URL to compare with, and its provider has naming rules",
+			joinProjectPath(proj.GroupName, proj.Name))
+	}
+	groupName, projectName := names.mapNames(gitLabProject)
+	return joinProjectPath(proj.GroupName, proj.Name) != joinProjectPath(groupName, projectName), nil
+}
+
+func joinProjectPath(groupName, projectName string) string {
+	if groupName == "" {
+		return projectName
+	}
+	return groupName + "/" + projectName
+}
+
+// getBuildDefinition fetches the build definition file of the project. The
+// path it was last found at is tried first, followed by the configured paths,
+// and the path it is found at is saved for the next time. If there is no file
+// and one is generated instead, the generated build definition is saved and
+// reused until a file is added, so the repository tree is only listed once.
+func (importer gitLabImporter) getBuildDefinition(ctx context.Context, gitLabProject *gitlab.Project) (buildDefinitionFile, error) {
+	if gitLabProject.EmptyRepo {
+		log.Debug().
+			WithInt("gitLabProjectId", gitLabProject.ID).
+			Message("Repository is empty, importing project without build definition.")
+		return buildDefinitionFile{}, nil
+	}
+	key := projectStateKey(importer.mapper.providerID, gitLabProject.ID)
+	state, _, err := importer.projectStates.load(key)
+	if err != nil {
+		log.Warn().
+			WithError(err).
+			WithString("projectState", key).
+			Message("Failed to load project state, looking for build definition in configured paths.")
+	}
+
+	ref := importer.defaultBranch(gitLabProject)
+	paths := importer.buildDefinitionPathsFor(state.BuildDefinitionPath)
+	buildDef, err := importer.gitLabClient.getBuildDefinitionIfExists(ctx, gitLabProject.ID, ref, paths)
+	if err != nil {
+		return buildDefinitionFile{}, err
+	}
+	importer.expandBuildDefinition(ctx, gitLabProject, ref, &buildDef)
+	if buildDef.Path == "" && importer.generateMissingBuildDefinitions {
+		if state.GeneratedBuildDefinition != "" {
+			buildDef.Content = state.GeneratedBuildDefinition
+			buildDef.Generated = true
+		} else {
+			importer.generateMissingBuildDefinition(ctx, gitLabProject, &buildDef)
+		}
+	}
+	importer.validateBuildDefinition(gitLabProject, ref, &buildDef)
+
+	var generated string
+	if buildDef.Generated {
+		generated = buildDef.Content
+	}
+	if buildDef.Path != state.BuildDefinitionPath || generated != state.GeneratedBuildDefinition {
+		log.Debug().
+			WithInt("gitLabProjectId", gitLabProject.ID).
+			WithString("oldPath", state.BuildDefinitionPath).
+			WithString("newPath", buildDef.Path).
+			WithBool("generated", buildDef.Generated).
+			Message("Build definition changed.")
+		state.BuildDefinitionPath = buildDef.Path
+		state.GeneratedBuildDefinition = generated
+		if err := importer.projectStates.save(key, state); err != nil {
+			log.Warn().WithError(err).WithString("projectState", key).Message("Failed to save project state.")
+		}
+	}
+	return buildDef, nil
+}
+
+// generateMissingBuildDefinition sets the build definition to one generated
+// from the files in the repository. A failure to generate it is only logged,
+// as the project can still be imported without a build definition.
+func (importer gitLabImporter) generateMissingBuildDefinition(ctx context.Context, gitLabProject *gitlab.Project, buildDef *buildDefinitionFile) {
+	suggestion, err := importer.suggestBuildDefinition(ctx, gitLabProject, importer.defaultBranch(gitLabProject))
+	if err != nil {
+		log.Warn().
+			WithError(err).
+			WithInt("gitLabProjectId", gitLabProject.ID).
+			Message("Failed to generate build definition, importing project without one.")
+		return
+	}
+	if suggestion.Content == "" {
+		return
+	}
+	log.Debug().
+		WithInt("gitLabProjectId", gitLabProject.ID).
+		WithStringf("detected", "%q", suggestion.Detected).
+		Message("Generated build definition.")
+	buildDef.Content = suggestion.Content
+	buildDef.Generated = true
+}
+
+// buildDefinitionPathsFor returns the configured build definition paths, with
+// the path the build definition was last found at first.
+func (importer gitLabImporter) buildDefinitionPathsFor(savedPath string) []string {
+	paths := importer.buildDefinitionPaths
+	if len(paths) == 0 {
+		paths = []string{BuildDefinitionFileName}
+	}
+	if savedPath != "" && savedPath != paths[0] {
+		paths = append([]string{savedPath}, removeString(paths, savedPath)...)
+	}
+	return paths
+}
+
+// lintProjectBuildDefinition fetches the build definition of a project at the
+// given ref and lints it. The ref defaults to the project's default branch,
+// and the path to the configured build definition paths. Nothing is saved, as
+// the ref may not be the one that is imported.
+func (importer gitLabImporter) lintProjectBuildDefinition(ctx context.Context, project, ref, path string) (BuildDefinitionLintResult, bool, error) {
+	gitLabProject, err := importer.getGitLabProjectByPathOrID(ctx, project)
+	if err != nil {
+		return BuildDefinitionLintResult{}, false, err
+	}
+	if ref == "" {
+		ref = importer.defaultBranch(gitLabProject)
+	}
+	if gitLabProject.EmptyRepo {
+		return BuildDefinitionLintResult{Ref: ref}, false, nil
+	}
+	paths := importer.buildDefinitionPaths
+	if path != "" {
+		paths = []string{path}
+	} else if len(paths) == 0 {
+		paths = []string{BuildDefinitionFileName}
+	}
+
+	buildDef, err := importer.gitLabClient.getBuildDefinitionIfExists(ctx, gitLabProject.ID, ref, paths)
+	if err != nil {
+		return BuildDefinitionLintResult{}, false, err
+	}
+	if buildDef.Path == "" {
+		return BuildDefinitionLintResult{Ref: ref}, false, nil
+	}
+	importer.expandBuildDefinition(ctx, gitLabProject, ref, &buildDef)
+	result := newBuildDefinitionLintResult(append(buildDef.Diagnostics, buildDef.lint()...))
+	result.Path = buildDef.Path
+	result.Ref = ref
+	return result, true, nil
+}
+
+// expandBuildDefinition merges the files included by the build definition into
+// it, if includes are enabled, and adds the problems found when resolving
+// them. Files may only be included from the project itself, or from other
+// projects imported using the same provider.
+func (importer gitLabImporter) expandBuildDefinition(ctx context.Context, gitLabProject *gitlab.Project, ref string, buildDef *buildDefinitionFile) {
+	if importer.includeMaxDepth <= 0 || buildDef.Path == "" {
+		return
+	}
+	self := buildDefinitionInclude{Project: gitLabProject.PathWithNamespace, Ref: ref, File: buildDef.Path}
+	expansion := expandBuildDefinitionIncludes(ctx, importer.gitLabClient, importer.includeMaxDepth, self, buildDef.Content, importer.isProjectPathImported)
+	buildDef.Content = expansion.Content
+	buildDef.Diagnostics = append(buildDef.Diagnostics, expansion.Diagnostics...)
+	buildDef.expansion = &expansion
 }
 
-func (importer gitLabImporter) postProject(gitLabProject gitlab.Project) (response.Project, error) {
-	buildDef, err := importer.gitLabClient.getBuildDefinitionIfExists(gitLabProject.ID, gitLabProject.DefaultBranch)
+// isProjectPathImported returns true if the GitLab project with the path is
+// imported into Wharf using the importer's provider.
+func (importer gitLabImporter) isProjectPathImported(ctx context.Context, projectPath string) (bool, error) {
+	gitLabProject, err := importer.getGitLabProjectByPathOrID(ctx, projectPath)
 	if err != nil {
-		return response.Project{}, err
+		return false, err
+	}
+	_, imported, err := importer.findImportedProject(ctx, gitLabProject)
+	return imported, err
+}
+
+// validateBuildDefinition adds the problems found in the build definition to
+// it, and rejects it if it has errors and invalid build definitions are not
+// to be stored. This includes generated build definitions.
+func (importer gitLabImporter) validateBuildDefinition(gitLabProject *gitlab.Project, ref string, buildDef *buildDefinitionFile) {
+	if buildDef.Path == "" && !buildDef.Generated {
+		return
+	}
+	buildDef.Diagnostics = append(buildDef.Diagnostics, buildDef.lint()...)
+	if !hasBuildDefinitionErrors(buildDef.Diagnostics) {
+		return
 	}
+	buildDef.Rejected = importer.rejectInvalidBuildDefinitions
+	log.Warn().
+		WithInt("gitLabProjectId", gitLabProject.ID).
+		WithString("gitLabProject", gitLabProject.PathWithNamespace).
+		WithString("ref", ref).
+		WithString("path", buildDef.Path).
+		WithBool("generated", buildDef.Generated).
+		WithInt("problems", len(buildDef.Diagnostics)).
+		WithBool("rejected", buildDef.Rejected).
+		Message("Build definition is invalid.")
+}
 
-	wharfProject := importer.mapper.mapProjectToWharfEntity(gitLabProject, buildDef)
+func removeString(values []string, value string) []string {
+	var result []string
+	for _, v := range values {
+		if v != value {
+			result = append(result, v)
+		}
+	}
+	return result
+}
 
-	dbProject, err := importer.wharfClient.CreateProject(wharfProject)
+func (importer gitLabImporter) postProject(ctx context.Context, gitLabProject gitlab.Project) (response.Project, buildDefinitionFile, error) {
+	buildDef, err := importer.getBuildDefinition(ctx, &gitLabProject)
+	if err != nil {
+		return response.Project{}, buildDef, err
+	}
+
+	buildDefContent := buildDef.Content
+	if buildDef.Rejected {
+		buildDefContent = ""
+	}
+	wharfProject := importer.mapper.mapProjectToWharfEntity(gitLabProject, buildDefContent)
+
+	dbProject, err := importer.wharfClient.CreateProject(ctx, wharfProject)
 	if err != nil {
 		log.Error().WithError(err).Message("Unable to create project.")
-		return response.Project{}, err
+		return response.Project{}, buildDef, err
 	}
 
-	return dbProject, nil
+	return dbProject, buildDef, nil
 }
 
-func (importer gitLabImporter) importBranches(wharfProjectID uint, gitLabProjectID int) error {
+func (importer gitLabImporter) importBranches(ctx context.Context, wharfProjectID uint, gitLabProject *gitlab.Project) error {
+	gitLabProjectID := gitLabProject.ID
 	errMessage := ""
-	page := 0
-	for page >= 0 {
-		branches, paging, err := importer.gitLabClient.getBranches(gitLabProjectID, page)
+	branchBuildDefs := importer.newBranchBuildDefinitionFetcher(wharfProjectID, gitLabProject)
+	var branchMetadata []BranchMetadata
+	branchNames := make(map[string]bool)
+	// An empty repository has no branches to list.
+	cursor, hasMore := gitLabPageCursor{}, !gitLabProject.EmptyRepo
+	for hasMore {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		branches, paging, err := importer.gitLabClient.getBranches(ctx, gitLabProjectID, cursor)
 		if err != nil {
 			log.Error().WithError(err).Message("Failed to get branches.")
 			return err
@@ -375,16 +1540,39 @@ func (importer gitLabImporter) importBranches(wharfProjectID uint, gitLabProject
 
 		for _, branch := range branches {
 			b := importer.mapper.mapBranchToWharfEntity(*branch)
-			_, err := importer.wharfClient.CreateProjectBranch(wharfProjectID, b)
+			_, err := importer.wharfClient.CreateProjectBranch(ctx, wharfProjectID, b)
 			if err != nil {
 				log.Error().WithError(err).Message("Failed to reset branches.")
 				errMessage += err.Error()
 			}
+			branchBuildDefs.fetch(ctx, branch)
+			branchMetadata = append(branchMetadata, importer.mapper.mapBranchMetadata(*branch))
+			branchNames[branch.Name] = true
 		}
+		importer.job.emit(ImportEvent{
+			Type:            importEventBranchesSynced,
+			GitLabProjectID: gitLabProjectID,
+			WharfProjectID:  wharfProjectID,
+			Page:            paging.currentPage,
+			Count:           len(branches),
+		})
 
-		page = paging.next()
+		cursor, hasMore = paging.next()
 	}
 
+	tags, err := importer.getTagsToImport(ctx, gitLabProject, branchNames)
+	if err != nil {
+		errMessage += err.Error()
+	}
+	for _, tag := range tags {
+		if _, err := importer.wharfClient.CreateProjectBranch(ctx, wharfProjectID, tag); err != nil {
+			log.Error().WithError(err).WithString("tag", tag.Name).Message("Failed to import tag.")
+			errMessage += err.Error()
+		}
+	}
+
+	branchBuildDefs.save()
+	importer.saveBranchMetadata(wharfProjectID, branchMetadata)
 	if errMessage != "" {
 		return fmt.Errorf(errMessage)
 	}
@@ -392,11 +1580,19 @@ func (importer gitLabImporter) importBranches(wharfProjectID uint, gitLabProject
 	return nil
 }
 
-func (importer gitLabImporter) refreshBranches(wharfProjectID uint, gitLabProjectID int) error {
-	page := 0
+func (importer gitLabImporter) refreshBranches(ctx context.Context, wharfProjectID uint, gitLabProject *gitlab.Project) error {
+	gitLabProjectID := gitLabProject.ID
+	branchBuildDefs := importer.newBranchBuildDefinitionFetcher(wharfProjectID, gitLabProject)
+	// An empty repository has no branches to list.
+	cursor, hasMore := gitLabPageCursor{}, !gitLabProject.EmptyRepo
 	var allBranches []request.Branch
-	for page >= 0 {
-		branches, paging, err := importer.gitLabClient.getBranches(gitLabProjectID, page)
+	var branchMetadata []BranchMetadata
+	branchNames := make(map[string]bool)
+	for hasMore {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		branches, paging, err := importer.gitLabClient.getBranches(ctx, gitLabProjectID, cursor)
 		if err != nil {
 			log.Error().WithError(err).Message("Failed to get branches.")
 			return err
@@ -404,11 +1600,33 @@ func (importer gitLabImporter) refreshBranches(wharfProjectID uint, gitLabProjec
 
 		for _, branch := range branches {
 			allBranches = append(allBranches, importer.mapper.mapBranchToWharfEntity(*branch))
+			branchBuildDefs.fetch(ctx, branch)
+			branchMetadata = append(branchMetadata, importer.mapper.mapBranchMetadata(*branch))
+			branchNames[branch.Name] = true
 		}
 
-		page = paging.next()
+		cursor, hasMore = paging.next()
 	}
 
-	_, err := importer.wharfClient.UpdateProjectBranchList(wharfProjectID, allBranches)
-	return err
+	// Failing to get the tags fails the whole refresh, as updating the
+	// branch list without them would remove the tags imported before.
+	tags, err := importer.getTagsToImport(ctx, gitLabProject, branchNames)
+	if err != nil {
+		return err
+	}
+	allBranches = append(allBranches, tags...)
+
+	_, err = importer.wharfClient.UpdateProjectBranchList(ctx, wharfProjectID, allBranches)
+	if err != nil {
+		return err
+	}
+	branchBuildDefs.save()
+	importer.saveBranchMetadata(wharfProjectID, branchMetadata)
+	importer.job.emit(ImportEvent{
+		Type:            importEventBranchesSynced,
+		GitLabProjectID: gitLabProjectID,
+		WharfProjectID:  wharfProjectID,
+		Count:           len(allBranches),
+	})
+	return nil
 }
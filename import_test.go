@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"reflect"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/request"
 	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/response"
@@ -18,6 +20,21 @@ import (
 	"github.com/xanzy/go-gitlab"
 )
 
+const movedWharfProjectID uint = 9001
+
+var userNamespaceProject = &gitlab.Project{
+	ID:                500,
+	Name:              "deploy-tools",
+	PathWithNamespace: "jsmith/deploy-tools",
+	Namespace: &gitlab.ProjectNamespace{
+		ID:       12,
+		Name:     "jsmith",
+		Path:     "jsmith",
+		Kind:     "user",
+		FullPath: "jsmith",
+	},
+}
+
 type importTestSuite struct {
 	suite.Suite
 	data Import
@@ -38,24 +55,30 @@ func (suite *importTestSuite) SetupSuite() {
 	defaultGroupGitLabProjects := readProjectsFromFile(suite.T(), "testdata/groups/default_9/projects.json")
 
 	gitLabMock := new(gitLabClientMock)
-	gitLabMock.On("listProjects", 0).Return(allProjects, getSampleGitLabPaging(len(allProjects)), nil)
-	gitLabMock.On("listProjectsFromGroup", spGroupGitLabProjects[0].Namespace.FullPath, 0).
+	gitLabMock.On("listProjects", gitLabProjectFilter{}, gitLabPageCursor{}).Return(allProjects, getSampleGitLabPaging(len(allProjects)), nil)
+	gitLabMock.On("listProjectsFromGroup", spGroupGitLabProjects[0].Namespace.FullPath, gitLabProjectFilter{}, gitLabPageCursor{}).
 		Return(spGroupGitLabProjects, getSampleGitLabPaging(len(spGroupGitLabProjects)), nil)
-	gitLabMock.On("listProjectsFromGroup", mushroomGroupGitLabProjects[0].Namespace.FullPath, 0).
+	gitLabMock.On("listProjectsFromGroup", mushroomGroupGitLabProjects[0].Namespace.FullPath, gitLabProjectFilter{}, gitLabPageCursor{}).
 		Return(mushroomGroupGitLabProjects, getSampleGitLabPaging(len(mushroomGroupGitLabProjects)), nil)
-	gitLabMock.On("listProjectsFromGroup", defaultGroupGitLabProjects[0].Namespace.FullPath, 0).
+	gitLabMock.On("listProjectsFromGroup", defaultGroupGitLabProjects[0].Namespace.FullPath, gitLabProjectFilter{}, gitLabPageCursor{}).
 		Return(defaultGroupGitLabProjects, getSampleGitLabPaging(len(defaultGroupGitLabProjects)), nil)
+	gitLabMock.On("getNamespace", userNamespaceProject.Namespace.FullPath).
+		Return(&gitlab.Namespace{Kind: "user", FullPath: userNamespaceProject.Namespace.FullPath}, nil)
+	gitLabMock.On("getNamespace", mock.AnythingOfType("string")).Return(&gitlab.Namespace{Kind: "group"}, nil)
+	gitLabMock.On("listUserProjects", userNamespaceProject.Namespace.FullPath, gitLabProjectFilter{}, gitLabPageCursor{}).
+		Return([]*gitlab.Project{userNamespaceProject}, getSampleGitLabPaging(1), nil)
 	for _, p := range allProjects {
 		newProj := *p
 		gitLabMock.On("getProject", p.Namespace.FullPath, p.Name).Return(&newProj, nil)
+		gitLabMock.On("getProjectByID", p.ID).Return(&newProj, nil)
 	}
 
 	gitLabMock.
-		On("getBuildDefinitionIfExists", mock.AnythingOfType("int"), mock.AnythingOfType("string")).
-		Return("", nil)
+		On("getBuildDefinitionIfExists", mock.AnythingOfType("int"), mock.AnythingOfType("string"), []string{BuildDefinitionFileName}).
+		Return(buildDefinitionFile{}, nil)
 
 	gitLabMock.
-		On("getBranches", mock.AnythingOfType("int"), 0).
+		On("getBranches", mock.AnythingOfType("int"), gitLabPageCursor{}).
 		Return([]*gitlab.Branch{{
 			Name:               "master",
 			CanPush:            true,
@@ -112,6 +135,28 @@ func (suite *importTestSuite) SetupSuite() {
 			Return([]response.Branch{}, nil)
 	}
 
+	wharfClientMock.On("CreateProject", mock.MatchedBy(func(proj request.Project) bool {
+		return proj.GroupName == userNamespaceProject.Namespace.FullPath
+	})).Return(response.Project{
+		ProjectID: uint(userNamespaceProject.ID),
+		GroupName: userNamespaceProject.Namespace.FullPath,
+		Name:      userNamespaceProject.Name,
+	}, nil)
+
+	movedProject := allProjects[0]
+	wharfClientMock.On("GetProject", movedWharfProjectID).Return(response.Project{
+		ProjectID:       movedWharfProjectID,
+		GroupName:       "old-group",
+		Name:            "old-name",
+		RemoteProjectID: strconv.Itoa(movedProject.ID),
+	}, nil)
+	wharfClientMock.
+		On("UpdateProject", movedWharfProjectID, anyOfType(request.ProjectUpdate{})).
+		Return(response.Project{}, nil)
+	wharfClientMock.
+		On("UpdateProjectBranchList", movedWharfProjectID, anyOfType([]request.Branch{})).
+		Return([]response.Branch{}, nil)
+
 	wharfClientMock.On("GetProject", nonExistentProjectID).Return(response.Project{}, errors.New("project with matching ID not found"))
 	wharfClientMock.
 		On("UpdateProject", nonExistentProjectID, anyOfType(request.ProjectUpdate{})).
@@ -126,7 +171,7 @@ func (suite *importTestSuite) SetupSuite() {
 	suite.sut = gitLabImporter{
 		gitLabClient: gitLabMock,
 		wharfClient:  wharfClientMock,
-		mapper:       mapper{suite.data.TokenID, suite.data.ProviderID},
+		mapper:       mapper{tokenID: suite.data.TokenID, providerID: suite.data.ProviderID},
 	}
 }
 
@@ -143,7 +188,7 @@ func (suite *importTestSuite) TestImportProject() {
 	suite.data.Group = wantGroup
 	suite.data.Project = wantProject
 
-	err := suite.sut.importProject(wantGroup, wantProject)
+	err := suite.sut.importProject(context.Background(), wantGroup, wantProject)
 
 	require.Nilf(suite.T(), err, "Import return error: %v", err)
 
@@ -159,7 +204,7 @@ func (suite *importTestSuite) TestImportGroup() {
 	suite.data.Project = ""
 	suite.data.Group = want
 
-	err := suite.sut.importGroup(want)
+	err := suite.sut.importGroup(context.Background(), want, false)
 	require.Nilf(suite.T(), err, "Import return error: %v", err)
 
 	apiMock := suite.sut.wharfClient.(*testdoubles.WharfClientAPIFetcherMock)
@@ -169,11 +214,26 @@ func (suite *importTestSuite) TestImportGroup() {
 	apiMock.AssertCalled(suite.T(), "CreateProject", mock.MatchedBy(func(p request.Project) bool { return p.Name == "docs" }))
 }
 
+func (suite *importTestSuite) TestImportUserNamespace() {
+	err := suite.sut.importGroup(context.Background(), "jsmith", false)
+	require.Nilf(suite.T(), err, "Import return error: %v", err)
+
+	gitlabMock := suite.sut.gitLabClient.(*gitLabClientMock)
+	gitlabMock.AssertNumberOfCalls(suite.T(), "listUserProjects", 1)
+	gitlabMock.AssertNumberOfCalls(suite.T(), "listProjectsFromGroup", 0)
+
+	apiMock := suite.sut.wharfClient.(*testdoubles.WharfClientAPIFetcherMock)
+	apiMock.AssertNumberOfCalls(suite.T(), "CreateProject", 1)
+	apiMock.AssertCalled(suite.T(), "CreateProject", mock.MatchedBy(func(p request.Project) bool {
+		return p.GroupName == "jsmith" && p.Name == "deploy-tools"
+	}))
+}
+
 func (suite *importTestSuite) TestImportAll() {
 	suite.data.Project = ""
 	suite.data.Group = ""
 
-	err := suite.sut.importAll()
+	err := suite.sut.importAll(context.Background(), false)
 	require.Nilf(suite.T(), err, "Import return error: %v", err)
 
 	apiMock := suite.sut.wharfClient.(*testdoubles.WharfClientAPIFetcherMock)
@@ -186,11 +246,35 @@ func (suite *importTestSuite) TestImportAll() {
 	apiMock.AssertCalled(suite.T(), "CreateProject", mock.MatchedBy(func(p request.Project) bool { return p.Name == "Boletus" }))
 }
 
+func (suite *importTestSuite) TestImportBulk() {
+	result := suite.sut.importBulk(context.Background(), []string{"default/super-project/builder", "225", "no-group"})
+
+	assert.Equal(suite.T(), 2, result.Imported)
+	assert.Equal(suite.T(), 1, result.Failed)
+	require.Len(suite.T(), result.Projects, 3)
+
+	assert.True(suite.T(), result.Projects[0].Imported)
+	assert.Equal(suite.T(), 252, result.Projects[0].GitLabProjectID)
+	assert.Equal(suite.T(), uint(252), result.Projects[0].WharfProjectID)
+	assert.True(suite.T(), result.Projects[1].Imported)
+	assert.Equal(suite.T(), "default/super-project/docs", result.Projects[1].Path)
+	assert.False(suite.T(), result.Projects[2].Imported)
+	assert.NotEmpty(suite.T(), result.Projects[2].Error)
+
+	gitlabMock := suite.sut.gitLabClient.(*gitLabClientMock)
+	gitlabMock.AssertCalled(suite.T(), "getProject", "default/super-project", "builder")
+	gitlabMock.AssertCalled(suite.T(), "getProjectByID", 225)
+
+	apiMock := suite.sut.wharfClient.(*testdoubles.WharfClientAPIFetcherMock)
+	apiMock.AssertNumberOfCalls(suite.T(), "CreateProject", 2)
+}
+
 func (suite *importTestSuite) TestRefreshProjectSuccess() {
 	suite.data = getTestImport()
 
-	err := suite.sut.refreshProject(suite.data.TokenID, suite.data.ProviderID, suite.data.ProjectID)
+	result, err := suite.sut.refreshProject(context.Background(), suite.data.TokenID, suite.data.ProviderID, suite.data.ProjectID)
 	require.Nilf(suite.T(), err, "Refresh return error: %v", err)
+	assert.False(suite.T(), result.Moved)
 
 	apiMock := suite.sut.wharfClient.(*testdoubles.WharfClientAPIFetcherMock)
 	apiMock.AssertNumberOfCalls(suite.T(), "GetProject", 1)
@@ -198,15 +282,31 @@ func (suite *importTestSuite) TestRefreshProjectSuccess() {
 	apiMock.AssertNumberOfCalls(suite.T(), "UpdateProjectBranchList", 1)
 
 	gitlabMock := suite.sut.gitLabClient.(*gitLabClientMock)
-	gitlabMock.AssertNumberOfCalls(suite.T(), "getProject", 1)
+	gitlabMock.AssertNumberOfCalls(suite.T(), "getProjectByID", 1)
+	gitlabMock.AssertNumberOfCalls(suite.T(), "getProject", 0)
 	gitlabMock.AssertNumberOfCalls(suite.T(), "getBuildDefinitionIfExists", 1)
 	gitlabMock.AssertNumberOfCalls(suite.T(), "getBranches", 1)
 }
 
+func (suite *importTestSuite) TestRefreshProjectMoved() {
+	result, err := suite.sut.refreshProject(context.Background(), suite.data.TokenID, suite.data.ProviderID, movedWharfProjectID)
+	require.Nilf(suite.T(), err, "Refresh return error: %v", err)
+
+	assert.True(suite.T(), result.Moved)
+	assert.Equal(suite.T(), "old-group/old-name", result.OldPath)
+	assert.Equal(suite.T(), "default/super-project/web", result.NewPath)
+
+	apiMock := suite.sut.wharfClient.(*testdoubles.WharfClientAPIFetcherMock)
+	apiMock.AssertNumberOfCalls(suite.T(), "CreateProject", 0)
+	apiMock.AssertCalled(suite.T(), "UpdateProject", movedWharfProjectID, mock.MatchedBy(func(p request.ProjectUpdate) bool {
+		return p.GroupName == "default/super-project" && p.Name == "web"
+	}))
+}
+
 func (suite *importTestSuite) TestRefreshProjectFail() {
 	suite.data = getTestImportWithNonExistentProjectID()
 
-	err := suite.sut.refreshProject(suite.data.TokenID, suite.data.ProviderID, suite.data.ProjectID)
+	_, err := suite.sut.refreshProject(context.Background(), suite.data.TokenID, suite.data.ProviderID, suite.data.ProjectID)
 	require.Errorf(suite.T(), err, "Refresh return error: %v", err)
 
 	apiMock := suite.sut.wharfClient.(*testdoubles.WharfClientAPIFetcherMock)
@@ -329,3 +429,150 @@ func TestFindProviderByTokenID(t *testing.T) {
 		})
 	}
 }
+
+func TestSyncProjectsOnlyActive(t *testing.T) {
+	firstSync := time.Date(2022, 5, 10, 2, 30, 0, 0, time.UTC)
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getNamespace", "default").Return(&gitlab.Namespace{Kind: "group"}, nil)
+	gitLabMock.
+		On("listProjectsFromGroup", "default", gitLabProjectFilter{}, gitLabPageCursor{}).
+		Return([]*gitlab.Project{}, gitLabPaging{}, nil).Once()
+	gitLabMock.
+		On("listProjectsFromGroup", "default", gitLabProjectFilter{LastActivityAfter: &firstSync}, gitLabPageCursor{}).
+		Return([]*gitlab.Project{}, gitLabPaging{}, nil).Once()
+
+	syncStates := newJSONStore[syncState](t.TempDir())
+	newImporter := func(now time.Time) *gitLabImporter {
+		return &gitLabImporter{
+			gitLabClient: gitLabMock,
+			wharfClient:  new(testdoubles.WharfClientAPIFetcherMock),
+			mapper:       mapper{tokenID: 2, providerID: 1},
+			syncStates:   syncStates,
+			currentTime:  func() time.Time { return now },
+		}
+	}
+	i := Import{Group: "default", OnlyActive: true}
+
+	_, err := newImporter(firstSync).runImport(context.Background(), i)
+	require.NoError(t, err, "first sync")
+	_, err = newImporter(firstSync.Add(24*time.Hour)).runImport(context.Background(), i)
+	require.NoError(t, err, "second sync")
+
+	gitLabMock.AssertExpectations(t)
+}
+
+func TestRefreshProjectSkipsUnchangedProject(t *testing.T) {
+	gitLabProject := &gitlab.Project{
+		ID:            84,
+		Name:          "web",
+		DefaultBranch: "main",
+		SSHURLToRepo:  "git@gitlab.local:default/web.git",
+		Namespace:     &gitlab.ProjectNamespace{FullPath: "default"},
+	}
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getProjectByID", 84).Return(gitLabProject, nil)
+	gitLabMock.On("getBuildDefinitionIfExists", 84, "main", []string{BuildDefinitionFileName}).
+		Return(buildDefinitionFile{Path: BuildDefinitionFileName, Content: validBuildDefinition}, nil)
+	gitLabMock.On("getBranches", 84, gitLabPageCursor{}).Return([]*gitlab.Branch{}, gitLabPaging{}, nil)
+
+	wharfMock := new(testdoubles.WharfClientAPIFetcherMock)
+	wharfMock.On("GetProject", uint(1)).Return(response.Project{
+		ProjectID:       1,
+		RemoteProjectID: "84",
+		Name:            "web",
+		GroupName:       "default",
+		GitURL:          "git@gitlab.local:default/web.git",
+		TokenID:         2,
+		ProviderID:      1,
+		BuildDefinition: validBuildDefinition,
+	}, nil)
+	wharfMock.On("UpdateProjectBranchList", uint(1), mock.Anything).Return([]response.Branch{}, nil)
+
+	importer := gitLabImporter{
+		gitLabClient: gitLabMock,
+		wharfClient:  wharfMock,
+		mapper:       mapper{tokenID: 2, providerID: 1},
+	}
+	result, err := importer.refreshProject(context.Background(), 2, 1, 1)
+	require.NoError(t, err)
+	assert.True(t, result.Unchanged)
+	wharfMock.AssertNotCalled(t, "UpdateProject", mock.Anything, mock.Anything)
+}
+
+func TestRefreshProjectFailsWhenBranchesFail(t *testing.T) {
+	gitLabProject := &gitlab.Project{
+		ID:            84,
+		Name:          "web",
+		DefaultBranch: "main",
+		Namespace:     &gitlab.ProjectNamespace{FullPath: "default"},
+	}
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getProjectByID", 84).Return(gitLabProject, nil)
+	gitLabMock.On("getBuildDefinitionIfExists", 84, "main", []string{BuildDefinitionFileName}).
+		Return(buildDefinitionFile{}, nil)
+	gitLabMock.On("getBranches", 84, gitLabPageCursor{}).
+		Return([]*gitlab.Branch{}, gitLabPaging{}, errors.New("502 Bad Gateway"))
+
+	wharfMock := new(testdoubles.WharfClientAPIFetcherMock)
+	wharfMock.On("GetProject", uint(1)).Return(response.Project{ProjectID: 1, RemoteProjectID: "84"}, nil)
+	wharfMock.On("UpdateProject", uint(1), mock.Anything).Return(response.Project{ProjectID: 1}, nil)
+
+	importer := gitLabImporter{
+		gitLabClient: gitLabMock,
+		wharfClient:  wharfMock,
+		mapper:       mapper{tokenID: 2, providerID: 1},
+	}
+	_, err := importer.refreshProject(context.Background(), 2, 1, 1)
+	assert.Error(t, err)
+}
+
+func TestImportBulkEmptyRepository(t *testing.T) {
+	gitLabProject := &gitlab.Project{
+		ID:                84,
+		Name:              "web",
+		PathWithNamespace: "default/web",
+		Namespace:         &gitlab.ProjectNamespace{FullPath: "default"},
+		EmptyRepo:         true,
+	}
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getProjectByID", 84).Return(gitLabProject, nil)
+
+	wharfMock := new(testdoubles.WharfClientAPIFetcherMock)
+	wharfMock.On("CreateProject", mock.MatchedBy(func(proj request.Project) bool {
+		return proj.Name == "web" && proj.BuildDefinition == ""
+	})).Return(response.Project{ProjectID: 1, Name: "web", GroupName: "default"}, nil)
+
+	jobs := newImportJobRegistry()
+	job, _ := jobs.start("")
+	importer := gitLabImporter{
+		gitLabClient: gitLabMock,
+		wharfClient:  wharfMock,
+		mapper:       mapper{tokenID: 2, providerID: 1},
+		job:          job,
+	}
+	result := importer.importBulk(context.Background(), []string{"84"})
+	require.Len(t, result.Projects, 1)
+	assert.True(t, result.Projects[0].Imported)
+	assert.True(t, result.Projects[0].EmptyRepository)
+	history, _, unsubscribe := job.subscribe()
+	unsubscribe()
+	require.NotEmpty(t, history)
+	finished := history[len(history)-1]
+	assert.Equal(t, importEventProjectFinished, finished.Type)
+	assert.True(t, finished.EmptyRepository)
+	gitLabMock.AssertNotCalled(t, "getBuildDefinitionIfExists", mock.Anything, mock.Anything, mock.Anything)
+	gitLabMock.AssertNotCalled(t, "getBranches", mock.Anything, mock.Anything)
+	wharfMock.AssertNotCalled(t, "CreateProjectBranch", mock.Anything, mock.Anything)
+}
+
+func TestGetBuildDefinitionUsesFallbackDefaultBranch(t *testing.T) {
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getBuildDefinitionIfExists", 84, "main", []string{BuildDefinitionFileName}).
+		Return(buildDefinitionFile{Path: BuildDefinitionFileName, Content: validBuildDefinition}, nil)
+
+	importer := gitLabImporter{gitLabClient: gitLabMock, fallbackDefaultBranch: "main"}
+	buildDef, err := importer.getBuildDefinition(context.Background(), &gitlab.Project{ID: 84})
+	require.NoError(t, err)
+	assert.Equal(t, validBuildDefinition, buildDef.Content)
+	gitLabMock.AssertExpectations(t)
+}
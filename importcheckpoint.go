@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// importCheckpoint is the progress of a group or instance-wide import. It is
+// saved after each page of projects so that an interrupted import can be
+// resumed.
+type importCheckpoint struct {
+	// Cursor points at the last page of projects that was handled. Resuming
+	// starts by fetching this page again, as projects may have shifted between
+	// pages since the checkpoint was saved. It is reset once the last page is
+	// handled.
+	Cursor gitLabPageCursor `json:"cursor"`
+	// LastProjectID is the ID of the last GitLab project that was handled.
+	// Projects are listed in ascending ID order, so all projects with an ID
+	// less than or equal to this one are skipped when resuming.
+	LastProjectID int             `json:"lastProjectId"`
+	Failed        []importFailure `json:"failed"`
+	UpdatedAt     time.Time       `json:"updatedAt"`
+}
+
+// importFailure is a GitLab project that failed to be imported.
+type importFailure struct {
+	GitLabProjectID int    `json:"gitLabProjectId"`
+	Path            string `json:"path"`
+	Error           string `json:"error"`
+}
+
+func (f importFailure) String() string {
+	return fmt.Sprintf("proj: %s (%d) err: %s", f.Path, f.GitLabProjectID, f.Error)
+}
+
+func newImportFailure(project *gitlab.Project, err error) importFailure {
+	return importFailure{
+		GitLabProjectID: project.ID,
+		Path:            project.PathWithNamespace,
+		Error:           err.Error(),
+	}
+}
+
+func importFailuresError(failures []importFailure) error {
+	if len(failures) == 0 {
+		return nil
+	}
+	var sb strings.Builder
+	for _, f := range failures {
+		sb.WriteString(f.String())
+		sb.WriteString(" \n")
+	}
+	return errors.New(sb.String())
+}
+
+// importCheckpointKey returns the file-safe name of the checkpoint for an
+// import of a given scope, such as a group name, from a given provider. An
+// empty scope means all projects. Imports with different filters list
+// different projects, so they get different checkpoints.
+func importCheckpointKey(providerID uint, scope string, filter gitLabProjectFilter) string {
+	key := fmt.Sprintf("provider-%d-all", providerID)
+	if scope != "" {
+		key = fmt.Sprintf("provider-%d-group-%s", providerID, url.PathEscape(scope))
+	}
+	if filterKey := filter.key(); filterKey != "" {
+		// GitLab paths cannot contain "@", so this cannot be mistaken for
+		// a part of the group name.
+		key += "@" + filterKey
+	}
+	return key
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestImportCheckpointStore(t *testing.T) {
+	store := newJSONStore[importCheckpoint](t.TempDir())
+	key := importCheckpointKey(1, "default/super-project", gitLabProjectFilter{})
+
+	_, ok, err := store.load(key)
+	require.NoError(t, err)
+	assert.False(t, ok, "loaded checkpoint before saving it")
+
+	want := importCheckpoint{
+		Cursor:        gitLabPageCursor{NextQuery: "id_after=267&pagination=keyset"},
+		LastProjectID: 267,
+		Failed:        []importFailure{{GitLabProjectID: 84, Path: "default/web", Error: "502 Bad Gateway"}},
+	}
+	require.NoError(t, store.save(key, want))
+
+	got, ok, err := store.load(key)
+	require.NoError(t, err)
+	require.True(t, ok, "did not find saved checkpoint")
+	assert.Equal(t, want.Cursor, got.Cursor)
+	assert.Equal(t, want.LastProjectID, got.LastProjectID)
+	assert.Equal(t, want.Failed, got.Failed)
+
+	require.NoError(t, store.remove(key))
+	_, ok, err = store.load(key)
+	require.NoError(t, err)
+	assert.False(t, ok, "loaded checkpoint after removing it")
+}
+
+func TestImportPaginatedProjectsResumesFromCheckpoint(t *testing.T) {
+	pages := map[int][]*gitlab.Project{
+		1: {{ID: 1}, {ID: 2}},
+		2: {{ID: 3}, {ID: 4}},
+		3: {{ID: 5}},
+	}
+	get := func(cursor gitLabPageCursor) ([]*gitlab.Project, gitLabPaging, error) {
+		page := cursor.Page
+		return pages[page], gitLabPaging{currentPage: page, nextPage: page + 1, totalPages: 3}, nil
+	}
+	var posted []int
+	post := func(projects []*gitlab.Project) []importFailure {
+		var failures []importFailure
+		for _, p := range projects {
+			posted = append(posted, p.ID)
+			if p.ID == 5 {
+				failures = append(failures, newImportFailure(p, errors.New("502 Bad Gateway")))
+			}
+		}
+		return failures
+	}
+	var saved []importCheckpoint
+	save := func(cp importCheckpoint) { saved = append(saved, cp) }
+
+	checkpoint := importCheckpoint{Cursor: gitLabPageCursor{Page: 2}, LastProjectID: 3}
+	err := importPaginatedProjects(context.Background(), get, post, nil, &checkpoint, save)
+
+	assert.Error(t, err)
+	assert.Equal(t, []int{4, 5}, posted)
+	require.Len(t, saved, 3)
+	assert.Equal(t, importCheckpoint{Cursor: gitLabPageCursor{Page: 2}, LastProjectID: 4}, saved[0])
+	assert.Equal(t, gitLabPageCursor{Page: 3}, saved[1].Cursor)
+	assert.Equal(t, 5, saved[1].LastProjectID)
+	assert.Len(t, saved[1].Failed, 1)
+	// The listing is done, so only the failures are kept for the next resume.
+	assert.Equal(t, importCheckpoint{Failed: saved[1].Failed}, saved[2])
+	assert.Equal(t, importCheckpoint{Failed: saved[1].Failed}, checkpoint)
+}
+
+func TestImportCheckpointKeyIncludesFilter(t *testing.T) {
+	assert.Equal(t, "provider-1-all", importCheckpointKey(1, "", gitLabProjectFilter{}))
+	assert.Equal(t, "provider-1-group-default%2Fweb", importCheckpointKey(1, "default/web", gitLabProjectFilter{}))
+	assert.Equal(t, "provider-1-group-default@owned-minaccess-30-topic-wharf%2Fci",
+		importCheckpointKey(1, "default", gitLabProjectFilter{Owned: true, MinAccessLevel: 30, Topic: "wharf/ci"}))
+
+	lastSync := time.Date(2022, 5, 11, 2, 30, 0, 0, time.UTC)
+	assert.Equal(t, importCheckpointKey(1, "default", gitLabProjectFilter{}),
+		importCheckpointKey(1, "default", gitLabProjectFilter{LastActivityAfter: &lastSync}))
+}
+
+func TestImportPaginatedProjectsCanceledMidPage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	get := func(cursor gitLabPageCursor) ([]*gitlab.Project, gitLabPaging, error) {
+		return []*gitlab.Project{{ID: 1}, {ID: 2}}, gitLabPaging{currentPage: 1, nextPage: 2, totalPages: 2}, nil
+	}
+	post := func(projects []*gitlab.Project) []importFailure {
+		cancel()
+		return nil
+	}
+	var saved []importCheckpoint
+	save := func(cp importCheckpoint) { saved = append(saved, cp) }
+
+	var checkpoint importCheckpoint
+	err := importPaginatedProjects(ctx, get, post, nil, &checkpoint, save)
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, saved, "saved checkpoint for a partially imported page")
+}
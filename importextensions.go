@@ -1,5 +1,13 @@
 package main
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/xanzy/go-gitlab"
+)
+
 // Import is the data that is required by the import endpoint.
 type Import struct {
 	// used in refresh only
@@ -14,6 +22,232 @@ type Import struct {
 	ProjectID uint   `json:"projectId" example:"0"`
 	Project   string `json:"project" example:"sample project name"`
 	Group     string `json:"group" example:"default"`
+	// used in group and instance-wide imports only
+	Resume bool `json:"resume" example:"false"`
+	// Async makes the import run in the background. The response then
+	// contains the ID of the import job instead of waiting for it to finish.
+	Async bool `json:"async" example:"false"`
+	// used in group and instance-wide imports only
+	Scope ImportScope `json:"scope"`
+	// OnlyActive only imports the projects with activity in GitLab since the
+	// last successful import of the same group, or of the whole instance,
+	// with the same scope.
+	// All projects are imported if there has been no successful import yet.
+	// Used in group and instance-wide imports only.
+	OnlyActive bool `json:"onlyActive" example:"false"`
+}
+
+// ImportScope narrows down which projects are imported in group and
+// instance-wide imports. Each field that is set adds another filter, and the
+// zero value imports all projects the token has access to.
+type ImportScope struct {
+	// Membership only imports projects the user is a member of. Only applies
+	// to instance-wide imports.
+	Membership bool `json:"membership" example:"true"`
+	// Owned only imports projects owned by the user.
+	Owned bool `json:"owned" example:"false"`
+	// Starred only imports projects starred by the user.
+	Starred bool `json:"starred" example:"false"`
+	// Topic only imports projects with the given topic.
+	Topic string `json:"topic" example:"wharf"`
+	// MinAccessLevel only imports projects where the user has at least the
+	// given GitLab access level: 10 for guest, 20 for reporter, 30 for
+	// developer, 40 for maintainer, or 50 for owner.
+	MinAccessLevel int `json:"minAccessLevel" enums:"0,5,10,20,30,40,50" example:"30"`
+}
+
+func (s ImportScope) validate() error {
+	switch gitlab.AccessLevelValue(s.MinAccessLevel) {
+	case gitlab.NoPermissions,
+		gitlab.MinimalAccessPermissions,
+		gitlab.GuestPermissions,
+		gitlab.ReporterPermissions,
+		gitlab.DeveloperPermissions,
+		gitlab.MaintainerPermissions,
+		gitlab.OwnerPermissions:
+		return nil
+	default:
+		return fmt.Errorf("invalid minimum access level: %d", s.MinAccessLevel)
+	}
+}
+
+func (s ImportScope) toFilter() gitLabProjectFilter {
+	return gitLabProjectFilter{
+		Membership:     s.Membership,
+		Owned:          s.Owned,
+		Starred:        s.Starred,
+		Topic:          s.Topic,
+		MinAccessLevel: gitlab.AccessLevelValue(s.MinAccessLevel),
+	}
+}
+
+// RefreshResult is the response from the import endpoint when refreshing an
+// existing project.
+type RefreshResult struct {
+	ProjectID uint `json:"projectId" example:"267"`
+	// Moved is true if the project was renamed or transferred to another
+	// namespace in GitLab since it was last imported or refreshed. It is
+	// false if only the naming rules of the provider changed its path in
+	// Wharf, even though OldPath and NewPath then differ.
+	Moved   bool   `json:"moved" example:"true"`
+	OldPath string `json:"oldPath" example:"default/sample project name"`
+	NewPath string `json:"newPath" example:"new-group/sample project name"`
+	// BuildDefinitionPath is the path of the build definition file that was
+	// found in the repository, or empty if none was found.
+	BuildDefinitionPath string `json:"buildDefinitionPath" example:".wharf-ci.yml"`
+	// BuildDefinitionDiagnostics are the problems found when validating the
+	// build definition.
+	BuildDefinitionDiagnostics []BuildDefinitionDiagnostic `json:"buildDefinitionDiagnostics"`
+	// BuildDefinitionRejected is true if the build definition was invalid and
+	// was not stored, as set by the import.rejectInvalidBuildDefinitions
+	// config.
+	BuildDefinitionRejected bool `json:"buildDefinitionRejected" example:"false"`
+	// BuildDefinitionGenerated is true if no build definition file was found
+	// and one was generated from the files in the repository instead, as set
+	// by the import.generateMissingBuildDefinitions config.
+	BuildDefinitionGenerated bool `json:"buildDefinitionGenerated" example:"false"`
+	// EmptyRepository is true if the repository has no commits, and so no
+	// branches nor build definition.
+	EmptyRepository bool `json:"emptyRepository" example:"false"`
+	// Unchanged is true if nothing had changed in GitLab since the project was
+	// last imported or refreshed, so the project was not updated in Wharf.
+	Unchanged bool `json:"unchanged" example:"false"`
+}
+
+// BulkImport is the data that is required by the bulk import endpoint.
+type BulkImport struct {
+	TokenID    uint   `json:"tokenId" example:"0"`
+	Token      string `json:"token" example:"sample token"`
+	User       string `json:"user" example:"sample user name"`
+	URL        string `json:"url" example:"https://gitlab.local"`
+	ProviderID uint   `json:"providerId" example:"0"`
+	// Projects are the projects to import, each either a full
+	// "group/project" path or a numeric GitLab project ID.
+	Projects []string `json:"projects" example:"default/super-project/web,84"`
+}
+
+func (b BulkImport) toImport() Import {
+	return Import{
+		TokenID:    b.TokenID,
+		Token:      b.Token,
+		User:       b.User,
+		URL:        b.URL,
+		ProviderID: b.ProviderID,
+	}
+}
+
+// BulkImportResult is the response from the bulk import endpoint.
+type BulkImportResult struct {
+	Imported int                       `json:"imported" example:"1"`
+	Failed   int                       `json:"failed" example:"1"`
+	Projects []BulkImportProjectResult `json:"projects"`
+}
+
+// BulkImportProjectResult is the outcome of importing one of the projects in
+// a bulk import, in the same order as in the request.
+type BulkImportProjectResult struct {
+	// Entry is the project path or ID as it was given in the request.
+	Entry           string `json:"entry" example:"84"`
+	Imported        bool   `json:"imported" example:"true"`
+	GitLabProjectID int    `json:"gitLabProjectId,omitempty" example:"84"`
+	WharfProjectID  uint   `json:"wharfProjectId,omitempty" example:"267"`
+	Path            string `json:"path,omitempty" example:"default/super-project/web"`
+	Error           string `json:"error,omitempty"`
+
+	BuildDefinitionPath        string                      `json:"buildDefinitionPath,omitempty" example:".wharf-ci.yml"`
+	BuildDefinitionDiagnostics []BuildDefinitionDiagnostic `json:"buildDefinitionDiagnostics,omitempty"`
+	BuildDefinitionRejected    bool                        `json:"buildDefinitionRejected,omitempty" example:"false"`
+	BuildDefinitionGenerated   bool                        `json:"buildDefinitionGenerated,omitempty" example:"false"`
+	// EmptyRepository is true if the repository has no commits, and so no
+	// branches nor build definition.
+	EmptyRepository bool `json:"emptyRepository,omitempty" example:"false"`
+}
+
+// BuildDefinitionLint is the data that is required by the lint endpoint.
+// Either the content to lint is given directly, or the project and ref to
+// fetch the build definition from.
+type BuildDefinitionLint struct {
+	// Content is the raw YAML of a build definition. When set, the other
+	// fields are ignored and nothing is fetched from GitLab.
+	Content    string `json:"content" example:"myStage:\n  myStep:\n    container:\n      image: alpine\n"`
+	TokenID    uint   `json:"tokenId" example:"0"`
+	Token      string `json:"token" example:"sample token"`
+	User       string `json:"user" example:"sample user name"`
+	URL        string `json:"url" example:"https://gitlab.local"`
+	ProviderID uint   `json:"providerId" example:"0"`
+	// Project is either a full "group/project" path or a numeric GitLab
+	// project ID.
+	Project string `json:"project" example:"default/super-project/web"`
+	// Ref is the branch, tag, or commit SHA to fetch the build definition
+	// from. Defaults to the project's default branch.
+	Ref string `json:"ref" example:"feature/new-pipeline"`
+	// Path is the path of the build definition file in the repository.
+	// Defaults to the paths in the import.buildDefinitionPaths config.
+	Path string `json:"path" example:".wharf-ci.yml"`
+}
+
+func (l BuildDefinitionLint) toImport() Import {
+	return Import{
+		TokenID:    l.TokenID,
+		Token:      l.Token,
+		User:       l.User,
+		URL:        l.URL,
+		ProviderID: l.ProviderID,
+	}
+}
+
+// BuildDefinitionSuggest is the data that is required by the endpoint that
+// suggests a build definition for a project.
+type BuildDefinitionSuggest struct {
+	TokenID    uint   `json:"tokenId" example:"0"`
+	Token      string `json:"token" example:"sample token"`
+	User       string `json:"user" example:"sample user name"`
+	URL        string `json:"url" example:"https://gitlab.local"`
+	ProviderID uint   `json:"providerId" example:"0"`
+	// Project is either a full "group/project" path or a numeric GitLab
+	// project ID.
+	Project string `json:"project" example:"default/super-project/web"`
+	// Ref is the branch, tag, or commit SHA to look at the files of.
+	// Defaults to the project's default branch.
+	Ref string `json:"ref" example:"main"`
+}
+
+func (s BuildDefinitionSuggest) toImport() Import {
+	return Import{
+		TokenID:    s.TokenID,
+		Token:      s.Token,
+		User:       s.User,
+		URL:        s.URL,
+		ProviderID: s.ProviderID,
+	}
+}
+
+// BuildDefinitionLintResult is the response from the lint endpoint.
+type BuildDefinitionLintResult struct {
+	// Valid is true if no errors were found. There may still be warnings.
+	Valid bool `json:"valid" example:"false"`
+	// Path and Ref are where the build definition was fetched from, and are
+	// empty when the content was given directly.
+	Path        string                      `json:"path,omitempty" example:".wharf-ci.yml"`
+	Ref         string                      `json:"ref,omitempty" example:"feature/new-pipeline"`
+	Diagnostics []BuildDefinitionDiagnostic `json:"diagnostics"`
+}
+
+func newBuildDefinitionLintResult(diagnostics []BuildDefinitionDiagnostic) BuildDefinitionLintResult {
+	if diagnostics == nil {
+		diagnostics = []BuildDefinitionDiagnostic{}
+	}
+	return BuildDefinitionLintResult{
+		Valid:       !hasBuildDefinitionErrors(diagnostics),
+		Diagnostics: diagnostics,
+	}
+}
+
+func (b BulkImport) lockKey(providerID uint) string {
+	entries := make([]string, len(b.Projects))
+	copy(entries, b.Projects)
+	sort.Strings(entries)
+	return fmt.Sprintf("provider-%d-bulk-%s", providerID, strings.Join(entries, ","))
 }
 
 type operationType int
@@ -55,6 +289,40 @@ func (i Import) getOperationType(entity entity) operationType {
 	return invalidOperation
 }
 
+func (i Import) errorDetail() string {
+	if i.ProjectID != 0 {
+		return fmt.Sprintf("Unable to refresh GitLab project %q", i.Project)
+	}
+	switch i.whatToImport() {
+	case importProject:
+		return fmt.Sprintf("Unable to import GitLab project %q", i.Project)
+	case importGroup:
+		return fmt.Sprintf("Unable to import GitLab group %q", i.Group)
+	default:
+		return "Unable to import GitLab groups"
+	}
+}
+
+// lockKey returns the key of the import, used so that the same import is not
+// run by two jobs at the same time. The scope is left out, as imports of the
+// same group with different scopes still overlap. Imports with different
+// keys may still include the same GitLab project, such as a group import and
+// a refresh, so each project is also locked while it is imported, as done by
+// importJob.lockProject.
+func (i Import) lockKey(providerID uint) string {
+	if i.ProjectID != 0 {
+		return fmt.Sprintf("provider-%d-refresh-%d", providerID, i.ProjectID)
+	}
+	switch i.whatToImport() {
+	case importProject:
+		return fmt.Sprintf("provider-%d-project-%s", providerID, joinProjectPath(i.Group, i.Project))
+	case importGroup:
+		return fmt.Sprintf("provider-%d-group-%s", providerID, i.Group)
+	default:
+		return fmt.Sprintf("provider-%d-all", providerID)
+	}
+}
+
 func (i Import) whatToImport() importType {
 	if i.Project != "" && i.Group != "" {
 		return importProject
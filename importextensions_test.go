@@ -4,6 +4,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-gitlab"
 )
 
 func TestGetOperationType(t *testing.T) {
@@ -100,3 +102,24 @@ func getTestImport() Import {
 	}
 	return importSampleData
 }
+
+func TestImportScopeValidate(t *testing.T) {
+	assert.NoError(t, ImportScope{}.validate())
+	assert.NoError(t, ImportScope{MinAccessLevel: 30}.validate())
+	assert.Error(t, ImportScope{MinAccessLevel: 35}.validate())
+}
+
+func TestImportScopeFilterTopic(t *testing.T) {
+	projects := []*gitlab.Project{
+		{ID: 1, Topics: []string{"wharf", "go"}},
+		{ID: 2, Topics: []string{"go"}},
+		{ID: 3, TagList: []string{"wharf"}},
+	}
+	filter := ImportScope{Topic: "wharf"}.toFilter()
+
+	got := filter.apply(projects)
+
+	require.Len(t, got, 2)
+	assert.Equal(t, 1, got[0].ID)
+	assert.Equal(t, 3, got[1].ID)
+}
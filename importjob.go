@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// importJobRetention is how long a finished import job, and its events, are
+// kept so that late subscribers can still read how it went.
+const importJobRetention = time.Hour
+
+// importJobSubscriberBuffer is how many events may be queued for a subscriber
+// before new events are dropped for that subscriber.
+const importJobSubscriberBuffer = 256
+
+// importJobMaxEvents is how many events are kept per job for replaying to new
+// subscribers. The oldest events are dropped first.
+const importJobMaxEvents = 10000
+
+type importEventType string
+
+const (
+	importEventJobStarted      importEventType = "job-started"
+	importEventJobFinished     importEventType = "job-finished"
+	importEventJobFailed       importEventType = "job-failed"
+	importEventPageFetched     importEventType = "page-fetched"
+	importEventProjectStarted  importEventType = "project-started"
+	importEventProjectFinished importEventType = "project-finished"
+	importEventProjectFailed   importEventType = "project-failed"
+	importEventBranchesSynced  importEventType = "branches-synced"
+)
+
+// ImportEvent is a progress event of an import job, streamed from the
+// endpoint GET /import/gitlab/jobs/{id}/events.
+type ImportEvent struct {
+	Type            importEventType `json:"type" enums:"job-started,job-finished,job-failed,page-fetched,project-started,project-finished,project-failed,branches-synced"`
+	Time            time.Time       `json:"time" format:"date-time"`
+	GitLabProjectID int             `json:"gitLabProjectId,omitempty" example:"84"`
+	WharfProjectID  uint            `json:"wharfProjectId,omitempty" example:"267"`
+	Project         string          `json:"project,omitempty" example:"default/super-project/web"`
+	Page            int             `json:"page,omitempty" example:"1"`
+	Count           int             `json:"count,omitempty" example:"20"`
+	Error           string          `json:"error,omitempty"`
+	// Diagnostics are the problems found in the project's build definition.
+	Diagnostics []BuildDefinitionDiagnostic `json:"diagnostics,omitempty"`
+	// EmptyRepository is true if the project's repository has no commits, and
+	// so it was imported without branches nor build definition.
+	EmptyRepository bool `json:"emptyRepository,omitempty" example:"false"`
+}
+
+// ImportJob is the response from the import endpoint when the import is run
+// asynchronously.
+type ImportJob struct {
+	ID        string    `json:"id" example:"4f9c1a2b3d4e5f60"`
+	StartedAt time.Time `json:"startedAt" format:"date-time"`
+	EventsURL string    `json:"eventsUrl" example:"/import/gitlab/jobs/4f9c1a2b3d4e5f60/events"`
+}
+
+type importJob struct {
+	id        string
+	key       string
+	startedAt time.Time
+	projects  *projectLocks
+
+	mutex       sync.Mutex
+	events      []ImportEvent
+	done        bool
+	subscribers map[chan ImportEvent]struct{}
+}
+
+func (j *importJob) eventsURL() string {
+	return fmt.Sprintf("/import/gitlab/jobs/%s/events", j.id)
+}
+
+func (j *importJob) response() ImportJob {
+	return ImportJob{
+		ID:        j.id,
+		StartedAt: j.startedAt,
+		EventsURL: j.eventsURL(),
+	}
+}
+
+// emit records the event and sends it to all subscribers. Calling emit on a
+// nil job does nothing, so importers that are not run as a job do not need to
+// check.
+func (j *importJob) emit(ev ImportEvent) {
+	if j == nil {
+		return
+	}
+	ev.Time = time.Now()
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.done {
+		return
+	}
+	j.events = append(j.events, ev)
+	if len(j.events) > importJobMaxEvents {
+		j.events = j.events[len(j.events)-importJobMaxEvents:]
+	}
+	for ch := range j.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			log.Debug().
+				WithString("job", j.id).
+				WithString("event", string(ev.Type)).
+				Message("Dropped import event for slow subscriber.")
+		}
+	}
+}
+
+// lockProject waits until no other job is importing or refreshing the GitLab
+// project, and then locks it until the returned function is called. Jobs
+// with different keys may still include the same project, such as a group
+// import and a bulk import, and are only kept apart by this lock. A nil job
+// never waits.
+func (j *importJob) lockProject(ctx context.Context, providerID uint, gitLabProjectID int) (func(), error) {
+	if j == nil {
+		return func() {}, nil
+	}
+	return j.projects.lock(ctx, fmt.Sprintf("provider-%d-project-%d", providerID, gitLabProjectID))
+}
+
+// finish emits the final event of the job and closes all subscriptions.
+func (j *importJob) finish(err error) {
+	if j == nil {
+		return
+	}
+	if err != nil {
+		j.emit(ImportEvent{Type: importEventJobFailed, Error: err.Error()})
+	} else {
+		j.emit(ImportEvent{Type: importEventJobFinished})
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.done = true
+	for ch := range j.subscribers {
+		close(ch)
+	}
+	j.subscribers = nil
+}
+
+// subscribe returns all events emitted so far, and a channel of the events to
+// come. The channel is closed when the job finishes. If the job has already
+// finished, the returned channel is nil.
+func (j *importJob) subscribe() ([]ImportEvent, <-chan ImportEvent, func()) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	history := make([]ImportEvent, len(j.events))
+	copy(history, j.events)
+	if j.done {
+		return history, nil, func() {}
+	}
+	ch := make(chan ImportEvent, importJobSubscriberBuffer)
+	j.subscribers[ch] = struct{}{}
+	return history, ch, func() {
+		j.mutex.Lock()
+		defer j.mutex.Unlock()
+		if _, ok := j.subscribers[ch]; ok {
+			delete(j.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+type importJobRegistry struct {
+	mutex sync.Mutex
+	jobs  map[string]*importJob
+	// running holds the unfinished jobs by their key.
+	running  map[string]*importJob
+	projects *projectLocks
+}
+
+func newImportJobRegistry() *importJobRegistry {
+	return &importJobRegistry{
+		jobs:     make(map[string]*importJob),
+		running:  make(map[string]*importJob),
+		projects: newProjectLocks(),
+	}
+}
+
+// start registers a new job. The job is removed from the registry a while
+// after it has finished.
+//
+// The key tells which projects the job imports, such as from
+// Import.lockKey, and only one job per key may run at a time. If a job with
+// the same key is already running, then no job is started, and the running
+// job is returned together with false. An empty key never conflicts.
+func (r *importJobRegistry) start(key string) (*importJob, bool) {
+	r.mutex.Lock()
+	if running, ok := r.running[key]; ok && key != "" {
+		r.mutex.Unlock()
+		return running, false
+	}
+	job := &importJob{
+		id:          newImportJobID(),
+		key:         key,
+		startedAt:   time.Now(),
+		projects:    r.projects,
+		subscribers: make(map[chan ImportEvent]struct{}),
+	}
+	r.jobs[job.id] = job
+	if key != "" {
+		r.running[key] = job
+	}
+	r.mutex.Unlock()
+	job.emit(ImportEvent{Type: importEventJobStarted})
+	return job, true
+}
+
+// finish finishes the job and schedules its removal from the registry.
+func (r *importJobRegistry) finish(job *importJob, err error) {
+	r.mutex.Lock()
+	if r.running[job.key] == job {
+		delete(r.running, job.key)
+	}
+	r.mutex.Unlock()
+	job.finish(err)
+	time.AfterFunc(importJobRetention, func() {
+		r.mutex.Lock()
+		delete(r.jobs, job.id)
+		r.mutex.Unlock()
+	})
+}
+
+// errImportPanicked is wrapped by the error that run returns when the import
+// panics.
+var errImportPanicked = errors.New("import panicked")
+
+// run runs the import of a started job, and then finishes the job. A panic
+// in the import is recovered, logged with its stack, and returned as an error
+// wrapping errImportPanicked, as run is also called on goroutines that
+// nothing else recovers, such as those of async imports and scheduled syncs.
+// The job is then finished as failed, so that its key is not left locked
+// until restart.
+func (r *importJobRegistry) run(job *importJob, runImport func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Error().
+				WithString("job", job.id).
+				WithStringf("panic", "%v", p).
+				WithString("stack", string(debug.Stack())).
+				Message("Import panicked.")
+			err = fmt.Errorf("%w: %v", errImportPanicked, p)
+		}
+		r.finish(job, err)
+	}()
+	return runImport()
+}
+
+func (r *importJobRegistry) get(id string) (*importJob, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	job, ok := r.jobs[id]
+	return job, ok
+}
+
+// projectLocks holds a lock per key, which are removed once no job holds or
+// waits for them.
+type projectLocks struct {
+	mutex sync.Mutex
+	locks map[string]*projectLock
+}
+
+type projectLock struct {
+	// held has room for one value, which is sent while the lock is held.
+	held chan struct{}
+	refs int
+}
+
+func newProjectLocks() *projectLocks {
+	return &projectLocks{locks: make(map[string]*projectLock)}
+}
+
+// lock waits for the lock of the key, or until the context is canceled.
+func (l *projectLocks) lock(ctx context.Context, key string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.mutex.Lock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &projectLock{held: make(chan struct{}, 1)}
+		l.locks[key] = lock
+	}
+	lock.refs++
+	l.mutex.Unlock()
+
+	release := func() {
+		l.mutex.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mutex.Unlock()
+	}
+	select {
+	case lock.held <- struct{}{}:
+		return func() {
+			<-lock.held
+			release()
+		}, nil
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+}
+
+func newImportJobID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Panic().WithError(err).Message("Failed to generate import job ID.")
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportJobReplaysHistoryToSubscribers(t *testing.T) {
+	jobs := newImportJobRegistry()
+	job, _ := jobs.start("")
+	job.emit(ImportEvent{Type: importEventPageFetched, Page: 1, Count: 20})
+
+	history, events, unsubscribe := job.subscribe()
+	defer unsubscribe()
+	require.Len(t, history, 2)
+	assert.Equal(t, importEventJobStarted, history[0].Type)
+	assert.Equal(t, importEventPageFetched, history[1].Type)
+
+	job.emit(ImportEvent{Type: importEventProjectStarted, GitLabProjectID: 84})
+	job.finish(errors.New("502 Bad Gateway"))
+
+	var got []importEventType
+	for ev := range events {
+		got = append(got, ev.Type)
+	}
+	assert.Equal(t, []importEventType{importEventProjectStarted, importEventJobFailed}, got)
+}
+
+func TestImportJobNilIsNoop(t *testing.T) {
+	var job *importJob
+	assert.NotPanics(t, func() {
+		job.emit(ImportEvent{Type: importEventPageFetched})
+		job.finish(nil)
+	})
+}
+
+func TestGetImportJobEventsHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	m := importModule{config: &Config{}, jobs: newImportJobRegistry()}
+	r := gin.New()
+	m.register(r)
+
+	job, _ := m.jobs.start("")
+	job.emit(ImportEvent{Type: importEventProjectFinished, Project: "default/web"})
+	m.jobs.finish(job, nil)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, job.eventsURL(), nil)
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Equal(t, 3, strings.Count(body, "event:"))
+	assert.Contains(t, body, "event:project-finished")
+	assert.Contains(t, body, `"project":"default/web"`)
+	assert.Contains(t, body, "event:job-finished")
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/import/gitlab/jobs/does-not-exist/events", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestImportJobRegistryStartConflict(t *testing.T) {
+	jobs := newImportJobRegistry()
+	key := getTestImportWithoutProject().lockKey(1)
+
+	first, started := jobs.start(key)
+	require.True(t, started)
+
+	second, started := jobs.start(key)
+	assert.False(t, started)
+	assert.Same(t, first, second)
+
+	other, started := jobs.start(getTestImportWithoutProject().lockKey(2))
+	assert.True(t, started, "job for another provider conflicted")
+	jobs.finish(other, nil)
+
+	jobs.finish(first, nil)
+	third, started := jobs.start(key)
+	assert.True(t, started, "job conflicted with a finished job")
+	assert.NotSame(t, first, third)
+}
+
+func TestImportLockKey(t *testing.T) {
+	assert.Equal(t, "provider-1-refresh-3", Import{ProjectID: 3, Group: "default"}.lockKey(1))
+	assert.Equal(t, "provider-1-project-default/web", Import{Group: "default", Project: "web"}.lockKey(1))
+	assert.Equal(t, "provider-1-group-default", Import{Group: "default", Scope: ImportScope{Topic: "wharf"}}.lockKey(1))
+	assert.Equal(t, "provider-1-all", Import{}.lockKey(1))
+	assert.Equal(t,
+		BulkImport{Projects: []string{"84", "default/web"}}.lockKey(1),
+		BulkImport{Projects: []string{"default/web", "84"}}.lockKey(1))
+}
+
+func TestImportJobLockProjectAcrossJobs(t *testing.T) {
+	jobs := newImportJobRegistry()
+	group, _ := jobs.start(Import{Group: "default"}.lockKey(1))
+	bulk, started := jobs.start(BulkImport{Projects: []string{"84"}}.lockKey(1))
+	require.True(t, started, "jobs of different scopes should both start")
+
+	unlock, err := group.lockProject(context.Background(), 1, 84)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = bulk.lockProject(ctx, 1, 84)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "locked the same project from two jobs")
+
+	otherUnlock, err := bulk.lockProject(context.Background(), 1, 85)
+	require.NoError(t, err, "other projects should not be locked")
+	otherUnlock()
+
+	unlock()
+	unlock, err = bulk.lockProject(context.Background(), 1, 84)
+	require.NoError(t, err)
+	unlock()
+	assert.Empty(t, jobs.projects.locks, "locks should be removed once released")
+}
+
+func TestImportJobRegistryRunRecoversPanic(t *testing.T) {
+	jobs := newImportJobRegistry()
+	job, _ := jobs.start("provider-1-all")
+	errs := make(chan error)
+	go func() {
+		errs <- jobs.run(job, func() error { panic("boom") })
+	}()
+	err := <-errs
+	assert.ErrorIs(t, err, errImportPanicked)
+	assert.Contains(t, err.Error(), "boom")
+
+	history, events, _ := job.subscribe()
+	assert.Nil(t, events, "job should be finished")
+	require.NotEmpty(t, history)
+	assert.Equal(t, importEventJobFailed, history[len(history)-1].Type)
+	_, started := jobs.start("provider-1-all")
+	assert.True(t, started, "key stayed locked after the import panicked")
+}
@@ -1,22 +1,202 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/google/go-querystring/query"
 	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/request"
 	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/response"
 	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/wharfapi"
+	"github.com/iver-wharf/wharf-core/pkg/problem"
 )
 
 type wharfClientAPIFetcher interface {
-	CreateProject(project request.Project) (response.Project, error)
-	CreateProjectBranch(projectID uint, branch request.Branch) (response.Branch, error)
-	CreateProvider(provider request.Provider) (response.Provider, error)
-	CreateToken(token request.Token) (response.Token, error)
-	GetProject(projectID uint) (response.Project, error)
-	GetProjectList(params wharfapi.ProjectSearch) (response.PaginatedProjects, error)
-	GetProvider(providerID uint) (response.Provider, error)
-	GetProviderList(params wharfapi.ProviderSearch) (response.PaginatedProviders, error)
-	GetToken(tokenID uint) (response.Token, error)
-	GetTokenList(params wharfapi.TokenSearch) (response.PaginatedTokens, error)
-	UpdateProject(projectID uint, project request.ProjectUpdate) (response.Project, error)
-	UpdateProjectBranchList(projectID uint, branches []request.Branch) ([]response.Branch, error)
+	CreateProject(ctx context.Context, project request.Project) (response.Project, error)
+	CreateProjectBranch(ctx context.Context, projectID uint, branch request.Branch) (response.Branch, error)
+	CreateProvider(ctx context.Context, provider request.Provider) (response.Provider, error)
+	CreateToken(ctx context.Context, token request.Token) (response.Token, error)
+	GetProject(ctx context.Context, projectID uint) (response.Project, error)
+	GetProjectList(ctx context.Context, params wharfapi.ProjectSearch) (response.PaginatedProjects, error)
+	GetProvider(ctx context.Context, providerID uint) (response.Provider, error)
+	GetProviderList(ctx context.Context, params wharfapi.ProviderSearch) (response.PaginatedProviders, error)
+	GetToken(ctx context.Context, tokenID uint) (response.Token, error)
+	GetTokenList(ctx context.Context, params wharfapi.TokenSearch) (response.PaginatedTokens, error)
+	UpdateProject(ctx context.Context, projectID uint, project request.ProjectUpdate) (response.Project, error)
+	UpdateProjectBranchList(ctx context.Context, projectID uint, branches []request.Branch) ([]response.Branch, error)
+}
+
+// wharfAPIClient sends the requests to the Wharf API that the importers need.
+// It uses the request and response models of the Wharf API client, but sends
+// the requests itself, as the Wharf API client does not take a context. This
+// way a canceled import also aborts the request it is waiting on. Unlike the
+// Wharf API client, it does not check the version of the Wharf API.
+type wharfAPIClient struct {
+	authHeader string
+	apiURL     string
+}
+
+func newWharfAPIClient(authHeader, apiURL string) wharfAPIClient {
+	return wharfAPIClient{
+		authHeader: authHeader,
+		apiURL:     apiURL,
+	}
+}
+
+func (c wharfAPIClient) CreateProject(ctx context.Context, project request.Project) (response.Project, error) {
+	var newProject response.Project
+	err := c.do(ctx, http.MethodPost, "/api/project", nil, project, &newProject)
+	return newProject, err
+}
+
+func (c wharfAPIClient) CreateProjectBranch(ctx context.Context, projectID uint, branch request.Branch) (response.Branch, error) {
+	var newBranch response.Branch
+	path := fmt.Sprintf("/api/project/%d/branch", projectID)
+	err := c.do(ctx, http.MethodPost, path, nil, branch, &newBranch)
+	return newBranch, err
+}
+
+func (c wharfAPIClient) CreateProvider(ctx context.Context, provider request.Provider) (response.Provider, error) {
+	var newProvider response.Provider
+	err := c.do(ctx, http.MethodPost, "/api/provider", nil, provider, &newProvider)
+	return newProvider, err
+}
+
+func (c wharfAPIClient) CreateToken(ctx context.Context, token request.Token) (response.Token, error) {
+	var newToken response.Token
+	err := c.do(ctx, http.MethodPost, "/api/token", nil, token, &newToken)
+	return newToken, err
+}
+
+func (c wharfAPIClient) GetProject(ctx context.Context, projectID uint) (response.Project, error) {
+	var project response.Project
+	path := fmt.Sprintf("/api/project/%d", projectID)
+	err := c.do(ctx, http.MethodGet, path, nil, nil, &project)
+	return project, err
+}
+
+func (c wharfAPIClient) GetProjectList(ctx context.Context, params wharfapi.ProjectSearch) (response.PaginatedProjects, error) {
+	var projects response.PaginatedProjects
+	q, err := query.Values(params)
+	if err != nil {
+		return projects, err
+	}
+	err = c.do(ctx, http.MethodGet, "/api/project", q, nil, &projects)
+	return projects, err
+}
+
+func (c wharfAPIClient) GetProvider(ctx context.Context, providerID uint) (response.Provider, error) {
+	var provider response.Provider
+	path := fmt.Sprintf("/api/provider/%d", providerID)
+	err := c.do(ctx, http.MethodGet, path, nil, nil, &provider)
+	return provider, err
+}
+
+func (c wharfAPIClient) GetProviderList(ctx context.Context, params wharfapi.ProviderSearch) (response.PaginatedProviders, error) {
+	var providers response.PaginatedProviders
+	q, err := query.Values(params)
+	if err != nil {
+		return providers, err
+	}
+	err = c.do(ctx, http.MethodGet, "/api/provider", q, nil, &providers)
+	return providers, err
+}
+
+func (c wharfAPIClient) GetToken(ctx context.Context, tokenID uint) (response.Token, error) {
+	var token response.Token
+	path := fmt.Sprintf("/api/token/%d", tokenID)
+	err := c.do(ctx, http.MethodGet, path, nil, nil, &token)
+	return token, err
+}
+
+func (c wharfAPIClient) GetTokenList(ctx context.Context, params wharfapi.TokenSearch) (response.PaginatedTokens, error) {
+	var tokens response.PaginatedTokens
+	q, err := query.Values(params)
+	if err != nil {
+		return tokens, err
+	}
+	err = c.do(ctx, http.MethodGet, "/api/token", q, nil, &tokens)
+	return tokens, err
+}
+
+func (c wharfAPIClient) UpdateProject(ctx context.Context, projectID uint, project request.ProjectUpdate) (response.Project, error) {
+	var updatedProject response.Project
+	path := fmt.Sprintf("/api/project/%d", projectID)
+	err := c.do(ctx, http.MethodPut, path, nil, project, &updatedProject)
+	return updatedProject, err
+}
+
+func (c wharfAPIClient) UpdateProjectBranchList(ctx context.Context, projectID uint, branches []request.Branch) ([]response.Branch, error) {
+	body := request.BranchListUpdate{
+		Branches: make([]request.BranchUpdate, 0, len(branches)),
+	}
+	for _, b := range branches {
+		body.Branches = append(body.Branches, request.BranchUpdate{Name: b.Name})
+		if b.Default {
+			body.DefaultBranch = b.Name
+		}
+	}
+	var branchList response.BranchList
+	path := fmt.Sprintf("/api/project/%d/branch", projectID)
+	err := c.do(ctx, http.MethodPut, path, nil, body, &branchList)
+	return branchList.Branches, err
+}
+
+// do sends a request to the Wharf API, with the body encoded as JSON unless
+// it is nil, and decodes the JSON response into result. Errors are returned
+// the same way as the Wharf API client does, as a *wharfapi.AuthError on
+// 401 Unauthorized and as a problem.Response when the Wharf API responds
+// with one.
+func (c wharfAPIClient) do(ctx context.Context, method, path string, q url.Values, body, result any) error {
+	u, err := url.Parse(c.apiURL)
+	if err != nil {
+		return err
+	}
+	u.Path = path
+	u.RawQuery = q.Encode()
+
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.authHeader != "" {
+		req.Header.Set("Authorization", c.authHeader)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return &wharfapi.AuthError{Realm: resp.Header.Get("WWW-Authenticate")}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		if problem.IsHTTPResponse(resp) {
+			prob, err := problem.ParseHTTPResponse(resp)
+			if err != nil {
+				return fmt.Errorf("unexpected status code returned: %s: %w", resp.Status, err)
+			}
+			return prob
+		}
+		return fmt.Errorf("unexpected status code returned: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
 }
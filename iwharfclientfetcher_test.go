@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/request"
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/response"
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/wharfapi"
+	"github.com/iver-wharf/wharf-core/pkg/problem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWharfAPIClientSendsRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "/api/project/5/branch", r.URL.Path)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		var body request.BranchListUpdate
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, request.BranchListUpdate{
+			DefaultBranch: "main",
+			Branches:      []request.BranchUpdate{{Name: "main"}, {Name: "feature"}},
+		}, body)
+		w.Write([]byte(`{"branches":[{"branchId":1,"name":"main"},{"branchId":2,"name":"feature"}]}`))
+	}))
+	defer server.Close()
+
+	client := newWharfAPIClient("Bearer token", server.URL)
+	branches, err := client.UpdateProjectBranchList(context.Background(), 5, []request.Branch{
+		{Name: "main", Default: true},
+		{Name: "feature"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []response.Branch{{BranchID: 1, Name: "main"}, {BranchID: 2, Name: "feature"}}, branches)
+}
+
+func TestWharfAPIClientEncodesSearchQuery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/project", r.URL.Path)
+		assert.Equal(t, "my-group", r.URL.Query().Get("groupName"))
+		assert.Equal(t, "3", r.URL.Query().Get("providerId"))
+		w.Write([]byte(`{"list":[{"projectId":7}],"totalCount":1}`))
+	}))
+	defer server.Close()
+
+	groupName := "my-group"
+	providerID := uint(3)
+	client := newWharfAPIClient("", server.URL)
+	projects, err := client.GetProjectList(context.Background(), wharfapi.ProjectSearch{
+		GroupName:  &groupName,
+		ProviderID: &providerID,
+	})
+	require.NoError(t, err)
+	require.Len(t, projects.List, 1)
+	assert.Equal(t, uint(7), projects.List[0].ProjectID)
+}
+
+func TestWharfAPIClientErrors(t *testing.T) {
+	testCases := []struct {
+		name    string
+		handler http.HandlerFunc
+		check   func(t *testing.T, err error)
+	}{
+		{
+			name: "unauthorized",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="wharf"`)
+				w.WriteHeader(http.StatusUnauthorized)
+			},
+			check: func(t *testing.T, err error) {
+				var authErr *wharfapi.AuthError
+				require.ErrorAs(t, err, &authErr)
+				assert.Equal(t, `Bearer realm="wharf"`, authErr.Realm)
+			},
+		},
+		{
+			name: "problem",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", problem.HTTPContentType)
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"type":"/prob/api/record-not-found","status":404}`))
+			},
+			check: func(t *testing.T, err error) {
+				var prob problem.Response
+				require.ErrorAs(t, err, &prob)
+				assert.Equal(t, "/prob/api/record-not-found", prob.Type)
+			},
+		},
+		{
+			name: "other status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadGateway)
+			},
+			check: func(t *testing.T, err error) {
+				assert.EqualError(t, err, "unexpected status code returned: 502 Bad Gateway")
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(tc.handler)
+			defer server.Close()
+
+			_, err := newWharfAPIClient("", server.URL).GetProject(context.Background(), 1)
+			tc.check(t, err)
+		})
+	}
+}
+
+func TestWharfAPIClientAbortsRequestWhenCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := newWharfAPIClient("", server.URL).GetProject(ctx, 1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
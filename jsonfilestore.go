@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// jsonFileStore saves values as JSON files in a directory, one file per key.
+// The keys must be safe to use as file names.
+type jsonFileStore struct {
+	dir string
+}
+
+// load unmarshals the file for the given key into v, or returns false if
+// there is no such file.
+func (s jsonFileStore) load(key string, v any) (bool, error) {
+	bytes, err := os.ReadFile(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(bytes, v); err != nil {
+		return false, fmt.Errorf("parse %q: %w", s.path(key), err)
+	}
+	return true, nil
+}
+
+// save writes the value to a temporary file first and then renames it, so a
+// crash while writing never leaves a half-written file behind. Each save uses
+// its own temporary file, so concurrent saves of the same key do not write to
+// the same file.
+func (s jsonFileStore) save(key string, v any) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bytes); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(key))
+}
+
+func (s jsonFileStore) remove(key string) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// evictOldest removes the files that were saved the longest time ago, until
+// all files together take up at most maxSize bytes. Zero means no limit.
+func (s jsonFileStore) evictOldest(maxSize int64) error {
+	if maxSize <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, file := range files {
+		if total <= maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.dir, file.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		total -= file.Size()
+	}
+	return nil
+}
+
+func (s jsonFileStore) path(key string) string {
+	return filepath.Join(s.dir, key+".json")
+}
+
+// jsonStore is a jsonFileStore of values of a single type. A nil store is
+// disabled: it never has any values, and saving to it does nothing.
+type jsonStore[T any] struct {
+	files jsonFileStore
+}
+
+// newJSONStore returns nil if the directory is empty, which disables the
+// store.
+func newJSONStore[T any](dir string) *jsonStore[T] {
+	if dir == "" {
+		return nil
+	}
+	return &jsonStore[T]{jsonFileStore{dir}}
+}
+
+// load returns the saved value for the given key, or false if there is none.
+func (s *jsonStore[T]) load(key string) (T, bool, error) {
+	var value T
+	if s == nil {
+		return value, false, nil
+	}
+	ok, err := s.files.load(key, &value)
+	return value, ok, err
+}
+
+func (s *jsonStore[T]) save(key string, value T) error {
+	if s == nil {
+		return nil
+	}
+	return s.files.save(key, value)
+}
+
+func (s *jsonStore[T]) remove(key string) error {
+	if s == nil {
+		return nil
+	}
+	return s.files.remove(key)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONStoreNilDisabled(t *testing.T) {
+	store := newJSONStore[importCheckpoint]("")
+	assert.Nil(t, store)
+	assert.NoError(t, store.save("key", importCheckpoint{LastProjectID: 1}))
+	_, ok, err := store.load("key")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.NoError(t, store.remove("key"))
+}
+
+func TestJSONFileStoreConcurrentSaves(t *testing.T) {
+	store := jsonFileStore{t.TempDir()}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, store.save("key", map[string]int{"value": i}))
+		}(i)
+	}
+	wg.Wait()
+
+	var got map[string]int
+	ok, err := store.load("key", &got)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Contains(t, got, "value")
+
+	entries, err := os.ReadDir(store.dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "temporary files left behind")
+	assert.Equal(t, "key.json", entries[0].Name())
+}
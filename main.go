@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -16,7 +22,8 @@ import (
 )
 
 // BuildDefinitionFileName is a name of the file that should exists in project
-// repository if project will have ability to be built by Wharf.
+// repository if project will have ability to be built by Wharf. It is the
+// default of the import.buildDefinitionPaths config.
 const BuildDefinitionFileName = ".wharf-ci.yml"
 
 // ProviderName is a provider name that is used in whole wharf system for GitLab.
@@ -29,8 +36,17 @@ const (
 	exitCodeFailBindAddress     = 2
 )
 
+// shutdownTimeout is how long the web server waits for requests that are
+// still being handled when shutting down.
+const shutdownTimeout = 10 * time.Second
+
 var log = logger.NewScoped("WHARF-PROVIDER-GITLAB")
 
+// auditLog is used for log entries about changes made to Wharf projects that
+// were not explicitly requested, such as following a project that was moved
+// in GitLab.
+var auditLog = logger.NewScoped("WHARF-PROVIDER-GITLAB-AUDIT")
+
 // @title Wharf provider API for GitLab
 // @description Wharf backend API for integrating GitLab repositories with
 // @description the Wharf main API.
@@ -66,6 +82,13 @@ func main() {
 		}
 		http.DefaultClient = client
 	}
+	if config.CA.InsecureSkipVerify {
+		log.Warn().Message("Verification of TLS certificates is disabled by the ca.insecureSkipVerify config.")
+		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		if transport, ok := http.DefaultClient.Transport.(*http.Transport); ok {
+			transport.TLSClientConfig.InsecureSkipVerify = true
+		}
+	}
 
 	gin.DefaultWriter = ginutil.DefaultLoggerWriter
 	gin.DefaultErrorWriter = ginutil.DefaultLoggerWriter
@@ -82,17 +105,44 @@ func main() {
 	}
 
 	r.GET("/", func(c *gin.Context) { c.JSON(200, gin.H{"message": "pong"}) })
-	r.POST("/import/gitlab/trigger", runGitLabTriggerHandler)
 	r.GET("/import/gitlab/version", getVersionHandler)
 	r.GET("/import/gitlab/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
-	importModule{&config}.register(r)
+	// The context is canceled on shutdown, which stops the scheduled syncs
+	// and the async imports that outlive their requests.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	jobs := newImportJobRegistry()
+	importModule{ctx: ctx, config: &config, jobs: jobs}.register(r)
+
+	sched, err := newScheduler(&config, jobs)
+	if err != nil {
+		log.Error().WithError(err).Message("Failed to parse scheduled syncs config.")
+		os.Exit(exitCodeFailLoadConfigFile)
+	}
+	sched.start(ctx)
+
+	server := &http.Server{Addr: config.HTTP.BindAddress, Handler: r}
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		log.Info().Message("Shutting down web server.")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Warn().WithError(err).Message("Failed to gracefully shut down web server.")
+		}
+	}()
 
-	if err := r.Run(config.HTTP.BindAddress); err != nil {
+	log.Info().WithString("address", config.HTTP.BindAddress).Message("Starting web server.")
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
 		log.Error().
 			WithError(err).
 			WithString("address", config.HTTP.BindAddress).
 			Message("Failed to start web server.")
 		os.Exit(exitCodeFailBindAddress)
 	}
+	<-shutdownDone
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/request"
 	"github.com/xanzy/go-gitlab"
@@ -10,21 +12,33 @@ import (
 type mapper struct {
 	tokenID    uint
 	providerID uint
+	gitURL     gitURLMapping
+	names      nameMapping
+	// avatarProxyURL is the base URL of this provider's avatar proxy, as set
+	// by the import.avatarProxy.url config, or empty to use GitLab's URLs.
+	avatarProxyURL string
 }
 
-func (m *mapper) mapProjectToWharfEntity(proj gitlab.Project, buildDef string) request.Project {
-	groupName := ""
+func newMapper(tokenID, providerID uint, config ImportConfig) mapper {
+	return mapper{
+		tokenID:    tokenID,
+		providerID: providerID,
+		gitURL:     newGitURLMapping(config, providerID),
+		names:      newNameMapping(config, providerID),
 
-	if proj.Namespace != nil {
-		groupName = proj.Namespace.FullPath
+		avatarProxyURL: config.AvatarProxy.URL,
 	}
+}
+
+func (m *mapper) mapProjectToWharfEntity(proj gitlab.Project, buildDef string) request.Project {
+	groupName, projectName := m.names.mapNames(proj)
 
 	return request.Project{
-		Name:            proj.Name,
+		Name:            projectName,
 		BuildDefinition: buildDef,
 		Description:     proj.Description,
-		AvatarURL:       proj.AvatarURL,
-		GitURL:          proj.SSHURLToRepo,
+		AvatarURL:       m.mapAvatarURL(proj),
+		GitURL:          m.gitURL.mapGitURL(proj),
 		TokenID:         m.tokenID,
 		ProviderID:      m.providerID,
 		GroupName:       groupName,
@@ -32,9 +46,93 @@ func (m *mapper) mapProjectToWharfEntity(proj gitlab.Project, buildDef string) r
 	}
 }
 
+// mapProjectMetadata returns the given fields of the project, for the fields
+// that Wharf does not store.
+func (m *mapper) mapProjectMetadata(proj gitlab.Project, fields []string) ProjectMetadata {
+	metadata := make(ProjectMetadata, len(fields))
+	for _, field := range fields {
+		switch field {
+		case projectMetadataWebURL:
+			metadata[field] = proj.WebURL
+		case projectMetadataVisibility:
+			metadata[field] = string(proj.Visibility)
+		case projectMetadataTopics:
+			topics := proj.Topics
+			if len(topics) == 0 {
+				// GitLab before v14.0 only sets the deprecated tag list.
+				topics = proj.TagList
+			}
+			metadata[field] = topics
+		case projectMetadataArchived:
+			metadata[field] = proj.Archived
+		case projectMetadataForkedFrom:
+			if proj.ForkedFromProject != nil {
+				metadata[field] = proj.ForkedFromProject.PathWithNamespace
+			}
+		case projectMetadataLastActivityAt:
+			if proj.LastActivityAt != nil {
+				metadata[field] = proj.LastActivityAt
+			}
+		case projectMetadataDefaultBranch:
+			metadata[field] = proj.DefaultBranch
+		}
+	}
+	return metadata
+}
+
+// mapAvatarURL returns the URL of the project's avatar in the avatar proxy,
+// so that avatars of private projects can be shown, or GitLab's URL if the
+// proxy is disabled.
+func (m *mapper) mapAvatarURL(proj gitlab.Project) string {
+	if m.avatarProxyURL == "" || proj.AvatarURL == "" {
+		return proj.AvatarURL
+	}
+	return fmt.Sprintf("%s/import/gitlab/avatars/%d?providerId=%d",
+		strings.TrimSuffix(m.avatarProxyURL, "/"), proj.ID, m.providerID)
+}
+
 func (m *mapper) mapBranchToWharfEntity(branch gitlab.Branch) request.Branch {
 	return request.Branch{
 		Name:    branch.Name,
 		Default: branch.Default,
 	}
 }
+
+// mapTagToWharfEntity returns the tag as a branch, as Wharf builds can be
+// started from any ref but only stores branches.
+func (m *mapper) mapTagToWharfEntity(tag gitlab.Tag) request.Branch {
+	return request.Branch{
+		Name: tag.Name,
+	}
+}
+
+// mapBranchMetadata returns the fields of the branch that Wharf does not
+// store.
+func (m *mapper) mapBranchMetadata(branch gitlab.Branch) BranchMetadata {
+	metadata := BranchMetadata{
+		Branch:    branch.Name,
+		Default:   branch.Default,
+		Protected: branch.Protected,
+	}
+	if branch.Commit != nil {
+		metadata.CommitID = branch.Commit.ID
+		metadata.CommittedDate = branch.Commit.CommittedDate
+	}
+	return metadata
+}
+
+// mapGroupName returns the full path of the project's namespace, which is
+// either a group path such as "default/super-project", or a username for
+// projects in a user's personal namespace.
+func mapGroupName(proj gitlab.Project) string {
+	if proj.Namespace != nil && proj.Namespace.FullPath != "" {
+		return proj.Namespace.FullPath
+	}
+	if i := strings.LastIndexByte(proj.PathWithNamespace, '/'); i >= 0 {
+		return proj.PathWithNamespace[:i]
+	}
+	if proj.Owner != nil {
+		return proj.Owner.Username
+	}
+	return ""
+}
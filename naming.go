@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// Sources of the project name stored in Wharf, as set by the
+// import.providers[].projectNameSource config.
+const (
+	projectNameSourceName = "name"
+	projectNameSourcePath = "path"
+)
+
+// nameTemplateFuncs are the functions that can be used in the
+// import.providers[].groupNameTemplate and .projectNameTemplate configs, in
+// addition to the built-in ones of text/template.
+var nameTemplateFuncs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"replace":    strings.ReplaceAll,
+	"trimPrefix": strings.TrimPrefix,
+	"trimSuffix": strings.TrimSuffix,
+}
+
+// nameTemplateData is what the name templates are executed with. GroupName
+// and ProjectName are the names after the other naming rules are applied.
+type nameTemplateData struct {
+	GroupName   string
+	ProjectName string
+	Project     gitlab.Project
+}
+
+// nameMapping chooses the group and project name of a project that is stored
+// in Wharf. The zero value uses the full namespace path and the display name
+// as reported by GitLab.
+type nameMapping struct {
+	stripGroupPrefix    string
+	groupSeparator      string
+	projectNameSource   string
+	groupNameTemplate   *template.Template
+	projectNameTemplate *template.Template
+}
+
+// newNameMapping returns the naming rules of the provider, or the defaults if
+// the provider has none.
+func newNameMapping(config ImportConfig, providerID uint) nameMapping {
+	for _, provider := range config.Providers {
+		if provider.ProviderID != providerID {
+			continue
+		}
+		names := nameMapping{
+			stripGroupPrefix:  strings.Trim(provider.StripGroupPrefix, "/"),
+			groupSeparator:    provider.GroupSeparator,
+			projectNameSource: provider.ProjectNameSource,
+		}
+		var err error
+		if names.groupNameTemplate, err = parseNameTemplate("groupNameTemplate", provider.GroupNameTemplate); err != nil {
+			log.Error().WithError(err).WithUint("providerId", providerID).Message("Invalid group name template, ignoring it.")
+		}
+		if names.projectNameTemplate, err = parseNameTemplate("projectNameTemplate", provider.ProjectNameTemplate); err != nil {
+			log.Error().WithError(err).WithUint("providerId", providerID).Message("Invalid project name template, ignoring it.")
+		}
+		return names
+	}
+	return nameMapping{}
+}
+
+// isDefault returns true if the names are used as reported by GitLab.
+func (n nameMapping) isDefault() bool {
+	return n.stripGroupPrefix == "" &&
+		n.groupSeparator == "" &&
+		n.projectNameSource != projectNameSourcePath &&
+		n.groupNameTemplate == nil &&
+		n.projectNameTemplate == nil
+}
+
+// mapNames returns the group name and project name of the project in Wharf.
+// The prefix is stripped and the nested groups are flattened before the
+// templates are applied. If a template fails, the name is used as it was
+// before the template.
+func (n nameMapping) mapNames(proj gitlab.Project) (groupName, projectName string) {
+	groupName = mapGroupName(proj)
+	if n.stripGroupPrefix != "" {
+		if groupName == n.stripGroupPrefix {
+			groupName = ""
+		} else {
+			groupName = strings.TrimPrefix(groupName, n.stripGroupPrefix+"/")
+		}
+	}
+	if n.groupSeparator != "" {
+		groupName = strings.ReplaceAll(groupName, "/", n.groupSeparator)
+	}
+	projectName = proj.Name
+	if n.projectNameSource == projectNameSourcePath && proj.Path != "" {
+		projectName = proj.Path
+	}
+
+	data := nameTemplateData{GroupName: groupName, ProjectName: projectName, Project: proj}
+	groupName = applyNameTemplate(n.groupNameTemplate, data, groupName)
+	projectName = applyNameTemplate(n.projectNameTemplate, data, projectName)
+	return groupName, projectName
+}
+
+func applyNameTemplate(tmpl *template.Template, data nameTemplateData, fallback string) string {
+	if tmpl == nil {
+		return fallback
+	}
+	name, err := executeNameTemplate(tmpl, data)
+	if err == nil && name == "" && fallback != "" {
+		err = errors.New("template resulted in an empty name")
+	}
+	if err != nil {
+		log.Warn().
+			WithError(err).
+			WithString("template", tmpl.Name()).
+			WithString("gitLabProject", data.Project.PathWithNamespace).
+			WithString("name", fallback).
+			Message("Failed to apply name template, using the name as-is.")
+		return fallback
+	}
+	return name
+}
+
+// parseNameTemplate returns nil if the template is empty.
+func parseNameTemplate(name, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New(name).Funcs(nameTemplateFuncs).Option("missingkey=error").Parse(text)
+}
+
+func executeNameTemplate(tmpl *template.Template, data nameTemplateData) (string, error) {
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
+
+// validateNameTemplate parses the template and executes it on an example
+// project, so that references to fields that do not exist are found when
+// the config is loaded instead of on import.
+func validateNameTemplate(name, text string) error {
+	tmpl, err := parseNameTemplate(name, text)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	if tmpl == nil {
+		return nil
+	}
+	example := gitlab.Project{
+		ID:                1,
+		Name:              "Example Project",
+		Path:              "example-project",
+		PathWithNamespace: "group/example-project",
+		Namespace:         &gitlab.ProjectNamespace{FullPath: "group"},
+		Owner:             &gitlab.User{Username: "user"},
+	}
+	_, err = executeNameTemplate(tmpl, nameTemplateData{"group", "Example Project", example})
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return nil
+}
+
+func validateProjectNameSource(source string) error {
+	switch source {
+	case "", projectNameSourceName, projectNameSourcePath:
+		return nil
+	default:
+		return fmt.Errorf("invalid projectNameSource %q, must be one of: %s, %s",
+			source, projectNameSourceName, projectNameSourcePath)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/response"
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/wharfapi"
+	"github.com/iver-wharf/wharf-provider-gitlab/testdoubles"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestMapNames(t *testing.T) {
+	proj := gitlab.Project{
+		ID:                84,
+		Name:              "Web App 🚀",
+		Path:              "web-app",
+		PathWithNamespace: "acme/platform/tools/web-app",
+		Namespace:         &gitlab.ProjectNamespace{FullPath: "acme/platform/tools"},
+	}
+	type testCase struct {
+		name        string
+		provider    ProviderConfig
+		wantGroup   string
+		wantProject string
+	}
+	testCases := []testCase{
+		{"default", ProviderConfig{}, "acme/platform/tools", "Web App 🚀"},
+		{"strip prefix", ProviderConfig{StripGroupPrefix: "acme/platform/"}, "tools", "Web App 🚀"},
+		{"strip partial segment", ProviderConfig{StripGroupPrefix: "acme/plat"}, "acme/platform/tools", "Web App 🚀"},
+		{"strip whole group", ProviderConfig{StripGroupPrefix: "acme/platform/tools"}, "", "Web App 🚀"},
+		{"flatten", ProviderConfig{StripGroupPrefix: "acme", GroupSeparator: "-"}, "platform-tools", "Web App 🚀"},
+		{"path", ProviderConfig{ProjectNameSource: projectNameSourcePath}, "acme/platform/tools", "web-app"},
+		{"templates", ProviderConfig{
+			GroupSeparator:      ".",
+			GroupNameTemplate:   `{{ .GroupName | upper }}`,
+			ProjectNameTemplate: `{{ .Project.ID }}-{{ replace .Project.Path "-" "_" }}`,
+		}, "ACME.PLATFORM.TOOLS", "84-web_app"},
+		{"empty template result", ProviderConfig{ProjectNameTemplate: `{{ if false }}x{{ end }}`}, "acme/platform/tools", "Web App 🚀"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.provider.ProviderID = 1
+			names := newNameMapping(ImportConfig{Providers: []ProviderConfig{tc.provider}}, 1)
+			groupName, projectName := names.mapNames(proj)
+			assert.Equal(t, tc.wantGroup, groupName)
+			assert.Equal(t, tc.wantProject, projectName)
+		})
+	}
+}
+
+func TestImportConfigValidateNaming(t *testing.T) {
+	validate := func(provider ProviderConfig) error {
+		provider.ProviderID = 1
+		return ImportConfig{Providers: []ProviderConfig{provider}}.validate()
+	}
+	assert.NoError(t, validate(ProviderConfig{ProjectNameSource: "path"}))
+	assert.Error(t, validate(ProviderConfig{ProjectNameSource: "slug"}))
+	assert.NoError(t, validate(ProviderConfig{GroupNameTemplate: `{{ .Project.Owner.Username | lower }}`}))
+	assert.Error(t, validate(ProviderConfig{GroupNameTemplate: `{{ .GroupName`}))
+	assert.Error(t, validate(ProviderConfig{ProjectNameTemplate: `{{ .Project.NoSuchField }}`}))
+	assert.Error(t, validate(ProviderConfig{ProjectNameTemplate: `{{ kebab .ProjectName }}`}))
+}
+
+func TestRefreshProjectMovedOnlyWhenGitLabPathChanged(t *testing.T) {
+	gitLabProject := &gitlab.Project{
+		ID:                84,
+		Name:              "Web App",
+		Path:              "web-app",
+		PathWithNamespace: "acme/default/web-app",
+		DefaultBranch:     "main",
+		SSHURLToRepo:      "git@gitlab.local:acme/default/web-app.git",
+		Namespace:         &gitlab.ProjectNamespace{FullPath: "acme/default"},
+	}
+	type testCase struct {
+		name      string
+		stored    response.Project
+		wantMoved bool
+		wantErr   bool
+	}
+	testCases := []testCase{
+		{"renamed by rules", response.Project{
+			GroupName: "acme/default",
+			Name:      "Web App",
+			GitURL:    "git@gitlab.local:acme/default/web-app.git",
+		}, false, false},
+		{"moved in GitLab", response.Project{
+			GroupName: "old",
+			Name:      "web-app",
+			GitURL:    "git@gitlab.local:acme/old/web-app.git",
+		}, true, false},
+		// Without a Git URL, the rules that named the project are unknown.
+		{"renamed by rules without Git URL", response.Project{
+			GroupName: "acme/default",
+			Name:      "Web App",
+		}, false, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gitLabMock := new(gitLabClientMock)
+			gitLabMock.On("getProjectByID", 84).Return(gitLabProject, nil)
+			gitLabMock.On("getBuildDefinitionIfExists", 84, "main", []string{BuildDefinitionFileName}).
+				Return(buildDefinitionFile{}, nil)
+			gitLabMock.On("getBranches", 84, gitLabPageCursor{}).Return([]*gitlab.Branch{}, gitLabPaging{}, nil)
+			tc.stored.ProjectID = 1
+			tc.stored.RemoteProjectID = "84"
+			wharfMock := new(testdoubles.WharfClientAPIFetcherMock)
+			wharfMock.On("GetProject", uint(1)).Return(tc.stored, nil)
+			wharfMock.On("UpdateProject", uint(1), mock.Anything).Return(response.Project{}, nil)
+			wharfMock.On("UpdateProjectBranchList", uint(1), mock.Anything).Return([]response.Branch{}, nil)
+
+			config := ImportConfig{Providers: []ProviderConfig{
+				{ProviderID: 1, StripGroupPrefix: "acme", ProjectNameSource: projectNameSourcePath},
+			}}
+			importer := gitLabImporter{
+				gitLabClient: gitLabMock,
+				wharfClient:  wharfMock,
+				mapper:       newMapper(2, 1, config),
+			}
+			result, err := importer.refreshProject(context.Background(), 2, 1, 1)
+			if tc.wantErr {
+				assert.Error(t, err)
+				wharfMock.AssertNotCalled(t, "UpdateProject", uint(1), mock.Anything)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantMoved, result.Moved)
+			assert.Equal(t, "default/web-app", result.NewPath)
+		})
+	}
+}
+
+func TestSyncTagPushUsesProviderNames(t *testing.T) {
+	var push TagPush
+	require.NoError(t, json.Unmarshal([]byte(`{
+  "object_kind": "tag_push",
+  "ref": "refs/tags/v1.0.0",
+  "project_id": 84,
+  "project": {"name": "Web App", "path_with_namespace": "acme/default/web-app"}
+}`), &push))
+
+	gitLabProject := &gitlab.Project{
+		ID:                84,
+		Name:              "Web App",
+		Path:              "web-app",
+		PathWithNamespace: "acme/default/web-app",
+		DefaultBranch:     "main",
+	}
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getProjectByID", 84).Return(gitLabProject, nil)
+	gitLabMock.On("getBranches", 84, gitLabPageCursor{}).Return([]*gitlab.Branch{{Name: "main", Default: true}}, gitLabPaging{}, nil)
+	gitLabMock.On("getTags", 84, gitLabPageCursor{}).Return([]*gitlab.Tag{{Name: "v1.0.0"}}, gitLabPaging{}, nil)
+
+	wharfMock := new(testdoubles.WharfClientAPIFetcherMock)
+	wharfMock.On("GetProjectList", mock.MatchedBy(func(search wharfapi.ProjectSearch) bool {
+		return search.ProviderID == nil && *search.GroupName == "acme/default" && *search.Name == "Web App"
+	})).Return(response.PaginatedProjects{List: []response.Project{
+		// Imported by the renaming provider before it had naming rules.
+		{ProjectID: 1, ProviderID: 1, RemoteProjectID: "84"},
+		{ProjectID: 2, ProviderID: 3, RemoteProjectID: "84"},
+	}}, nil)
+	wharfMock.On("GetProjectList", mock.MatchedBy(func(search wharfapi.ProjectSearch) bool {
+		return search.ProviderID != nil && *search.ProviderID == 1 &&
+			*search.GroupName == "default" && *search.Name == "web-app"
+	})).Return(response.PaginatedProjects{List: []response.Project{
+		{ProjectID: 3, ProviderID: 1, RemoteProjectID: "84"},
+	}}, nil)
+	wharfMock.On("UpdateProjectBranchList", mock.Anything, mock.Anything).Return([]response.Branch{}, nil)
+
+	config := ImportConfig{Providers: []ProviderConfig{
+		{ProviderID: 1, StripGroupPrefix: "acme", ProjectNameSource: projectNameSourcePath},
+		{ProviderID: 3, GitURLProtocol: gitURLProtocolHTTPS},
+	}}
+	newImporter := func(ctx context.Context, providerID uint) (*gitLabImporter, error) {
+		return &gitLabImporter{
+			gitLabClient: gitLabMock,
+			wharfClient:  wharfMock,
+			mapper:       newMapper(2, providerID, config),
+			importTags:   true,
+		}, nil
+	}
+	require.NoError(t, syncTagPush(context.Background(), wharfMock, newImporter, config, push))
+	wharfMock.AssertNotCalled(t, "UpdateProjectBranchList", uint(1), mock.Anything)
+	wharfMock.AssertCalled(t, "UpdateProjectBranchList", uint(2), mock.Anything)
+	wharfMock.AssertCalled(t, "UpdateProjectBranchList", uint(3), mock.Anything)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Names of the GitLab project fields that can be stored as project metadata,
+// as set by the import.projectMetadataFields config.
+const (
+	projectMetadataWebURL         = "webUrl"
+	projectMetadataVisibility     = "visibility"
+	projectMetadataTopics         = "topics"
+	projectMetadataArchived       = "archived"
+	projectMetadataForkedFrom     = "forkedFrom"
+	projectMetadataLastActivityAt = "lastActivityAt"
+	projectMetadataDefaultBranch  = "defaultBranch"
+)
+
+// projectMetadataFieldNames are all the fields that can be stored as project
+// metadata.
+var projectMetadataFieldNames = []string{
+	projectMetadataWebURL,
+	projectMetadataVisibility,
+	projectMetadataTopics,
+	projectMetadataArchived,
+	projectMetadataForkedFrom,
+	projectMetadataLastActivityAt,
+	projectMetadataDefaultBranch,
+}
+
+// ProjectMetadata holds details about a GitLab project that Wharf has no
+// fields for, such as the URL of the project's page in GitLab, by field name.
+// Only the configured fields are included.
+type ProjectMetadata map[string]any
+
+// projectMetadataFields returns the configured fields to store as project
+// metadata, or all fields if none are configured.
+func projectMetadataFields(config ImportConfig) []string {
+	if len(config.ProjectMetadataFields) == 0 {
+		return projectMetadataFieldNames
+	}
+	return config.ProjectMetadataFields
+}
+
+// projectMetadataKey returns the file-safe name of the metadata of a Wharf
+// project.
+func projectMetadataKey(wharfProjectID uint) string {
+	return fmt.Sprintf("wharf-project-%d", wharfProjectID)
+}
+
+func validateProjectMetadataFields(fields []string) error {
+	for _, field := range fields {
+		if !containsString(projectMetadataFieldNames, field) {
+			return fmt.Errorf("unknown field %q, must be one of: %s",
+				field, strings.Join(projectMetadataFieldNames, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestMapProjectMetadata(t *testing.T) {
+	lastActivity := time.Date(2022, 5, 10, 2, 30, 0, 0, time.UTC)
+	proj := gitlab.Project{
+		WebURL:            "https://gitlab.local/default/web",
+		Visibility:        gitlab.InternalVisibility,
+		TagList:           []string{"go"},
+		Archived:          true,
+		ForkedFromProject: &gitlab.ForkParent{PathWithNamespace: "upstream/web"},
+		LastActivityAt:    &lastActivity,
+		DefaultBranch:     "main",
+	}
+	m := mapper{}
+	assert.Equal(t, ProjectMetadata{
+		"webUrl":         "https://gitlab.local/default/web",
+		"visibility":     "internal",
+		"topics":         []string{"go"},
+		"archived":       true,
+		"forkedFrom":     "upstream/web",
+		"lastActivityAt": &lastActivity,
+		"defaultBranch":  "main",
+	}, m.mapProjectMetadata(proj, projectMetadataFieldNames))
+
+	assert.Equal(t, ProjectMetadata{"webUrl": "https://gitlab.local/default/web"},
+		m.mapProjectMetadata(proj, []string{"webUrl"}))
+	assert.Empty(t, m.mapProjectMetadata(gitlab.Project{}, []string{"forkedFrom", "lastActivityAt"}))
+}
+
+func TestImportConfigValidateProjectMetadataFields(t *testing.T) {
+	assert.NoError(t, ImportConfig{ProjectMetadataFields: projectMetadataFieldNames}.validate())
+	assert.Error(t, ImportConfig{ProjectMetadataFields: []string{"webURL"}}.validate())
+}
+
+func TestGetProjectMetadataHandler(t *testing.T) {
+	config := ImportConfig{
+		ProjectMetadataFields: []string{"webUrl", "archived"},
+		ProjectMetadataDir:    t.TempDir(),
+	}
+	importer := gitLabImporter{
+		projectMetadata:       newJSONStore[ProjectMetadata](config.ProjectMetadataDir),
+		projectMetadataFields: projectMetadataFields(config),
+	}
+	importer.saveProjectMetadata(1, &gitlab.Project{ID: 84, WebURL: "https://gitlab.local/default/web"})
+
+	gin.SetMode(gin.TestMode)
+	m := importModule{config: &Config{Import: config}, jobs: newImportJobRegistry()}
+	r := gin.New()
+	m.register(r)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/import/gitlab/projects/1/metadata", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"webUrl":"https://gitlab.local/default/web","archived":false}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/import/gitlab/projects/2/metadata", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestProjectMetadataFields(t *testing.T) {
+	assert.Nil(t, newJSONStore[ProjectMetadata](DefaultConfig.Import.ProjectMetadataDir), "enabled by default")
+	assert.Equal(t, projectMetadataFieldNames, projectMetadataFields(ImportConfig{}))
+	assert.Equal(t, []string{"webUrl"}, projectMetadataFields(ImportConfig{ProjectMetadataFields: []string{"webUrl"}}))
+}
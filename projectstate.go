@@ -0,0 +1,22 @@
+package main
+
+import "fmt"
+
+// projectState is the saved state of an imported GitLab project, for details
+// that Wharf does not store.
+type projectState struct {
+	// BuildDefinitionPath is the path of the build definition file that was
+	// found in the repository, which is tried first on later refreshes.
+	BuildDefinitionPath string `json:"buildDefinitionPath,omitempty"`
+	// GeneratedBuildDefinition is the build definition that was generated
+	// because no file was found, which is reused on later refreshes instead
+	// of listing the repository tree again.
+	GeneratedBuildDefinition string `json:"generatedBuildDefinition,omitempty"`
+}
+
+// projectStateKey returns the file-safe name of the state of a GitLab
+// project from a given provider. The GitLab project ID is used rather than
+// its path, as the path changes when the project is renamed or moved.
+func projectStateKey(providerID uint, gitLabProjectID int) string {
+	return fmt.Sprintf("provider-%d-project-%d", providerID, gitLabProjectID)
+}
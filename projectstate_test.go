@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestGetBuildDefinitionTriesSavedPathFirst(t *testing.T) {
+	configured := []string{".wharf-ci.yml", ".wharf-ci.yaml", ".wharf/ci.yml"}
+	project := &gitlab.Project{ID: 84, DefaultBranch: "main"}
+
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getBuildDefinitionIfExists", 84, "main", configured).
+		Return(buildDefinitionFile{Path: ".wharf/ci.yml", Content: "myStage:\n"}, nil).Once()
+	gitLabMock.On("getBuildDefinitionIfExists", 84, "main", []string{".wharf/ci.yml", ".wharf-ci.yml", ".wharf-ci.yaml"}).
+		Return(buildDefinitionFile{Path: ".wharf/ci.yml", Content: "myStage:\n"}, nil).Once()
+
+	importer := gitLabImporter{
+		gitLabClient:         gitLabMock,
+		mapper:               mapper{tokenID: 2, providerID: 1},
+		projectStates:        newJSONStore[projectState](t.TempDir()),
+		buildDefinitionPaths: configured,
+	}
+
+	_, err := importer.getBuildDefinition(context.Background(), project)
+	require.NoError(t, err, "first lookup")
+	state, ok, err := importer.projectStates.load(projectStateKey(1, 84))
+	require.NoError(t, err)
+	require.True(t, ok, "project state not saved")
+	assert.Equal(t, ".wharf/ci.yml", state.BuildDefinitionPath)
+
+	buildDef, err := importer.getBuildDefinition(context.Background(), project)
+	require.NoError(t, err, "second lookup")
+	assert.Equal(t, ".wharf/ci.yml", buildDef.Path)
+	gitLabMock.AssertExpectations(t)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type scheduledSync struct {
+	config   ScheduledSyncConfig
+	schedule cronSchedule
+}
+
+type scheduler struct {
+	syncs        []scheduledSync
+	jobs         *importJobRegistry
+	newImporter  func(ctx context.Context, providerID uint) (*gitLabImporter, error)
+	currentTime  func() time.Time
+	waitDuration func(context.Context, time.Duration) error
+}
+
+// newScheduler parses the cron expressions of all scheduled syncs in the
+// config, so that invalid ones are reported on startup rather than never
+// running.
+func newScheduler(config *Config, jobs *importJobRegistry) (*scheduler, error) {
+	var syncs []scheduledSync
+	for _, syncConfig := range config.Schedule.Syncs {
+		schedule, err := parseCronSchedule(syncConfig.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("scheduled sync %q: %w", syncConfig.Name, err)
+		}
+		if syncConfig.ProviderID == 0 {
+			return nil, fmt.Errorf("scheduled sync %q: providerId is required", syncConfig.Name)
+		}
+		if err := syncConfig.Scope.validate(); err != nil {
+			return nil, fmt.Errorf("scheduled sync %q: %w", syncConfig.Name, err)
+		}
+		syncs = append(syncs, scheduledSync{syncConfig, schedule})
+	}
+	return &scheduler{
+		syncs: syncs,
+		jobs:  jobs,
+		newImporter: func(ctx context.Context, providerID uint) (*gitLabImporter, error) {
+			wharfClient := newWharfAPIClient(config.API.AuthHeader, config.API.URL)
+			return newGitLabImporterForProvider(ctx, wharfClient, providerID, config.Import)
+		},
+		currentTime:  time.Now,
+		waitDuration: sleepContext,
+	}, nil
+}
+
+// start runs each scheduled sync in its own goroutine. A sync is never run
+// concurrently with itself; if a run takes longer than the time until the next
+// scheduled run, then that run is skipped. Canceling the context aborts the
+// running syncs and stops scheduling new ones.
+func (s *scheduler) start(ctx context.Context) {
+	for _, sync := range s.syncs {
+		log.Info().
+			WithString("sync", sync.config.Name).
+			WithString("cron", sync.config.Cron).
+			WithTime("next", sync.schedule.next(s.currentTime())).
+			Message("Scheduled sync.")
+		go s.runLoop(ctx, sync)
+	}
+}
+
+func (s *scheduler) runLoop(ctx context.Context, sync scheduledSync) {
+	for ctx.Err() == nil {
+		next := sync.schedule.next(s.currentTime())
+		if next.IsZero() {
+			log.Warn().
+				WithString("sync", sync.config.Name).
+				WithString("cron", sync.config.Cron).
+				Message("Scheduled sync never matches any time, stopping it.")
+			return
+		}
+		if err := s.waitDuration(ctx, next.Sub(s.currentTime())); err != nil {
+			return
+		}
+		s.runSync(ctx, sync.config)
+	}
+}
+
+// sleepContext waits for the duration to pass, or returns the error of the
+// context as soon as it is canceled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (s *scheduler) runSync(ctx context.Context, syncConfig ScheduledSyncConfig) error {
+	startedAt := s.currentTime()
+	log.Info().
+		WithString("sync", syncConfig.Name).
+		WithUint("providerId", syncConfig.ProviderID).
+		WithString("group", syncConfig.Group).
+		WithString("project", syncConfig.Project).
+		WithUint("projectId", syncConfig.ProjectID).
+		Message("Starting scheduled sync.")
+
+	importer, err := s.newImporter(ctx, syncConfig.ProviderID)
+	if err != nil {
+		log.Error().
+			WithError(err).
+			WithString("sync", syncConfig.Name).
+			Message("Failed to create importer for scheduled sync.")
+		return err
+	}
+	importer.currentTime = s.currentTime
+	importer.filter = syncConfig.Scope.toFilter()
+
+	i := Import{
+		TokenID:    importer.mapper.tokenID,
+		ProviderID: importer.mapper.providerID,
+		ProjectID:  syncConfig.ProjectID,
+		Group:      syncConfig.Group,
+		Project:    syncConfig.Project,
+		Resume:     true,
+		OnlyActive: syncConfig.OnlyActive,
+	}
+	job, started := s.jobs.start(i.lockKey(i.ProviderID))
+	if !started {
+		log.Info().
+			WithString("sync", syncConfig.Name).
+			WithString("job", job.id).
+			Message("Skipping scheduled sync, as an import of the same projects is already running.")
+		return nil
+	}
+	importer.job = job
+	err = s.jobs.run(importer.job, func() error {
+		_, err := importer.runImport(ctx, i)
+		return err
+	})
+	if err != nil {
+		log.Error().
+			WithError(err).
+			WithString("sync", syncConfig.Name).
+			WithString("job", importer.job.id).
+			Message("Scheduled sync failed.")
+		return err
+	}
+
+	log.Info().
+		WithString("sync", syncConfig.Name).
+		WithString("job", importer.job.id).
+		WithDuration("duration", s.currentTime().Sub(startedAt)).
+		Message("Scheduled sync finished.")
+	return nil
+}
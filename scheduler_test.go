@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/request"
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/response"
+	"github.com/iver-wharf/wharf-provider-gitlab/testdoubles"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestSchedulerRunSyncOnlyActive(t *testing.T) {
+	lastSync := time.Date(2022, 5, 10, 2, 30, 0, 0, time.UTC)
+	now := time.Date(2022, 5, 11, 2, 30, 0, 0, time.UTC)
+	syncConfig := ScheduledSyncConfig{
+		Name:       "nightly",
+		Cron:       "30 2 * * *",
+		ProviderID: 1,
+		Group:      "default",
+		OnlyActive: true,
+	}
+	key := syncStateKey(syncConfig.ProviderID, syncConfig.Group, syncConfig.Project, gitLabProjectFilter{})
+
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getNamespace", "default").Return(&gitlab.Namespace{Kind: "group"}, nil)
+	gitLabMock.
+		On("listProjectsFromGroup", "default", gitLabProjectFilter{LastActivityAfter: &lastSync}, gitLabPageCursor{}).
+		Return([]*gitlab.Project{}, gitLabPaging{}, nil)
+
+	syncStates := newJSONStore[syncState](t.TempDir())
+	s := &scheduler{
+		jobs: newImportJobRegistry(),
+		newImporter: func(_ context.Context, providerID uint) (*gitLabImporter, error) {
+			return &gitLabImporter{
+				gitLabClient: gitLabMock,
+				wharfClient:  new(testdoubles.WharfClientAPIFetcherMock),
+				mapper:       mapper{tokenID: 2, providerID: providerID},
+				syncStates:   syncStates,
+			}, nil
+		},
+		currentTime: func() time.Time { return now },
+	}
+	require.NoError(t, syncStates.save(key, syncState{LastSuccessfulSync: lastSync}))
+
+	err := s.runSync(context.Background(), syncConfig)
+	require.NoError(t, err)
+	gitLabMock.AssertExpectations(t)
+
+	state, ok, err := syncStates.load(key)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.True(t, now.Equal(state.LastSuccessfulSync), "want %s, got %s", now, state.LastSuccessfulSync)
+}
+
+func TestSchedulerRunSyncOnlyActiveIgnoresFilteredSyncs(t *testing.T) {
+	filtered := ScheduledSyncConfig{
+		Name:       "wharf-topic",
+		Cron:       "30 2 * * *",
+		ProviderID: 1,
+		Group:      "default",
+		Scope:      ImportScope{Topic: "wharf"},
+	}
+	unfiltered := ScheduledSyncConfig{
+		Name:       "nightly",
+		Cron:       "30 2 * * *",
+		ProviderID: 1,
+		Group:      "default",
+		OnlyActive: true,
+	}
+
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getNamespace", "default").Return(&gitlab.Namespace{Kind: "group"}, nil)
+	gitLabMock.On("listProjectsFromGroup", "default", gitLabProjectFilter{Topic: "wharf"}, gitLabPageCursor{}).
+		Return([]*gitlab.Project{}, gitLabPaging{}, nil).Once()
+	gitLabMock.On("listProjectsFromGroup", "default", gitLabProjectFilter{}, gitLabPageCursor{}).
+		Return([]*gitlab.Project{}, gitLabPaging{}, nil).Once()
+
+	syncStates := newJSONStore[syncState](t.TempDir())
+	s := &scheduler{
+		jobs: newImportJobRegistry(),
+		newImporter: func(_ context.Context, providerID uint) (*gitLabImporter, error) {
+			return &gitLabImporter{
+				gitLabClient: gitLabMock,
+				wharfClient:  new(testdoubles.WharfClientAPIFetcherMock),
+				mapper:       mapper{tokenID: 2, providerID: providerID},
+				syncStates:   syncStates,
+			}, nil
+		},
+		currentTime: time.Now,
+	}
+
+	require.NoError(t, s.runSync(context.Background(), filtered))
+	require.NoError(t, s.runSync(context.Background(), unfiltered))
+	gitLabMock.AssertExpectations(t)
+}
+
+func TestSchedulerRunSyncKeepsRefreshingWhenAProjectFails(t *testing.T) {
+	syncConfig := ScheduledSyncConfig{
+		Name:       "nightly",
+		Cron:       "30 2 * * *",
+		ProviderID: 1,
+		Group:      "default",
+	}
+	newProject := func(id int, name string) *gitlab.Project {
+		return &gitlab.Project{
+			ID:                id,
+			Name:              name,
+			PathWithNamespace: "default/" + name,
+			Namespace:         &gitlab.ProjectNamespace{FullPath: "default"},
+			EmptyRepo:         true,
+		}
+	}
+	broken, web, api := newProject(1, "broken"), newProject(2, "web"), newProject(3, "api")
+
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getNamespace", "default").Return(&gitlab.Namespace{Kind: "group"}, nil)
+	gitLabMock.On("listProjectsFromGroup", "default", gitLabProjectFilter{}, gitLabPageCursor{}).
+		Return([]*gitlab.Project{broken, web, api}, gitLabPaging{}, nil)
+	gitLabMock.On("getProjectByID", 1).Return(broken, nil)
+
+	wharfMock := new(testdoubles.WharfClientAPIFetcherMock)
+	wharfMock.On("CreateProject", mock.MatchedBy(func(proj request.Project) bool {
+		return proj.Name == "broken"
+	})).Return(response.Project{}, errors.New("400 Bad Request"))
+	wharfMock.On("CreateProject", mock.Anything).Return(response.Project{ProjectID: 5}, nil)
+
+	checkpoints := newJSONStore[importCheckpoint](t.TempDir())
+	s := &scheduler{
+		jobs: newImportJobRegistry(),
+		newImporter: func(_ context.Context, providerID uint) (*gitLabImporter, error) {
+			return &gitLabImporter{
+				gitLabClient: gitLabMock,
+				wharfClient:  wharfMock,
+				mapper:       mapper{tokenID: 2, providerID: providerID},
+				checkpoints:  checkpoints,
+			}, nil
+		},
+		currentTime: time.Now,
+	}
+
+	for run := 1; run <= 2; run++ {
+		assert.Error(t, s.runSync(context.Background(), syncConfig), "run %d", run)
+		for _, name := range []string{"broken", "web", "api"} {
+			calls := 0
+			for _, call := range wharfMock.Calls {
+				if call.Method == "CreateProject" && call.Arguments.Get(0).(request.Project).Name == name {
+					calls++
+				}
+			}
+			assert.Equal(t, run, calls, "run %d: imports of %q", run, name)
+		}
+	}
+}
+
+func TestSchedulerStopsWaitingWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	schedule, err := parseCronSchedule("30 2 * * *")
+	require.NoError(t, err)
+	s := &scheduler{
+		jobs:         newImportJobRegistry(),
+		currentTime:  time.Now,
+		waitDuration: sleepContext,
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.runLoop(ctx, scheduledSync{ScheduledSyncConfig{Name: "nightly"}, schedule})
+		close(stopped)
+	}()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduler kept waiting for the next run after being canceled")
+	}
+}
+
+func TestNewSchedulerInvalidCron(t *testing.T) {
+	config := &Config{Schedule: ScheduleConfig{Syncs: []ScheduledSyncConfig{
+		{Name: "broken", Cron: "every night", ProviderID: 1},
+	}}}
+	_, err := newScheduler(config, newImportJobRegistry())
+	assert.Error(t, err)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// syncState is the saved state of a recurring sync of projects from GitLab.
+type syncState struct {
+	// LastSuccessfulSync is when the last successful sync was started.
+	LastSuccessfulSync time.Time `json:"lastSuccessfulSync"`
+}
+
+// syncStateKey returns the file-safe name of the sync state for a sync of a
+// given group, or project in that group, from a given provider. An empty
+// group means all projects. Syncs with different filters import different
+// projects, so they get different sync states, the same way as checkpoints.
+func syncStateKey(providerID uint, group, project string, filter gitLabProjectFilter) string {
+	var key string
+	switch {
+	case group == "":
+		key = fmt.Sprintf("provider-%d-all", providerID)
+	case project == "":
+		key = fmt.Sprintf("provider-%d-group-%s", providerID, url.PathEscape(group))
+	default:
+		key = fmt.Sprintf("provider-%d-project-%s", providerID, url.PathEscape(group+"/"+project))
+	}
+	if filterKey := filter.key(); filterKey != "" {
+		key += "@" + filterKey
+	}
+	return key
+}
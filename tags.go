@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/request"
+	"github.com/xanzy/go-gitlab"
+)
+
+// getTagsToImport returns the tags of the project to add to its branches in
+// Wharf, as set by the import.importTags and import.tagPatterns configs. Tags
+// with the same name as a branch are skipped, as Wharf could not tell them
+// apart.
+func (importer gitLabImporter) getTagsToImport(ctx context.Context, gitLabProject *gitlab.Project, branchNames map[string]bool) ([]request.Branch, error) {
+	if !importer.importTags || gitLabProject.EmptyRepo {
+		return nil, nil
+	}
+	var tags []request.Branch
+	cursor, hasMore := gitLabPageCursor{}, true
+	for hasMore {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		page, paging, err := importer.gitLabClient.getTags(ctx, gitLabProject.ID, cursor)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range page {
+			if !matchesBranchPatterns(importer.tagPatterns, tag.Name) {
+				continue
+			}
+			if branchNames[tag.Name] {
+				log.Warn().
+					WithInt("gitLabProjectId", gitLabProject.ID).
+					WithString("tag", tag.Name).
+					Message("Skipping tag with the same name as a branch.")
+				continue
+			}
+			tags = append(tags, importer.mapper.mapTagToWharfEntity(*tag))
+		}
+		cursor, hasMore = paging.next()
+	}
+	return tags, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/request"
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/model/response"
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/wharfapi"
+	"github.com/iver-wharf/wharf-provider-gitlab/testdoubles"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestRefreshBranchesImportsTags(t *testing.T) {
+	project := &gitlab.Project{ID: 84, DefaultBranch: "main"}
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getBranches", 84, gitLabPageCursor{}).Return([]*gitlab.Branch{
+		{Name: "main", Default: true},
+		{Name: "v2"},
+	}, gitLabPaging{}, nil)
+	gitLabMock.On("getTags", 84, gitLabPageCursor{}).Return([]*gitlab.Tag{
+		{Name: "v1.0.0"},
+		{Name: "v2"},
+		{Name: "nightly"},
+	}, gitLabPaging{}, nil)
+	wharfMock := new(testdoubles.WharfClientAPIFetcherMock)
+	wharfMock.On("UpdateProjectBranchList", uint(1), mock.Anything).Return([]response.Branch{}, nil)
+
+	importer := gitLabImporter{
+		gitLabClient: gitLabMock,
+		wharfClient:  wharfMock,
+		mapper:       mapper{tokenID: 2, providerID: 1},
+		importTags:   true,
+		tagPatterns:  []string{"v*"},
+	}
+	require.NoError(t, importer.refreshBranches(context.Background(), 1, project))
+	wharfMock.AssertCalled(t, "UpdateProjectBranchList", uint(1), []request.Branch{
+		{Name: "main", Default: true},
+		{Name: "v2"},
+		{Name: "v1.0.0"},
+	})
+}
+
+func TestRefreshBranchesWithoutTags(t *testing.T) {
+	project := &gitlab.Project{ID: 84, DefaultBranch: "main"}
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getBranches", 84, gitLabPageCursor{}).Return([]*gitlab.Branch{{Name: "main", Default: true}}, gitLabPaging{}, nil)
+	wharfMock := new(testdoubles.WharfClientAPIFetcherMock)
+	wharfMock.On("UpdateProjectBranchList", uint(1), mock.Anything).Return([]response.Branch{}, nil)
+
+	importer := gitLabImporter{gitLabClient: gitLabMock, wharfClient: wharfMock}
+	require.NoError(t, importer.refreshBranches(context.Background(), 1, project))
+	gitLabMock.AssertNotCalled(t, "getTags", mock.Anything, mock.Anything)
+}
+
+func TestSyncTagPush(t *testing.T) {
+	var push TagPush
+	require.NoError(t, json.Unmarshal([]byte(`{
+  "object_kind": "tag_push",
+  "event_name": "tag_push",
+  "ref": "refs/tags/v1.0.0",
+  "project_id": 84,
+  "project": {"name": "web", "path_with_namespace": "default/web"}
+}`), &push))
+
+	gitLabProject := &gitlab.Project{ID: 84, DefaultBranch: "main"}
+	gitLabMock := new(gitLabClientMock)
+	gitLabMock.On("getProjectByID", 84).Return(gitLabProject, nil)
+	gitLabMock.On("getBranches", 84, gitLabPageCursor{}).Return([]*gitlab.Branch{{Name: "main", Default: true}}, gitLabPaging{}, nil)
+	gitLabMock.On("getTags", 84, gitLabPageCursor{}).Return([]*gitlab.Tag{{Name: "v1.0.0"}}, gitLabPaging{}, nil)
+
+	wharfMock := new(testdoubles.WharfClientAPIFetcherMock)
+	wharfMock.On("GetProjectList", mock.MatchedBy(func(search wharfapi.ProjectSearch) bool {
+		return *search.GroupName == "default" && *search.Name == "web"
+	})).Return(response.PaginatedProjects{List: []response.Project{
+		{ProjectID: 1, ProviderID: 1, RemoteProjectID: "84"},
+		{ProjectID: 2, ProviderID: 3, RemoteProjectID: "12"},
+	}}, nil)
+	wharfMock.On("UpdateProjectBranchList", uint(1), mock.Anything).Return([]response.Branch{}, nil)
+
+	var providerIDs []uint
+	newImporter := func(ctx context.Context, providerID uint) (*gitLabImporter, error) {
+		providerIDs = append(providerIDs, providerID)
+		return &gitLabImporter{
+			gitLabClient: gitLabMock,
+			wharfClient:  wharfMock,
+			mapper:       mapper{tokenID: 2, providerID: providerID},
+			importTags:   true,
+		}, nil
+	}
+	require.NoError(t, syncTagPush(context.Background(), wharfMock, newImporter, ImportConfig{}, push))
+	assert.Equal(t, []uint{1}, providerIDs)
+	wharfMock.AssertCalled(t, "UpdateProjectBranchList", uint(1), []request.Branch{
+		{Name: "main", Default: true},
+		{Name: "v1.0.0"},
+	})
+	wharfMock.AssertNotCalled(t, "UpdateProjectBranchList", uint(2), mock.Anything)
+}
+
+func TestGitLabTriggerHandlerVerifiesToken(t *testing.T) {
+	const tagPush = `{"object_kind": "tag_push", "project_id": 84}`
+	gin.SetMode(gin.TestMode)
+	config := &Config{Import: ImportConfig{TriggerToken: "secret"}}
+	m := importModule{config: config, jobs: newImportJobRegistry()}
+	r := gin.New()
+	m.register(r)
+	trigger := func(token, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/import/gitlab/trigger", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("X-Gitlab-Token", token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, trigger("", tagPush))
+	assert.Equal(t, http.StatusUnauthorized, trigger("wrong", tagPush))
+	assert.Equal(t, http.StatusBadRequest, trigger("secret", "{"))
+	assert.Equal(t, http.StatusOK, trigger("secret", tagPush))
+
+	// Without a token, tag pushes are rejected before the Wharf API is used.
+	config.Import = ImportConfig{ImportTags: true}
+	assert.Equal(t, http.StatusForbidden, trigger("", tagPush))
+}
+
+func TestGitLabTriggerHandlerConflictsWithRunningTagPush(t *testing.T) {
+	const tagPush = `{"object_kind": "tag_push", "project_id": 84}`
+	gin.SetMode(gin.TestMode)
+	m := importModule{
+		config: &Config{Import: ImportConfig{ImportTags: true, TriggerToken: "secret"}},
+		jobs:   newImportJobRegistry(),
+	}
+	r := gin.New()
+	m.register(r)
+
+	running, started := m.jobs.start(tagPushLockKey(84))
+	require.True(t, started)
+	defer m.jobs.finish(running, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/import/gitlab/trigger", strings.NewReader(tagPush))
+	req.Header.Set("X-Gitlab-Token", "secret")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, running.eventsURL(), w.Header().Get("Location"))
+}
+
+func TestEventTypeName(t *testing.T) {
+	assert.Equal(t, TagPushEvent, Event{Kind: "tag_push"}.typeName())
+	assert.Equal(t, RepositoryUpdateEvent, Event{Name: "repository_update", Kind: "push"}.typeName())
+}
@@ -1,18 +1,212 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
+	"github.com/iver-wharf/wharf-api-client-go/v2/pkg/wharfapi"
+	"github.com/iver-wharf/wharf-core/pkg/ginutil"
+	"github.com/iver-wharf/wharf-core/pkg/problem"
 )
 
-func runGitLabTriggerHandler(c *gin.Context) {
+func (m importModule) runGitLabTriggerHandler(c *gin.Context) {
 	log.Debug().Message("GitLab triggered.")
+	if !m.verifyTriggerTokenWritesProblem(c) {
+		return
+	}
 
 	var event Event
 	if err := c.ShouldBindBodyWith(&event, binding.JSON); err != nil {
-		log.Panic().WithError(err).Message("Could not bind event.")
+		ginutil.WriteInvalidBindError(c, err, "The event could not be parsed.")
+		return
+	}
+	log.Info().WithString("event", event.typeName()).Message("Successfully binded event.")
+
+	if event.typeName() == TagPushEvent {
+		m.syncTagPushWritesProblem(c)
 	}
-	log.Info().WithString("event", event.Name).Message("Successfully binded event.")
 
 	log.Debug().Message("GitLab trigger finished.")
 }
+
+// verifyTriggerTokenWritesProblem compares the secret token that GitLab sends
+// in the X-Gitlab-Token header of its webhooks to the import.triggerToken
+// config. All requests are let through if no token is configured, as tag
+// push events are then rejected instead.
+func (m importModule) verifyTriggerTokenWritesProblem(c *gin.Context) bool {
+	want := m.config.Import.TriggerToken
+	if want == "" {
+		return true
+	}
+	got := c.GetHeader("X-Gitlab-Token")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		ginutil.WriteProblem(c, problem.Response{
+			Type:   "/prob/provider/gitlab/invalid-trigger-token",
+			Title:  "Invalid trigger token.",
+			Status: http.StatusUnauthorized,
+			Detail: "The X-Gitlab-Token header does not match the secret token set by the import.triggerToken config.",
+		})
+		return false
+	}
+	return true
+}
+
+// syncTagPushWritesProblem refreshes the branches of the Wharf projects of
+// the GitLab project that a tag was pushed to or deleted from, so that its
+// tags are kept in sync, as set by the import.importTags config.
+func (m importModule) syncTagPushWritesProblem(c *gin.Context) {
+	var push TagPush
+	if err := c.ShouldBindBodyWith(&push, binding.JSON); err != nil {
+		ginutil.WriteInvalidBindError(c, err, "The tag push event could not be parsed.")
+		return
+	}
+	if !m.config.Import.ImportTags {
+		log.Warn().
+			WithString("project", push.Project.PathWithNamespace).
+			Message("Importing tags is disabled by the import.importTags config, ignoring tag push.")
+		return
+	}
+	if m.config.Import.TriggerToken == "" {
+		log.Warn().
+			WithString("project", push.Project.PathWithNamespace).
+			Message("No trigger token is configured, so the sender cannot be verified, ignoring tag push.")
+		ginutil.WriteProblem(c, problem.Response{
+			Type:   "/prob/provider/gitlab/trigger-token-missing",
+			Title:  "Trigger token not configured.",
+			Status: http.StatusForbidden,
+			Detail: "Tag pushes are only synced when the import.triggerToken config is set, " +
+				"as the sender of the event cannot be verified otherwise.",
+		})
+		return
+	}
+
+	wharfClient := newWharfAPIClient(m.config.API.AuthHeader, m.config.API.URL)
+	job, started := m.jobs.start(tagPushLockKey(push.ProjectID))
+	if !started {
+		writeImportConflictProblem(c, job)
+		return
+	}
+	newImporter := func(ctx context.Context, providerID uint) (*gitLabImporter, error) {
+		importer, err := newGitLabImporterForProvider(ctx, wharfClient, providerID, m.config.Import)
+		if err != nil {
+			return nil, err
+		}
+		importer.job = job
+		return importer, nil
+	}
+	err := m.jobs.run(job, func() error {
+		return syncTagPush(c.Request.Context(), wharfClient, newImporter, m.config.Import, push)
+	})
+	if err != nil {
+		writeImportErrorProblem(c, err, fmt.Sprintf(
+			"Unable to sync the tags of GitLab project %q", push.Project.PathWithNamespace))
+	}
+}
+
+// tagPushLockKey returns the key of the job that syncs the tags of a GitLab
+// project after a tag push. The Wharf projects it refreshes are only known
+// once the job runs, so they are locked one by one while it does.
+func tagPushLockKey(gitLabProjectID int) string {
+	return fmt.Sprintf("tag-push-project-%d", gitLabProjectID)
+}
+
+// syncTagPush refreshes the branches, and with them the tags, of each Wharf
+// project imported from the GitLab project in the event. The Wharf projects
+// are looked up by name, and those with a different remote project ID are
+// skipped, as they were imported from another GitLab project or instance.
+//
+// Providers with naming rules in the import.providers config are looked up
+// by the names the rules give the GitLab project, which requires fetching it
+// from each of those providers first.
+func syncTagPush(ctx context.Context, wharfClient wharfClientAPIFetcher, newImporter func(ctx context.Context, providerID uint) (*gitLabImporter, error), config ImportConfig, push TagPush) error {
+	groupName := push.Project.PathWithNamespace
+	if i := strings.LastIndexByte(groupName, '/'); i >= 0 {
+		groupName = groupName[:i]
+	}
+	searches := []wharfapi.ProjectSearch{{
+		GroupName: &groupName,
+		Name:      &push.Project.Name,
+	}}
+	renamingProviders := make(map[uint]bool)
+	for _, provider := range config.Providers {
+		if newNameMapping(config, provider.ProviderID).isDefault() {
+			continue
+		}
+		renamingProviders[provider.ProviderID] = true
+		search, err := tagPushProviderProjectSearch(ctx, newImporter, provider.ProviderID, push)
+		if err != nil {
+			log.Warn().
+				WithError(err).
+				WithUint("providerId", provider.ProviderID).
+				WithInt("gitLabProjectId", push.ProjectID).
+				Message("Failed to get GitLab project of tag push from provider, skipping provider.")
+			continue
+		}
+		searches = append(searches, search)
+	}
+
+	remoteProjectID := strconv.Itoa(push.ProjectID)
+	for _, search := range searches {
+		projects, err := wharfClient.GetProjectList(ctx, search)
+		if err != nil {
+			return err
+		}
+		for _, proj := range projects.List {
+			if proj.RemoteProjectID != "" && proj.RemoteProjectID != remoteProjectID {
+				continue
+			}
+			if search.ProviderID == nil && renamingProviders[proj.ProviderID] {
+				// Found by the names GitLab reports, which are not the names
+				// this provider gives the project.
+				continue
+			}
+			importer, err := newImporter(ctx, proj.ProviderID)
+			if err != nil {
+				return err
+			}
+			gitLabProject, err := importer.gitLabClient.getProjectByID(ctx, push.ProjectID)
+			if err != nil {
+				return err
+			}
+			unlock, err := importer.job.lockProject(ctx, proj.ProviderID, gitLabProject.ID)
+			if err != nil {
+				return err
+			}
+			err = importer.refreshBranches(ctx, proj.ProjectID, gitLabProject)
+			unlock()
+			if err != nil {
+				return err
+			}
+			log.Info().
+				WithUint("projectId", proj.ProjectID).
+				WithString("ref", push.Ref).
+				Message("Synced tags after tag push.")
+		}
+	}
+	return nil
+}
+
+// tagPushProviderProjectSearch returns a search for the Wharf projects of the
+// provider, using the names its naming rules give the pushed GitLab project.
+func tagPushProviderProjectSearch(ctx context.Context, newImporter func(ctx context.Context, providerID uint) (*gitLabImporter, error), providerID uint, push TagPush) (wharfapi.ProjectSearch, error) {
+	importer, err := newImporter(ctx, providerID)
+	if err != nil {
+		return wharfapi.ProjectSearch{}, err
+	}
+	gitLabProject, err := importer.gitLabClient.getProjectByID(ctx, push.ProjectID)
+	if err != nil {
+		return wharfapi.ProjectSearch{}, err
+	}
+	groupName, projectName := importer.mapper.names.mapNames(*gitLabProject)
+	return wharfapi.ProjectSearch{
+		GroupName:  &groupName,
+		Name:       &projectName,
+		ProviderID: &providerID,
+	}, nil
+}